@@ -0,0 +1,200 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Claims are arbitrary objects which are only known to the render phase as
+// unstructured objects, so the types in this file are never registered with
+// the scheme. They describe the shape of the status which the render phase
+// writes onto a claim, and are converted to and from unstructured content
+// when the claim is read or written.
+
+// ClaimPhase is a high-level summary of where a claim is in its render lifecycle.
+type ClaimPhase string
+
+// Recognized claim phases.
+const (
+	// ClaimPhasePending means that the claim has been seen, but no hooks have been started yet.
+	ClaimPhasePending ClaimPhase = "Pending"
+
+	// ClaimPhaseRendering means that at least one hook is still running.
+	ClaimPhaseRendering ClaimPhase = "Rendering"
+
+	// ClaimPhaseRendered means that every hook for the claim has finished successfully.
+	ClaimPhaseRendered ClaimPhase = "Rendered"
+
+	// ClaimPhaseDeleting means that the claim is being deleted, and its delete hooks are still running.
+	ClaimPhaseDeleting ClaimPhase = "Deleting"
+
+	// ClaimPhaseFailed means that at least one hook failed, or that the hooks could not be run at all.
+	ClaimPhaseFailed ClaimPhase = "Failed"
+
+	// ClaimPhasePlanned means that changes to the claim are being planned, or are waiting for approval.
+	ClaimPhasePlanned ClaimPhase = "Planned"
+)
+
+// HookPhase is a high-level summary of where an individual hook is in its execution.
+type HookPhase string
+
+// Recognized hook phases.
+const (
+	HookPhasePending   HookPhase = "Pending"
+	HookPhaseRunning   HookPhase = "Running"
+	HookPhaseSucceeded HookPhase = "Succeeded"
+	HookPhaseFailed    HookPhase = "Failed"
+)
+
+// ClaimStatus is the status which is written to a claim by the render phase.
+type ClaimStatus struct {
+	runtimev1alpha1.ConditionedStatus `json:",inline"`
+
+	Phase ClaimPhase `json:"phase,omitempty"`
+
+	// Event is the event whose hooks were most recently run for the claim.
+	Event EventName `json:"event,omitempty"`
+
+	// Hooks has the status of each hook which was executed for the most recent render,
+	// in the order that the hooks are configured.
+	Hooks []HookStatus `json:"hooks,omitempty"`
+
+	// LastRenderTime is the last time that hooks were started for the claim.
+	LastRenderTime *metav1.Time `json:"lastRenderTime,omitempty"`
+
+	// ObservedGeneration is the generation of the claim which was most recently rendered.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// StackRevision is the revision of the claim's behavior which the claim's
+	// hooks were most recently run with. See the documentation of RolloutStrategy.
+	StackRevision string `json:"stackRevision,omitempty"`
+
+	// Message has details about the most recent failure, if there is one.
+	Message string `json:"message,omitempty"`
+
+	// Plan is what the hooks for the claim would change, if changes to the claim
+	// need approval before they are applied.
+	Plan *ClaimPlan `json:"plan,omitempty"`
+}
+
+// HookStatus is the status of an individual hook which was executed for a claim.
+type HookStatus struct {
+	runtimev1alpha1.ConditionedStatus `json:",inline"`
+
+	// Index is the position of the hook in the list of hooks configured for its event.
+	Index int `json:"index"`
+
+	Directory string `json:"directory,omitempty"`
+	Engine    string `json:"engine,omitempty"`
+
+	Phase HookPhase `json:"phase,omitempty"`
+
+	// JobName is the name of the Job which is executing the hook, if the engine uses a Job.
+	JobName string `json:"jobName,omitempty"`
+
+	// Resources are the objects which the hook applied the last time that it
+	// succeeded. They are the hook's inventory, which is used to prune the
+	// objects that the hook stops rendering.
+	Resources []corev1.ObjectReference `json:"resources,omitempty"`
+
+	// Message has details about a failure of the hook, if there is one.
+	Message string `json:"message,omitempty"`
+}
+
+// Changes to a claim can be planned before they are applied, either because the
+// stack configuration requires approval for every claim, or because the claim has
+// the plan annotation. While approval is required, the hooks for the claim are
+// rendered without being applied, and what they would create, update and delete
+// is recorded as the claim's plan. The hooks are only run once the claim's
+// approval annotation is set to the ID of the plan. Plans which don't change
+// anything don't need approval.
+//
+// A plan is made again whenever the hooks' inputs change, and the new plan has a
+// new ID, so an approval only ever applies the changes that were approved. Delete
+// hooks aren't planned.
+
+// PlanPhase is a high-level summary of where the plan for a claim is.
+type PlanPhase string
+
+// Recognized plan phases.
+const (
+	// PlanPhasePlanning means that at least one hook is still being planned.
+	PlanPhasePlanning PlanPhase = "Planning"
+
+	// PlanPhaseAwaitingApproval means that the plan is complete, and its changes
+	// are waiting for approval.
+	PlanPhaseAwaitingApproval PlanPhase = "AwaitingApproval"
+
+	// PlanPhaseApproved means that the plan was approved, or that it doesn't
+	// change anything, so the hooks are run.
+	PlanPhaseApproved PlanPhase = "Approved"
+
+	// PlanPhaseFailed means that at least one hook couldn't be planned.
+	PlanPhaseFailed PlanPhase = "Failed"
+)
+
+// ClaimPlan is what running the hooks for a claim would change.
+type ClaimPlan struct {
+	// ID identifies the plan's changes. Setting the claim's approval annotation
+	// to it lets the hooks apply the changes.
+	ID string `json:"id,omitempty"`
+
+	Phase PlanPhase `json:"phase,omitempty"`
+
+	// Event is the event whose hooks were planned.
+	Event EventName `json:"event,omitempty"`
+
+	// Generation is the generation of the claim which was planned.
+	Generation int64 `json:"generation,omitempty"`
+
+	// Hooks has the plan for each hook, in the order that the hooks are
+	// configured.
+	Hooks []HookPlan `json:"hooks,omitempty"`
+
+	// Message has details about a failure to plan, if there is one.
+	Message string `json:"message,omitempty"`
+}
+
+// HookPlan is what running an individual hook would change.
+type HookPlan struct {
+	// Index is the position of the hook in the list of hooks configured for its event.
+	Index int `json:"index"`
+
+	Phase HookPhase `json:"phase,omitempty"`
+
+	// JobName is the name of the Job which planned the hook, if the engine uses a
+	// Job. The full diff of the changes is kept in the config map with the same
+	// name.
+	JobName string `json:"jobName,omitempty"`
+
+	// Resources are the objects which the hook would apply.
+	Resources []corev1.ObjectReference `json:"resources,omitempty"`
+
+	// Create are the objects which would be created.
+	Create []corev1.ObjectReference `json:"create,omitempty"`
+
+	// Update are the existing objects which would be changed.
+	Update []corev1.ObjectReference `json:"update,omitempty"`
+
+	// Delete are the objects which the hook applied before, but would prune.
+	Delete []corev1.ObjectReference `json:"delete,omitempty"`
+
+	// Message has details about a failure to plan the hook, if there is one.
+	Message string `json:"message,omitempty"`
+}
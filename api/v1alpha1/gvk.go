@@ -0,0 +1,186 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// The GVK should be in domain format, so Kind.group/version. Kinds in the core
+// group, which has no name, are written as Kind/version.
+type GVK string
+
+// GroupVersionKind parses the GVK. An error is returned if the GVK isn't in
+// domain format.
+func (g GVK) GroupVersionKind() (schema.GroupVersionKind, error) {
+	invalid := fmt.Errorf("%q is not in the format Kind.group/version", g)
+
+	slash := strings.Index(string(g), "/")
+	if slash == -1 {
+		return schema.GroupVersionKind{}, invalid
+	}
+
+	// Kinds can't have dots in them, but groups can, so everything after the first dot is the group.
+	kindGroup := strings.SplitN(string(g[:slash]), ".", 2)
+	gvk := schema.GroupVersionKind{
+		Kind:    kindGroup[0],
+		Version: string(g[slash+1:]),
+	}
+	if len(kindGroup) == 2 {
+		gvk.Group = kindGroup[1]
+		if gvk.Group == "" {
+			return schema.GroupVersionKind{}, invalid
+		}
+	}
+
+	if gvk.Kind == "" || gvk.Version == "" || strings.Contains(gvk.Version, "/") {
+		return schema.GroupVersionKind{}, invalid
+	}
+
+	return gvk, nil
+}
+
+// Selector converts the GVK to the selector which matches exactly the same
+// resources.
+func (g GVK) Selector() (GVKSelector, error) {
+	gvk, err := g.GroupVersionKind()
+	if err != nil {
+		return GVKSelector{}, err
+	}
+
+	return GVKSelector{
+		Group:    gvk.Group,
+		Kind:     gvk.Kind,
+		Versions: []string{gvk.Version},
+	}, nil
+}
+
+// GVKSelector selects resources by their group, kind and version.
+//
+// A selector may list the versions which it matches, or bound them with a
+// minimum and a maximum version, or both. Versions are compared in Kubernetes
+// order, so v1alpha1 < v1alpha2 < v1beta1 < v1 < v2. A selector which doesn't
+// restrict its versions matches every version of its kind. Claims of a kind
+// are only ever rendered at one version, which is the highest installed version
+// that the selector matches.
+type GVKSelector struct {
+	// Group is the API group of the resources. It is empty for the core group.
+	Group string `json:"group,omitempty"`
+	Kind  string `json:"kind"`
+
+	// Versions are the versions which are matched.
+	Versions []string `json:"versions,omitempty"`
+
+	// MinVersion is the lowest version which is matched.
+	MinVersion string `json:"minVersion,omitempty"`
+
+	// MaxVersion is the highest version which is matched.
+	MaxVersion string `json:"maxVersion,omitempty"`
+}
+
+// GroupKind returns the group and kind which the selector matches.
+func (s GVKSelector) GroupKind() schema.GroupKind {
+	return schema.GroupKind{Group: s.Group, Kind: s.Kind}
+}
+
+// Matches returns true if the selector matches the given GVK.
+func (s GVKSelector) Matches(gvk schema.GroupVersionKind) bool {
+	return gvk.GroupKind() == s.GroupKind() && s.MatchesVersion(gvk.Version)
+}
+
+// MatchesVersion returns true if the selector matches the given version of its
+// kind.
+func (s GVKSelector) MatchesVersion(v string) bool {
+	if len(s.Versions) > 0 && !contains(s.Versions, v) {
+		return false
+	}
+	if s.MinVersion != "" && version.CompareKubeAwareVersionStrings(v, s.MinVersion) < 0 {
+		return false
+	}
+	if s.MaxVersion != "" && version.CompareKubeAwareVersionStrings(v, s.MaxVersion) > 0 {
+		return false
+	}
+	return true
+}
+
+// String describes the selector in a format similar to a GVK, such as
+// Kind.group/v1alpha1,v1beta1 or Kind.group/>=v1alpha1.
+func (s GVKSelector) String() string {
+	versions := make([]string, 0)
+	versions = append(versions, s.Versions...)
+	if s.MinVersion != "" {
+		versions = append(versions, ">="+s.MinVersion)
+	}
+	if s.MaxVersion != "" {
+		versions = append(versions, "<="+s.MaxVersion)
+	}
+	if len(versions) == 0 {
+		versions = append(versions, "*")
+	}
+
+	kindGroup := s.Kind
+	if s.Group != "" {
+		kindGroup = s.Kind + "." + s.Group
+	}
+
+	return kindGroup + "/" + strings.Join(versions, ",")
+}
+
+// ResourceBehaviors returns all of the configured behaviors, with the behaviors
+// which are configured in the legacy format converted to use selectors. The
+// behaviors are in the order that they are matched in. Legacy behaviors whose
+// GVKs can't be parsed are left out.
+func (b *StackConfigurationBehaviors) ResourceBehaviors() []ResourceBehavior {
+	rbs := make([]ResourceBehavior, 0, len(b.Resources)+len(b.CRDs))
+	rbs = append(rbs, b.Resources...)
+
+	keys := make([]string, 0, len(b.CRDs))
+	for gvk := range b.CRDs {
+		keys = append(keys, string(gvk))
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		selector, err := GVK(key).Selector()
+		if err != nil {
+			continue
+		}
+
+		rbs = append(rbs, ResourceBehavior{
+			Selector:                   selector,
+			StackConfigurationBehavior: b.CRDs[GVK(key)],
+		})
+	}
+
+	return rbs
+}
+
+// BehaviorFor returns the first configured behavior which matches the given
+// GVK, if there is one.
+func (b *StackConfigurationBehaviors) BehaviorFor(gvk schema.GroupVersionKind) (*StackConfigurationBehavior, bool) {
+	for _, rb := range b.ResourceBehaviors() {
+		if rb.Selector.Matches(gvk) {
+			scb := rb.StackConfigurationBehavior
+			return &scb, true
+		}
+	}
+	return nil, false
+}
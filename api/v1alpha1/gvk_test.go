@@ -0,0 +1,220 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestGVKGroupVersionKind(t *testing.T) {
+	cases := map[string]struct {
+		gvk     GVK
+		want    schema.GroupVersionKind
+		wantErr bool
+	}{
+		"Grouped": {
+			gvk:  "SampleClaim.samples.stacks.crossplane.io/v1alpha1",
+			want: schema.GroupVersionKind{Group: "samples.stacks.crossplane.io", Version: "v1alpha1", Kind: "SampleClaim"},
+		},
+		"CoreGroup": {
+			gvk:  "ConfigMap/v1",
+			want: schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		},
+		"NoVersion": {
+			gvk:     "SampleClaim.samples.stacks.crossplane.io",
+			wantErr: true,
+		},
+		"EmptyVersion": {
+			gvk:     "SampleClaim.samples.stacks.crossplane.io/",
+			wantErr: true,
+		},
+		"EmptyKind": {
+			gvk:     ".samples.stacks.crossplane.io/v1alpha1",
+			wantErr: true,
+		},
+		"EmptyGroup": {
+			gvk:     "SampleClaim./v1alpha1",
+			wantErr: true,
+		},
+		"GroupVersionFormat": {
+			gvk:     "samples.stacks.crossplane.io/v1alpha1/SampleClaim",
+			wantErr: true,
+		},
+		"Empty": {
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.gvk.GroupVersionKind()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("GroupVersionKind(): got error %v, want error: %t", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("GroupVersionKind(): got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGVKSelectorMatches(t *testing.T) {
+	gvk := func(group, version, kind string) schema.GroupVersionKind {
+		return schema.GroupVersionKind{Group: group, Version: version, Kind: kind}
+	}
+
+	cases := map[string]struct {
+		selector GVKSelector
+		gvk      schema.GroupVersionKind
+		want     bool
+	}{
+		"AnyVersion": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget"},
+			gvk:      gvk("example.org", "v2", "Widget"),
+			want:     true,
+		},
+		"OtherKind": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget"},
+			gvk:      gvk("example.org", "v1", "Gadget"),
+		},
+		"OtherGroup": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget"},
+			gvk:      gvk("example.com", "v1", "Widget"),
+		},
+		"CoreGroup": {
+			selector: GVKSelector{Kind: "ConfigMap"},
+			gvk:      gvk("", "v1", "ConfigMap"),
+			want:     true,
+		},
+		"ListedVersion": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget", Versions: []string{"v1alpha1", "v1"}},
+			gvk:      gvk("example.org", "v1", "Widget"),
+			want:     true,
+		},
+		"UnlistedVersion": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget", Versions: []string{"v1alpha1", "v1"}},
+			gvk:      gvk("example.org", "v1beta1", "Widget"),
+		},
+		"AtMinVersion": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget", MinVersion: "v1beta1"},
+			gvk:      gvk("example.org", "v1beta1", "Widget"),
+			want:     true,
+		},
+		"BelowMinVersionInKubernetesOrder": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget", MinVersion: "v1"},
+			gvk:      gvk("example.org", "v1beta2", "Widget"),
+		},
+		"AboveMinVersionInKubernetesOrder": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget", MinVersion: "v1alpha2"},
+			gvk:      gvk("example.org", "v1alpha10", "Widget"),
+			want:     true,
+		},
+		"AboveMaxVersion": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget", MaxVersion: "v1beta1"},
+			gvk:      gvk("example.org", "v1", "Widget"),
+		},
+		"WithinBounds": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget", MinVersion: "v1alpha1", MaxVersion: "v1"},
+			gvk:      gvk("example.org", "v1beta1", "Widget"),
+			want:     true,
+		},
+		"ListedButOutOfBounds": {
+			selector: GVKSelector{Group: "example.org", Kind: "Widget", Versions: []string{"v1alpha1", "v2"}, MaxVersion: "v1"},
+			gvk:      gvk("example.org", "v2", "Widget"),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.selector.Matches(tc.gvk); got != tc.want {
+				t.Errorf("%s.Matches(%v): got %t, want %t", tc.selector, tc.gvk, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStackConfigurationBehaviorsBehaviorFor(t *testing.T) {
+	widget := schema.GroupVersionKind{Group: "example.org", Version: "v1", Kind: "Widget"}
+	hooks := func(directory string) StackConfigurationBehavior {
+		return StackConfigurationBehavior{
+			Hooks: map[EventName]HookConfigurations{EventReconcile: {{Directory: directory}}},
+		}
+	}
+
+	cases := map[string]struct {
+		behaviors StackConfigurationBehaviors
+		want      string
+		wantOK    bool
+	}{
+		"NoMatch": {
+			behaviors: StackConfigurationBehaviors{
+				Resources: []ResourceBehavior{{
+					Selector:                   GVKSelector{Group: "example.org", Kind: "Gadget"},
+					StackConfigurationBehavior: hooks("gadget"),
+				}},
+			},
+		},
+		"FirstResourceWins": {
+			behaviors: StackConfigurationBehaviors{
+				Resources: []ResourceBehavior{
+					{Selector: GVKSelector{Group: "example.org", Kind: "Widget", MaxVersion: "v1beta1"}, StackConfigurationBehavior: hooks("old")},
+					{Selector: GVKSelector{Group: "example.org", Kind: "Widget"}, StackConfigurationBehavior: hooks("any")},
+					{Selector: GVKSelector{Group: "example.org", Kind: "Widget", Versions: []string{"v1"}}, StackConfigurationBehavior: hooks("v1")},
+				},
+			},
+			want:   "any",
+			wantOK: true,
+		},
+		"ResourcesBeforeLegacy": {
+			behaviors: StackConfigurationBehaviors{
+				CRDs: map[GVK]StackConfigurationBehavior{"Widget.example.org/v1": hooks("legacy")},
+				Resources: []ResourceBehavior{
+					{Selector: GVKSelector{Group: "example.org", Kind: "Widget"}, StackConfigurationBehavior: hooks("resource")},
+				},
+			},
+			want:   "resource",
+			wantOK: true,
+		},
+		"Legacy": {
+			behaviors: StackConfigurationBehaviors{
+				CRDs: map[GVK]StackConfigurationBehavior{
+					"Widget.example.org/v1alpha1": hooks("v1alpha1"),
+					"Widget.example.org/v1":       hooks("v1"),
+					"not a gvk":                   hooks("invalid"),
+				},
+			},
+			want:   "v1",
+			wantOK: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, ok := tc.behaviors.BehaviorFor(widget)
+			if ok != tc.wantOK {
+				t.Fatalf("BehaviorFor(%v): got ok %t, want %t", widget, ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if dir := got.Hooks[EventReconcile][0].Directory; dir != tc.want {
+				t.Errorf("BehaviorFor(%v): got the behavior for %q, want %q", widget, dir, tc.want)
+			}
+		})
+	}
+}
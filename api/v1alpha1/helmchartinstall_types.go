@@ -18,25 +18,129 @@ package v1alpha1
 import (
 	"reflect"
 
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
-// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
-// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+// A HelmChartInstall installs a chart from a stack image with the given values,
+// without a stack configuration or a claim. It is rendered with the helm
+// engines, by the same kind of job which renders a claim's hook, and the
+// release's objects are pruned in the same way when they stop being rendered.
+// The objects are deleted when the HelmChartInstall is deleted.
 
 // HelmChartInstallSpec defines the desired state of HelmChartInstall
 type HelmChartInstallSpec struct {
-	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	// Chart is where the chart is found.
+	Chart HelmChartSource `json:"chart"`
+
+	// ReleaseName is the name of the release which the chart is rendered as.
+	// If it isn't specified, the name of the HelmChartInstall is used.
+	ReleaseName string `json:"releaseName,omitempty"`
+
+	// Namespace is the namespace which the chart is installed into. If it
+	// isn't specified, the chart is installed into the namespace of the
+	// HelmChartInstall.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Values are the values which the chart is rendered with.
+	Values *runtime.RawExtension `json:"values,omitempty"`
+
+	// ValuesFrom are values files in secrets and config maps in the namespace
+	// of the HelmChartInstall. They are passed to helm in order, before the
+	// values in the spec, so the values in the spec take precedence.
+	ValuesFrom []ValuesReference `json:"valuesFrom,omitempty"`
+
+	// ServiceAccountName is the service account in the namespace of the
+	// HelmChartInstall which the chart is installed as. It needs permission to
+	// read the referenced values, and to manage the chart's objects in the
+	// namespace which the chart is installed into. It must exist, and it can't
+	// be one of the service accounts which hold the permissions of stacks.
+	// +kubebuilder:validation:MinLength=1
+	ServiceAccountName string `json:"serviceAccountName"`
+
+	// Engine configures the engine which renders the chart. The type must be
+	// helm2 or helm3, and defaults to helm3.
+	Engine ResourceEngineConfiguration `json:"engine,omitempty"`
 }
 
+// HelmChartSource is a chart in a stack image.
+type HelmChartSource struct {
+	// Image is the stack image which has the chart.
+	Image string `json:"image"`
+
+	// Directory is the chart's directory, relative to the image's registry root.
+	Directory string `json:"directory"`
+}
+
+// A ValuesReference is a values file in a secret or config map.
+type ValuesReference struct {
+	// Kind is either Secret or ConfigMap.
+	Kind string `json:"kind"`
+
+	// Name is the name of the secret or config map.
+	Name string `json:"name"`
+
+	// Key is the key of the values file in the object's data. It defaults to
+	// values.yaml.
+	Key string `json:"key,omitempty"`
+
+	// Optional values are left out if the object or the key doesn't exist.
+	// Otherwise, the chart isn't installed until it exists.
+	Optional bool `json:"optional,omitempty"`
+}
+
+// ReleasePhase is a high-level summary of where a release is in its lifecycle.
+type ReleasePhase string
+
+// Recognized release phases.
+const (
+	// ReleasePhaseInstalling means that the chart is being rendered and applied.
+	ReleasePhaseInstalling ReleasePhase = "Installing"
+
+	// ReleasePhaseDeployed means that the current revision of the release was applied.
+	ReleasePhaseDeployed ReleasePhase = "Deployed"
+
+	// ReleasePhaseFailed means that the current revision of the release failed, or
+	// that it couldn't be started.
+	ReleasePhaseFailed ReleasePhase = "Failed"
+
+	// ReleasePhaseUninstalling means that the release's objects are being deleted.
+	ReleasePhaseUninstalling ReleasePhase = "Uninstalling"
+)
+
 // HelmChartInstallStatus defines the observed state of HelmChartInstall
 type HelmChartInstallStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	runtimev1alpha1.ConditionedStatus `json:",inline"`
+
+	Phase ReleasePhase `json:"phase,omitempty"`
+
+	// ReleaseName and Namespace are the release name and namespace which the
+	// chart was most recently rendered with.
+	ReleaseName string `json:"releaseName,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+
+	// Revision is incremented whenever the chart is rendered again, because
+	// the chart, its values or the engine changed.
+	Revision int64 `json:"revision,omitempty"`
+
+	// JobName is the name of the Job which rendered the current revision.
+	JobName string `json:"jobName,omitempty"`
+
+	// Resources are the objects which the release applied the last time that
+	// it succeeded.
+	Resources []corev1.ObjectReference `json:"resources,omitempty"`
+
+	// ObservedGeneration is the generation which was most recently rendered.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Message has details about the most recent failure, if there is one.
+	Message string `json:"message,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
 
 // HelmChartInstall is the Schema for the helmchartinstalls API
 type HelmChartInstall struct {
@@ -0,0 +1,82 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// HooksFor returns the hooks which are configured for an event on claims of the
+// given kind, resolved with ResolveHook. False is returned if no behavior is
+// configured for the kind.
+func (sc *StackConfiguration) HooksFor(gvk schema.GroupVersionKind, event EventName) ([]HookConfiguration, bool) {
+	scb, ok := sc.Spec.Behaviors.BehaviorFor(gvk)
+	if !ok {
+		return nil, false
+	}
+
+	// If a directory is not provided, the root of the stack artifact is used.
+	// However, it is recommended to specify a directory for clarity.
+	hooks := make([]HookConfiguration, 0, len(scb.Hooks[event]))
+	for _, hc := range scb.Hooks[event] {
+		hooks = append(hooks, sc.ResolveHook(scb, hc))
+	}
+
+	return hooks, true
+}
+
+// ResolveHook returns the configuration of a hook with the fields which it
+// inherits from its behavior and from the stack filled in.
+func (sc *StackConfiguration) ResolveHook(scb *StackConfigurationBehavior, hc HookConfiguration) HookConfiguration {
+	hc.Engine = resolveEngine(hc.Engine, scb.Engine, sc.Spec.Behaviors.Engine)
+
+	if hc.Source.IsZero() {
+		hc.Source = scb.Source
+	}
+	if hc.Source.IsZero() {
+		hc.Source = sc.Spec.Behaviors.Source
+	}
+
+	return hc
+}
+
+// resolveEngine merges engine configurations, from the most specific to the
+// least specific. The first value which is specified for a field wins, except
+// for the image, which is only inherited from configurations for the same
+// engine type.
+func resolveEngine(configs ...ResourceEngineConfiguration) ResourceEngineConfiguration {
+	resolved := ResourceEngineConfiguration{}
+
+	for _, c := range configs {
+		if resolved.Type == "" {
+			resolved.Type = c.Type
+		}
+		if resolved.Image == "" && c.Type == resolved.Type {
+			resolved.Image = c.Image
+		}
+		if resolved.ApplierImage == "" {
+			resolved.ApplierImage = c.ApplierImage
+		}
+		if resolved.ImagePullPolicy == "" {
+			resolved.ImagePullPolicy = c.ImagePullPolicy
+		}
+		if len(resolved.ImagePullSecrets) == 0 {
+			resolved.ImagePullSecrets = c.ImagePullSecrets
+		}
+	}
+
+	return resolved
+}
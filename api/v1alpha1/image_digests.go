@@ -0,0 +1,89 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"sort"
+	"strings"
+)
+
+// IsPinnedImage returns true if an image is already pinned to a digest, so its
+// tag doesn't need to be resolved.
+func IsPinnedImage(image string) bool {
+	return strings.Contains(image, "@")
+}
+
+// SourceImages returns the stack images which the stack configuration's hooks
+// are loaded from, at every level that a source can be specified at, sorted and
+// without duplicates. Images which are already pinned to a digest are left out.
+func (sc *StackConfiguration) SourceImages() []string {
+	seen := map[string]bool{}
+	add := func(s StackConfigurationSource) {
+		if s.Image != "" && !IsPinnedImage(s.Image) {
+			seen[s.Image] = true
+		}
+	}
+	addBehavior := func(scb *StackConfigurationBehavior) {
+		add(scb.Source)
+		for _, hooks := range scb.Hooks {
+			for _, hc := range hooks {
+				add(hc.Source)
+			}
+		}
+	}
+
+	add(sc.Spec.Behaviors.Source)
+	for i := range sc.Spec.Behaviors.Resources {
+		addBehavior(&sc.Spec.Behaviors.Resources[i].StackConfigurationBehavior)
+	}
+	for _, scb := range sc.Spec.Behaviors.CRDs {
+		scb := scb
+		addBehavior(&scb)
+	}
+
+	images := make([]string, 0, len(seen))
+	for image := range seen {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// ImageDigest returns the digest which an image's tag was resolved to, if it
+// has been resolved.
+func (s *StackConfigurationStatus) ImageDigest(image string) (ImageDigest, bool) {
+	for _, id := range s.Images {
+		if id.Image == image {
+			return id, true
+		}
+	}
+	return ImageDigest{}, false
+}
+
+// PinnedImage returns the image with its resolved digest. The tag is kept for
+// readability, but the digest is what the image is pulled by. False is returned
+// if the image's tag hasn't been resolved. Images which are already pinned are
+// returned as they are.
+func (s *StackConfigurationStatus) PinnedImage(image string) (string, bool) {
+	if IsPinnedImage(image) {
+		return image, true
+	}
+	id, ok := s.ImageDigest(image)
+	if !ok {
+		return image, false
+	}
+	return image + "@" + id.Digest, true
+}
@@ -16,7 +16,11 @@ limitations under the License.
 package v1alpha1
 
 import (
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
@@ -25,36 +29,226 @@ import (
 type StackConfigurationSpec struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	Behaviors StackConfigurationBehaviors `json:"behaviors,omitempty"`
+
+	// Permissions are what the stack's rendered resources are allowed to do.
+	// Rendered resources are applied as a service account which only has these
+	// permissions, so resources which aren't covered by them are refused.
+	Permissions StackPermissions `json:"permissions,omitempty"`
+
+	// RequireApproval makes changes to every claim wait for approval before they
+	// are applied. Individual claims can require approval with an annotation
+	// instead. See the documentation of ClaimPlan.
+	RequireApproval bool `json:"requireApproval,omitempty"`
+
+	// ImageDigests configures how the tags of the stack's images are resolved
+	// to digests.
+	ImageDigests ImageDigestPolicy `json:"imageDigests,omitempty"`
+
+	// Rollout is how changes to the stack configuration are rolled out to the
+	// claims which were rendered before the change.
+	Rollout RolloutStrategy `json:"rollout,omitempty"`
 }
 
+// RolloutStrategyType is a way of rolling out changes to existing claims.
+type RolloutStrategyType string
+
+// Recognized rollout strategy types.
+const (
+	// RolloutAllAtOnce renders every existing claim again as soon as the stack
+	// configuration changes.
+	RolloutAllAtOnce RolloutStrategyType = "AllAtOnce"
+
+	// RolloutBatches renders existing claims again in batches. A batch is only
+	// started once every claim in the previous batch has been rendered, so a
+	// batch with a failed claim stops the rollout.
+	RolloutBatches RolloutStrategyType = "Batches"
+
+	// RolloutMaxUnavailable renders existing claims again as long as few
+	// enough of the claims which have already been rendered again are still
+	// rendering or have failed.
+	RolloutMaxUnavailable RolloutStrategyType = "MaxUnavailable"
+)
+
+// RolloutStrategy controls how quickly a change to a claim's behavior is
+// rolled out to the claims which were rendered before the change. A change to
+// any of the behavior's hooks, including the digests of their stack images, is
+// a new revision of the behavior. Claims are rendered again with the new
+// revision, in whatever order they happen to be reconciled in, as fast as the
+// strategy allows. New claims are always rendered straight away, and count
+// towards the rollout.
+type RolloutStrategy struct {
+	// Type is AllAtOnce, Batches or MaxUnavailable. It defaults to AllAtOnce.
+	Type RolloutStrategyType `json:"type,omitempty"`
+
+	// BatchSize is how many claims are in each batch, for the Batches strategy.
+	BatchSize int `json:"batchSize,omitempty"`
+
+	// MaxUnavailable is how many of the claims which have been rendered with
+	// the new revision may be rendering or failed at once, for the
+	// MaxUnavailable strategy.
+	MaxUnavailable int `json:"maxUnavailable,omitempty"`
+}
+
+// ImageDigestPolicy configures how the tags of a stack's images are resolved to
+// digests. Render jobs use the digests rather than the tags, so that every claim
+// is rendered from the same stack contents, whenever it is rendered. Images
+// which are already pinned to a digest are used as they are.
+//
+// A tag is resolved when its image is first used by the stack configuration.
+// After that, the stack only moves to a new digest when the resolve annotation
+// is changed, or on the poll interval.
+type ImageDigestPolicy struct {
+	// PollInterval is how often tags are resolved again. If it isn't set, tags
+	// are only resolved again when they are requested to be.
+	PollInterval *metav1.Duration `json:"pollInterval,omitempty"`
+}
+
+// StackPermissions are the RBAC rules which are granted to the service account
+// that a stack's rendered resources are applied as. The service account is
+// created in the namespace of each claim. A stack can only be granted rules
+// which the controller's permissions role allows.
+type StackPermissions struct {
+	// Rules are granted in the namespace of the claim.
+	Rules []rbacv1.PolicyRule `json:"rules,omitempty"`
+
+	// ClusterRules are granted across the cluster. They are needed for
+	// cluster-scoped resources, and for resources in namespaces other than the
+	// claim's.
+	ClusterRules []rbacv1.PolicyRule `json:"clusterRules,omitempty"`
+}
+
+// ResourceEngineConfiguration configures the engine which runs a hook, and the
+// containers which the engine runs in. It can be specified for the whole stack,
+// for a behavior, or for a hook. Fields which aren't specified for a hook are
+// inherited from its behavior, and then from the stack.
 type ResourceEngineConfiguration struct {
-	Type string `json:"type"`
+	// Type is the type of the engine. If it isn't specified, it is inherited
+	// from the behavior, and then from the stack configuration.
+	Type string `json:"type,omitempty"`
+
+	// Image is the image of the engine's container. It is only inherited along
+	// with the engine type. If it isn't specified, the engine's default image is
+	// used.
+	Image string `json:"image,omitempty"`
+
+	// ApplierImage is the image of the container which applies the rendered
+	// resources. It needs to have kubectl and a shell.
+	ApplierImage string `json:"applierImage,omitempty"`
+
+	// ImagePullPolicy is the pull policy for all of the containers which run the
+	// hook.
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// ImagePullSecrets are used to pull the images of all of the containers which
+	// run the hook.
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
 }
 
-// StackConfigurationSource is the stack image which this stack configuration is from.
-// In the future, other source types may be supported, such as a URL.
+// StackConfigurationSource is where the stack's files come from. At most one
+// type of source may be specified. The stack's files are laid out in the same
+// way in every type of source as they are under the registry root of a stack
+// image, so a hook's directory is found in the same place whatever the source.
+//
+// Sources other than images are pinned to a digest or to a revision, which is
+// verified when the stack's files are loaded.
 type StackConfigurationSource struct {
 	// a container image id
 	Image string `json:"image,omitempty"`
+
+	// OCI is an OCI artifact with the stack's files.
+	OCI *OCISource `json:"oci,omitempty"`
+
+	// Git is a git repository with the stack's files.
+	Git *GitSource `json:"git,omitempty"`
+
+	// ConfigMap is a config map with a tarball of the stack's files.
+	ConfigMap *ConfigMapSource `json:"configMap,omitempty"`
+
+	// URL is a tarball of the stack's files which is downloaded from a URL.
+	URL *URLSource `json:"url,omitempty"`
+}
+
+// IsZero returns true if no source is specified.
+func (s StackConfigurationSource) IsZero() bool {
+	return s.Image == "" && s.OCI == nil && s.Git == nil && s.ConfigMap == nil && s.URL == nil
+}
+
+// OCISource is an OCI artifact, which is pulled by its digest.
+type OCISource struct {
+	// Reference is the artifact's repository, such as
+	// registry.example.com/stacks/wordpress.
+	Reference string `json:"reference"`
+
+	// Digest is the digest of the artifact's manifest, as sha256:<hex>.
+	Digest string `json:"digest"`
+}
+
+// GitSource is a git repository, which is checked out at a commit.
+type GitSource struct {
+	// Repository is the URL which the repository is cloned from.
+	Repository string `json:"repository"`
+
+	// Revision is the full SHA-1 of the commit which is checked out. Branches
+	// and tags aren't allowed, because they can move.
+	Revision string `json:"revision"`
+}
+
+// ConfigMapSource is a gzipped tarball in the binary data of a config map.
+type ConfigMapSource struct {
+	// Name is the name of the config map, which is in the namespace of the
+	// stack configuration.
+	Name string `json:"name"`
+
+	// Key is the key of the tarball in the config map's binary data. It
+	// defaults to stack.tar.gz.
+	Key string `json:"key,omitempty"`
+
+	// Digest is the digest of the tarball, as sha256:<hex>.
+	Digest string `json:"digest"`
+}
+
+// URLSource is a gzipped tarball which is downloaded from a URL.
+type URLSource struct {
+	// URL is where the tarball is downloaded from.
+	URL string `json:"url"`
+
+	// Digest is the digest of the tarball, as sha256:<hex>.
+	Digest string `json:"digest"`
 }
 
 // StackConfigurationBehaviors specifies behaviors for the stack
 type StackConfigurationBehaviors struct {
-	CRDs   map[GVK]StackConfigurationBehavior `json:"crds,omitempty"`
-	Engine ResourceEngineConfiguration        `json:"engine,omitempty"`
-	// Theoretically, source and engine could be specified at a per-crd level or
-	// per-hook level as well.
+	// CRDs configures behaviors by GVK, in the legacy string format. Prefer
+	// Resources for new configurations.
+	CRDs map[GVK]StackConfigurationBehavior `json:"crds,omitempty"`
+
+	// Resources configures behaviors for the resources which their selectors match.
+	// When more than one behavior matches a resource, the first one is used, and
+	// behaviors in Resources come before behaviors in CRDs.
+	Resources []ResourceBehavior `json:"resources,omitempty"`
+
+	Engine ResourceEngineConfiguration `json:"engine,omitempty"`
+
+	// Source is where the stack's files come from. Behaviors and hooks can
+	// override it.
 	Source StackConfigurationSource `json:"source,omitempty"`
 }
 
-// The GVK should be in domain format, so Kind.group/version
-type GVK string
+// ResourceBehavior is a behavior for the resources which are matched by its selector.
+type ResourceBehavior struct {
+	Selector GVKSelector `json:"selector"`
+
+	StackConfigurationBehavior `json:",inline"`
+}
 
 // StackConfigurationBehavior specifies an individual behavior, by listing resources
 // which should be processed.
 type StackConfigurationBehavior struct {
 	Hooks  map[EventName]HookConfigurations `json:"hooks"`
 	Engine ResourceEngineConfiguration      `json:"engine,omitempty"`
+
+	// Source overrides the stack's source for the behavior's hooks.
+	Source StackConfigurationSource `json:"source,omitempty"`
 }
 
 type HookConfigurations []HookConfiguration
@@ -63,20 +257,189 @@ type HookConfigurations []HookConfiguration
 // There are certain events that are recognized.
 type EventName string
 
+// Recognized event names. Exactly one event applies to a claim each time it is
+// reconciled:
+// - delete applies while the claim is being deleted
+// - create applies until the claim has been rendered for the first time
+// - update applies when the claim's generation changes after it has been rendered
+// - reconcile applies the rest of the time
+//
+// The hooks for create and update are run until they finish, even if the claim is
+// reconciled again in the meantime. If no hooks are configured for create or update,
+// the reconcile hooks are run instead, so a behavior which only has reconcile hooks
+// runs them for every change to the claim.
+const (
+	// EventCreate hooks are run when a claim is rendered for the first time.
+	EventCreate EventName = "create"
+
+	// EventUpdate hooks are run when a claim changes after it has been rendered.
+	EventUpdate EventName = "update"
+
+	// EventReconcile hooks are run whenever a claim is reconciled and no other
+	// event applies.
+	EventReconcile EventName = "reconcile"
+
+	// EventDelete hooks are run when a claim is being deleted. The claim is not
+	// released until all of its delete hooks have succeeded.
+	EventDelete EventName = "delete"
+)
+
+// EventNames are all of the recognized event names.
+var EventNames = []EventName{EventCreate, EventUpdate, EventReconcile, EventDelete}
+
+// IsValid returns true if the event name is one of the recognized event names.
+func (e EventName) IsValid() bool {
+	for _, n := range EventNames {
+		if e == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Fallbacks returns the events whose hooks should be tried, in order, when the
+// event applies to a claim.
+func (e EventName) Fallbacks() []EventName {
+	switch e {
+	case EventCreate, EventUpdate:
+		return []EventName{e, EventReconcile}
+	default:
+		return []EventName{e}
+	}
+}
+
 // HookConfiguration is the configuration for an individual hook which will be
 // executed in response to an event.
 type HookConfiguration struct {
 	Engine    ResourceEngineConfiguration `json:"engine,omitempty"`
 	Directory string                      `json:"directory"`
+
+	// Source overrides the stack's source for the hook.
+	Source StackConfigurationSource `json:"source,omitempty"`
+
+	// Values map the fields of the claim to the inputs of the engine, such as
+	// the values of a helm chart. If no values are specified, the engine is
+	// given the claim's spec.
+	Values []ValueMapping `json:"values,omitempty"`
+
+	// References are secrets and config maps which are named by the claim, and
+	// which are passed to the engine without their contents being copied into
+	// the engine's configuration. The kustomize engine doesn't support them.
+	References []ResourceReference `json:"references,omitempty"`
+}
+
+// Kinds of objects which a hook can reference.
+const (
+	ReferenceKindSecret    = "Secret"
+	ReferenceKindConfigMap = "ConfigMap"
+)
+
+// A ResourceReference is a secret or config map in the claim's namespace, whose
+// name is read from a field of the claim.
+type ResourceReference struct {
+	// Name identifies the reference to the engine. Engines which run in jobs
+	// mount the referenced object in a directory with this name, and charts see
+	// its contents as .Values.references.<name>.<key>.
+	Name string `json:"name"`
+
+	// Kind is either Secret or ConfigMap.
+	Kind string `json:"kind"`
+
+	// From is a JSONPath expression which selects the name of the referenced
+	// object from the claim, such as {.spec.credentialsSecretRef.name}.
+	From string `json:"from"`
+
+	// Optional references are left out if the claim doesn't name an object,
+	// or if the object doesn't exist. Otherwise, the claim isn't rendered until
+	// the object exists.
+	Optional bool `json:"optional,omitempty"`
+}
+
+// A ValueMapping sets one of the engine's inputs. The input is set from a
+// JSONPath expression, from a template, or to a constant value. Expressions and
+// templates are evaluated against the whole claim, so they can refer to its
+// metadata, such as {.metadata.name} or {.metadata.labels.app}, as well as to
+// its spec.
+type ValueMapping struct {
+	// To is the path of the input which is set, with dots between the fields,
+	// such as image.tag.
+	To string `json:"to"`
+
+	// From is a JSONPath expression, such as {.spec.version}. The braces may be
+	// left out. If the expression matches more than one value, the input is
+	// set to the list of values.
+	From string `json:"from,omitempty"`
+
+	// Template is a Go template which renders the input as a string, such as
+	// {{ .metadata.name }}-{{ .spec.size | lower }}. The template can use the
+	// same functions as the gotemplate engine.
+	Template string `json:"template,omitempty"`
+
+	// Value is a constant value for the input.
+	Value *runtime.RawExtension `json:"value,omitempty"`
+
+	// Default is the value of the input when From doesn't match anything, or
+	// when Template renders an empty string. If there is no default, the input
+	// is left out.
+	Default *runtime.RawExtension `json:"default,omitempty"`
 }
 
 // StackConfigurationStatus defines the observed state of StackConfiguration
 type StackConfigurationStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
+	runtimev1alpha1.ConditionedStatus `json:",inline"`
+
+	// Behaviors has the status of each behavior which is configured in the spec,
+	// in the order that the behaviors are matched in.
+	Behaviors []BehaviorStatus `json:"behaviors,omitempty"`
+
+	// Images are the digests which the tags of the stack's images have been
+	// resolved to, in the order of the images.
+	Images []ImageDigest `json:"images,omitempty"`
+
+	// ResolveRequest is the value of the resolve annotation which the images
+	// were last resolved for.
+	ResolveRequest string `json:"resolveRequest,omitempty"`
+}
+
+// ImageDigest is the digest which the tag of an image was resolved to.
+type ImageDigest struct {
+	// Image is the image, as it is specified in the stack configuration.
+	Image string `json:"image"`
+
+	// Digest is the digest of the image's manifest, as sha256:<hex>.
+	Digest string `json:"digest"`
+
+	// ResolvedAt is when the digest was resolved.
+	ResolvedAt metav1.Time `json:"resolvedAt"`
+}
+
+// BehaviorStatus is the status of an individual behavior, which reports
+// whether the setup phase was able to start watching its GVK.
+type BehaviorStatus struct {
+	runtimev1alpha1.ConditionedStatus `json:",inline"`
+
+	// Selector identifies the behavior. It is the behavior's key for behaviors
+	// which are configured in crds.
+	Selector string `json:"selector"`
+
+	// Group and Kind are the group and kind which the behavior selects. They are
+	// empty if the behavior's GVK couldn't be parsed.
+	Group string `json:"group,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+
+	// Versions has the version of the kind which the behavior is watching.
+	// Claims of a kind are only watched at one version.
+	Versions []string `json:"versions,omitempty"`
+
+	// Events are the events which the behavior has hooks for.
+	Events []EventName `json:"events,omitempty"`
+
+	// Active is true if claims of the GVK are being watched and rendered.
+	Active bool `json:"active"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
 
 // StackConfiguration is the Schema for the stackconfigurations API
 type StackConfiguration struct {
@@ -0,0 +1,338 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// Validate checks a stack configuration for problems which would prevent its
+// behaviors from being set up or rendered. All of the problems which are found
+// are reported together.
+//
+// The engines register themselves in a package which depends on this one, so
+// the engine types which hooks may reference are passed in, along with the
+// ones which pass references to what they render. If either is nil, it isn't
+// checked.
+func (sc *StackConfiguration) Validate(engineTypes, referenceEngineTypes []string) error {
+	problems := make([]string, 0)
+
+	for gvk, scb := range sc.Spec.Behaviors.CRDs {
+		field := fmt.Sprintf("crds[%s]", gvk)
+		if _, err := gvk.GroupVersionKind(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", field, err))
+		}
+
+		problems = append(problems, sc.validateBehavior(field, &scb, engineTypes, referenceEngineTypes)...)
+	}
+
+	for i, rb := range sc.Spec.Behaviors.Resources {
+		field := fmt.Sprintf("resources[%d]", i)
+		problems = append(problems, validateSelector(field+".selector", &rb.Selector)...)
+		problems = append(problems, sc.validateBehavior(field, &rb.StackConfigurationBehavior, engineTypes, referenceEngineTypes)...)
+	}
+
+	problems = append(problems, validateSource("source", &sc.Spec.Behaviors.Source)...)
+
+	if pi := sc.Spec.ImageDigests.PollInterval; pi != nil && pi.Duration <= 0 {
+		problems = append(problems, fmt.Sprintf("imageDigests.pollInterval: %s is not a positive duration", pi.Duration))
+	}
+
+	problems = append(problems, validateRollout("rollout", &sc.Spec.Rollout)...)
+
+	for i, rule := range sc.Spec.Permissions.Rules {
+		problems = append(problems, validateRule(fmt.Sprintf("permissions.rules[%d]", i), &rule, false)...)
+	}
+	for i, rule := range sc.Spec.Permissions.ClusterRules {
+		problems = append(problems, validateRule(fmt.Sprintf("permissions.clusterRules[%d]", i), &rule, true)...)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	// Map iteration order is random, so the problems are sorted to keep the message stable.
+	sort.Strings(problems)
+	return fmt.Errorf("invalid stack configuration: %s", strings.Join(problems, "; "))
+}
+
+func (sc *StackConfiguration) validateBehavior(
+	field string, scb *StackConfigurationBehavior, engineTypes, referenceEngineTypes []string,
+) []string {
+	problems := validateSource(field+".source", &scb.Source)
+
+	for event, hooks := range scb.Hooks {
+		if !event.IsValid() {
+			problems = append(problems, fmt.Sprintf("%s.hooks: unknown event name %q, expected one of %v", field, event, EventNames))
+		}
+
+		if len(hooks) == 0 {
+			problems = append(problems, fmt.Sprintf("%s.hooks[%s]: at least one hook is required", field, event))
+		}
+
+		for i, hc := range hooks {
+			hookField := fmt.Sprintf("%s.hooks[%s][%d]", field, event, i)
+
+			if path.IsAbs(hc.Directory) {
+				problems = append(problems, fmt.Sprintf("%s.directory: %q is absolute, but directories are relative to the root of the stack", hookField, hc.Directory))
+			} else if escapesRoot(hc.Directory) {
+				problems = append(problems, fmt.Sprintf("%s.directory: %q is outside of the stack", hookField, hc.Directory))
+			}
+
+			problems = append(problems, validateSource(hookField+".source", &hc.Source)...)
+
+			resolved := sc.ResolveHook(scb, hc)
+
+			engineType := resolved.Engine.Type
+			if engineType == "" {
+				problems = append(problems, fmt.Sprintf("%s.engine: an engine type is required for the hook, its behavior, or the stack", hookField))
+			} else if engineTypes != nil && !contains(engineTypes, engineType) {
+				problems = append(problems, fmt.Sprintf("%s.engine: unknown engine type %q, expected one of %v", hookField, engineType, engineTypes))
+			}
+
+			switch resolved.Engine.ImagePullPolicy {
+			case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+			default:
+				problems = append(problems, fmt.Sprintf("%s.engine.imagePullPolicy: unknown pull policy %q", hookField, resolved.Engine.ImagePullPolicy))
+			}
+
+			for j, vm := range hc.Values {
+				problems = append(problems, validateValueMapping(fmt.Sprintf("%s.values[%d]", hookField, j), &vm)...)
+			}
+
+			if len(hc.References) > 0 && engineType != "" && referenceEngineTypes != nil && !contains(referenceEngineTypes, engineType) {
+				problems = append(problems, fmt.Sprintf("%s.references: the %q engine doesn't pass references to what it renders", hookField, engineType))
+			}
+
+			names := map[string]bool{}
+			for j, ref := range hc.References {
+				refField := fmt.Sprintf("%s.references[%d]", hookField, j)
+				problems = append(problems, validateReference(refField, &ref)...)
+
+				if names[ref.Name] {
+					problems = append(problems, fmt.Sprintf("%s.name: %q is used by more than one reference", refField, ref.Name))
+				}
+				names[ref.Name] = true
+			}
+		}
+	}
+
+	return problems
+}
+
+// validateRule checks the parts of an RBAC rule which the api server would otherwise only reject once the
+// stack's roles are created. Non-resource URLs can only be granted across the cluster.
+func validateRule(field string, rule *rbacv1.PolicyRule, cluster bool) []string {
+	problems := make([]string, 0)
+
+	if len(rule.Verbs) == 0 {
+		problems = append(problems, fmt.Sprintf("%s.verbs: at least one verb is required", field))
+	}
+
+	if len(rule.NonResourceURLs) > 0 {
+		if !cluster {
+			problems = append(problems, fmt.Sprintf("%s.nonResourceURLs: non-resource URLs can only be granted by cluster rules", field))
+		}
+		if len(rule.Resources) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: a rule may grant resources or non-resource URLs, but not both", field))
+		}
+	} else if len(rule.Resources) == 0 {
+		problems = append(problems, fmt.Sprintf("%s.resources: at least one resource is required", field))
+	}
+
+	return problems
+}
+
+// validateValueMapping checks that a value mapping sets exactly one input from exactly one source. The
+// expressions and templates themselves are checked by the engines, when they are evaluated.
+func validateValueMapping(field string, vm *ValueMapping) []string {
+	problems := make([]string, 0)
+
+	if vm.To == "" {
+		problems = append(problems, fmt.Sprintf("%s.to: the input to set is required", field))
+	}
+	for _, part := range strings.Split(vm.To, ".") {
+		if vm.To != "" && part == "" {
+			problems = append(problems, fmt.Sprintf("%s.to: %q has an empty field", field, vm.To))
+			break
+		}
+	}
+
+	sources := 0
+	if vm.From != "" {
+		sources++
+	}
+	if vm.Template != "" {
+		sources++
+	}
+	if vm.Value != nil {
+		sources++
+	}
+	if sources != 1 {
+		problems = append(problems, fmt.Sprintf("%s: exactly one of from, template or value is required", field))
+	}
+
+	if vm.Value != nil && vm.Default != nil {
+		problems = append(problems, fmt.Sprintf("%s.default: a default can't be used with a constant value", field))
+	}
+
+	return problems
+}
+
+// validateReference checks a reference to a secret or config map. The name is used as a directory name and
+// as a key in helm values, so it needs to be a DNS label.
+func validateReference(field string, ref *ResourceReference) []string {
+	problems := make([]string, 0)
+
+	for _, msg := range validation.IsDNS1123Label(ref.Name) {
+		problems = append(problems, fmt.Sprintf("%s.name: %s", field, msg))
+	}
+
+	if ref.Kind != ReferenceKindSecret && ref.Kind != ReferenceKindConfigMap {
+		problems = append(problems, fmt.Sprintf("%s.kind: unknown kind %q, expected %s or %s", field, ref.Kind, ReferenceKindSecret, ReferenceKindConfigMap))
+	}
+
+	if ref.From == "" {
+		problems = append(problems, fmt.Sprintf("%s.from: an expression for the name of the object is required", field))
+	}
+
+	return problems
+}
+
+var (
+	sha256Digest = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+	gitCommit    = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// validateSource checks that at most one type of source is specified, and that sources other than images are
+// pinned to a digest or a commit.
+func validateSource(field string, s *StackConfigurationSource) []string {
+	problems := make([]string, 0)
+	required := func(f, value, what string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s.%s: %s is required", field, f, what))
+		}
+	}
+	digest := func(f, value string) {
+		if !sha256Digest.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("%s.%s: %q is not a digest of the form sha256:<hex>", field, f, value))
+		}
+	}
+
+	types := 0
+	if s.Image != "" {
+		types++
+	}
+	if s.OCI != nil {
+		types++
+		required("oci.reference", s.OCI.Reference, "a reference")
+		if strings.Contains(s.OCI.Reference, "@") {
+			problems = append(problems, fmt.Sprintf("%s.oci.reference: the digest belongs in oci.digest", field))
+		}
+		digest("oci.digest", s.OCI.Digest)
+	}
+	if s.Git != nil {
+		types++
+		required("git.repository", s.Git.Repository, "a repository")
+		if !gitCommit.MatchString(s.Git.Revision) {
+			problems = append(problems, fmt.Sprintf("%s.git.revision: %q is not the full SHA-1 of a commit", field, s.Git.Revision))
+		}
+	}
+	if s.ConfigMap != nil {
+		types++
+		required("configMap.name", s.ConfigMap.Name, "a name")
+		digest("configMap.digest", s.ConfigMap.Digest)
+	}
+	if s.URL != nil {
+		types++
+		required("url.url", s.URL.URL, "a URL")
+		digest("url.digest", s.URL.Digest)
+	}
+
+	if types > 1 {
+		problems = append(problems, fmt.Sprintf("%s: only one of image, oci, git, configMap or url may be specified", field))
+	}
+
+	return problems
+}
+
+// validateRollout checks that a rollout strategy is recognized, and that it has the settings which it needs.
+func validateRollout(field string, rs *RolloutStrategy) []string {
+	problems := make([]string, 0)
+
+	switch rs.Type {
+	case "", RolloutAllAtOnce:
+	case RolloutBatches:
+		if rs.BatchSize < 1 {
+			problems = append(problems, fmt.Sprintf("%s.batchSize: must be at least 1 for the %s strategy", field, rs.Type))
+		}
+	case RolloutMaxUnavailable:
+		if rs.MaxUnavailable < 1 {
+			problems = append(problems, fmt.Sprintf("%s.maxUnavailable: must be at least 1 for the %s strategy", field, rs.Type))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s.type: unknown strategy %q; strategies are %s, %s and %s",
+			field, rs.Type, RolloutAllAtOnce, RolloutBatches, RolloutMaxUnavailable))
+	}
+
+	return problems
+}
+
+func validateSelector(field string, s *GVKSelector) []string {
+	problems := make([]string, 0)
+
+	if s.Kind == "" {
+		problems = append(problems, fmt.Sprintf("%s.kind: a kind is required", field))
+	}
+
+	if s.MinVersion != "" && s.MaxVersion != "" && version.CompareKubeAwareVersionStrings(s.MinVersion, s.MaxVersion) > 0 {
+		problems = append(problems, fmt.Sprintf("%s: minVersion %q is higher than maxVersion %q", field, s.MinVersion, s.MaxVersion))
+	}
+
+	for _, v := range s.Versions {
+		if !s.MatchesVersion(v) {
+			problems = append(problems, fmt.Sprintf("%s.versions: %q is outside of the range of versions", field, v))
+		}
+	}
+
+	return problems
+}
+
+// escapesRoot returns true if a hook's directory refers to something outside of the directory which
+// the stack's files are in. Directories are relative to the root of the stack, even if they start
+// with a slash.
+func escapesRoot(dir string) bool {
+	cleaned := path.Clean(strings.TrimLeft(dir, "/"))
+	return cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
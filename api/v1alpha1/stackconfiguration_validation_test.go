@@ -0,0 +1,197 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strings"
+	"testing"
+)
+
+var testEngineTypes = []string{"gotemplate", "helm3", "kustomize"}
+
+// validConfiguration returns a stack configuration which is valid, so that each case only breaks one thing.
+func validConfiguration() *StackConfiguration {
+	return &StackConfiguration{
+		Spec: StackConfigurationSpec{
+			Behaviors: StackConfigurationBehaviors{
+				Engine: ResourceEngineConfiguration{Type: "helm3"},
+				Source: StackConfigurationSource{Image: "example.org/widget-stack:v1"},
+				Resources: []ResourceBehavior{{
+					Selector: GVKSelector{Group: "example.org", Kind: "Widget"},
+					StackConfigurationBehavior: StackConfigurationBehavior{
+						Hooks: map[EventName]HookConfigurations{
+							EventReconcile: {{Directory: "widget"}},
+						},
+					},
+				}},
+			},
+		},
+	}
+}
+
+func TestStackConfigurationValidate(t *testing.T) {
+	hook := func(sc *StackConfiguration) *HookConfiguration {
+		return &sc.Spec.Behaviors.Resources[0].Hooks[EventReconcile][0]
+	}
+
+	cases := map[string]struct {
+		change func(sc *StackConfiguration)
+
+		// want is part of the error which is expected, or empty if the configuration is valid.
+		want string
+	}{
+		"Valid": {
+			change: func(sc *StackConfiguration) {},
+		},
+		"NestedDirectory": {
+			change: func(sc *StackConfiguration) { hook(sc).Directory = "widgets/../widget/./v1" },
+		},
+		"DirectoryEscapesRoot": {
+			change: func(sc *StackConfiguration) { hook(sc).Directory = "../widget" },
+			want:   `resources[0].hooks[reconcile][0].directory: "../widget" is outside of the stack`,
+		},
+		"DirectoryEscapesRootAfterCleaning": {
+			change: func(sc *StackConfiguration) { hook(sc).Directory = "widget/../../other" },
+			want:   `"widget/../../other" is outside of the stack`,
+		},
+		"AbsoluteDirectory": {
+			change: func(sc *StackConfiguration) { hook(sc).Directory = "/etc" },
+			want:   `resources[0].hooks[reconcile][0].directory: "/etc" is absolute`,
+		},
+		"UnknownEngine": {
+			change: func(sc *StackConfiguration) { hook(sc).Engine.Type = "jsonnet" },
+			want:   `resources[0].hooks[reconcile][0].engine: unknown engine type "jsonnet"`,
+		},
+		"NoEngine": {
+			change: func(sc *StackConfiguration) { sc.Spec.Behaviors.Engine.Type = "" },
+			want:   "an engine type is required",
+		},
+		"ReferencesForAnEngineWithoutThem": {
+			change: func(sc *StackConfiguration) {
+				hook(sc).Engine.Type = "kustomize"
+				hook(sc).References = []ResourceReference{{Name: "creds", Kind: ReferenceKindSecret, From: "{.spec.secretName}"}}
+			},
+			want: `resources[0].hooks[reconcile][0].references: the "kustomize" engine doesn't pass references`,
+		},
+		"ZeroBatchSize": {
+			change: func(sc *StackConfiguration) { sc.Spec.Rollout = RolloutStrategy{Type: RolloutBatches} },
+			want:   "rollout.batchSize: must be at least 1",
+		},
+		"UnknownEvent": {
+			change: func(sc *StackConfiguration) {
+				sc.Spec.Behaviors.Resources[0].Hooks["upgrade"] = HookConfigurations{{Directory: "widget"}}
+			},
+			want: `unknown event name "upgrade"`,
+		},
+		"NoKind": {
+			change: func(sc *StackConfiguration) { sc.Spec.Behaviors.Resources[0].Selector.Kind = "" },
+			want:   "resources[0].selector.kind: a kind is required",
+		},
+		"VersionsOutOfOrder": {
+			change: func(sc *StackConfiguration) {
+				sc.Spec.Behaviors.Resources[0].Selector.MinVersion = "v1"
+				sc.Spec.Behaviors.Resources[0].Selector.MaxVersion = "v1beta1"
+			},
+			want: `resources[0].selector: minVersion "v1" is higher than maxVersion "v1beta1"`,
+		},
+		"InvalidLegacyGVK": {
+			change: func(sc *StackConfiguration) {
+				sc.Spec.Behaviors.CRDs = map[GVK]StackConfigurationBehavior{
+					"widgets": sc.Spec.Behaviors.Resources[0].StackConfigurationBehavior,
+				}
+			},
+			want: `crds[widgets]: "widgets" is not in the format Kind.group/version`,
+		},
+		"UnpinnedGitSource": {
+			change: func(sc *StackConfiguration) {
+				hook(sc).Source = StackConfigurationSource{Git: &GitSource{Repository: "https://example.org/widgets.git", Revision: "main"}}
+			},
+			want: `resources[0].hooks[reconcile][0].source.git.revision: "main" is not the full SHA-1 of a commit`,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sc := validConfiguration()
+			tc.change(sc)
+
+			err := sc.Validate(testEngineTypes, []string{"gotemplate", "helm3"})
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("Validate(...): %v", err)
+			case tc.want != "" && err == nil:
+				t.Errorf("Validate(...): got no error, want %q", tc.want)
+			case tc.want != "" && !strings.Contains(err.Error(), tc.want):
+				t.Errorf("Validate(...): got %q, want it to contain %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestEscapesRoot(t *testing.T) {
+	cases := map[string]bool{
+		"":                  false,
+		".":                 false,
+		"widget":            false,
+		"widget/..":         false,
+		"./widget/../other": false,
+		"..":                true,
+		"../widget":         true,
+		"widget/../..":      true,
+		"widget/../../a":    true,
+		"/../widget":        true,
+		"..widget":          false,
+	}
+
+	for dir, want := range cases {
+		t.Run(dir, func(t *testing.T) {
+			if got := escapesRoot(dir); got != want {
+				t.Errorf("escapesRoot(%q): got %t, want %t", dir, got, want)
+			}
+		})
+	}
+}
+
+func TestValidateRollout(t *testing.T) {
+	cases := map[string]struct {
+		rollout RolloutStrategy
+		want    string
+	}{
+		"Default":         {},
+		"AllAtOnce":       {rollout: RolloutStrategy{Type: RolloutAllAtOnce}},
+		"Batches":         {rollout: RolloutStrategy{Type: RolloutBatches, BatchSize: 3}},
+		"MaxUnavailable":  {rollout: RolloutStrategy{Type: RolloutMaxUnavailable, MaxUnavailable: 1}},
+		"ZeroBatchSize":   {rollout: RolloutStrategy{Type: RolloutBatches}, want: "rollout.batchSize: must be at least 1"},
+		"NegativeBatches": {rollout: RolloutStrategy{Type: RolloutBatches, BatchSize: -1}, want: "rollout.batchSize: must be at least 1"},
+		"ZeroMaxUnavailable": {
+			rollout: RolloutStrategy{Type: RolloutMaxUnavailable},
+			want:    "rollout.maxUnavailable: must be at least 1",
+		},
+		"UnknownStrategy": {rollout: RolloutStrategy{Type: "Canary"}, want: `rollout.type: unknown strategy "Canary"`},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			problems := validateRollout("rollout", &tc.rollout)
+			switch {
+			case tc.want == "" && len(problems) > 0:
+				t.Errorf("validateRollout(...): got %q, want no problems", problems)
+			case tc.want != "" && (len(problems) != 1 || !strings.Contains(problems[0], tc.want)):
+				t.Errorf("validateRollout(...): got %q, want one problem containing %q", problems, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var stackconfigurationlog = logf.Log.WithName("stackconfiguration-resource")
+
+// webhookEngineTypes are the engine types which the webhook allows hooks to reference, and
+// webhookReferenceEngineTypes are the ones which allow hooks to have references.
+var (
+	webhookEngineTypes          []string
+	webhookReferenceEngineTypes []string
+)
+
+// SetupWebhookWithManager registers the validating webhook for stack configurations with the manager.
+// The engine types are the ones which hooks are allowed to reference, and the reference engine types are
+// the ones which pass references to what they render.
+func (r *StackConfiguration) SetupWebhookWithManager(mgr ctrl.Manager, engineTypes, referenceEngineTypes []string) error {
+	webhookEngineTypes = engineTypes
+	webhookReferenceEngineTypes = referenceEngineTypes
+
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-helm-samples-stacks-crossplane-io-v1alpha1-stackconfiguration,mutating=false,failurePolicy=fail,groups=helm.samples.stacks.crossplane.io,resources=stackconfigurations,versions=v1alpha1,name=vstackconfiguration.kb.io
+
+var _ webhook.Validator = &StackConfiguration{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *StackConfiguration) ValidateCreate() error {
+	stackconfigurationlog.Info("validate create", "name", r.Name)
+
+	return r.Validate(webhookEngineTypes, webhookReferenceEngineTypes)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *StackConfiguration) ValidateUpdate(old runtime.Object) error {
+	stackconfigurationlog.Info("validate update", "name", r.Name)
+
+	return r.Validate(webhookEngineTypes, webhookReferenceEngineTypes)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *StackConfiguration) ValidateDelete() error {
+	// Deleting a stack configuration is always allowed.
+	return nil
+}
@@ -0,0 +1,264 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// stack-render renders a claim with a stack on the local machine, without a cluster, so that stack authors
+// can see what their stacks render. The hooks for the claim are resolved from the stack configuration in
+// the same way as they are by the controller, and the rendered objects are printed, written to a
+// directory, or compared with the objects in a directory.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+	"github.com/suskin/stack-template-engine/engines"
+)
+
+func main() {
+	var configFile string
+	var claimFile string
+	var stackRoot string
+	var event string
+	var referencesDir string
+	var outputDir string
+	var diffDir string
+	var verbose bool
+	flag.StringVar(&configFile, "stack-configuration", "", "The file with the StackConfiguration which configures the stack.")
+	flag.StringVar(&claimFile, "claim", "", "The file with the claim to render.")
+	flag.StringVar(&stackRoot, "stack", ".",
+		"The directory with the stack's files, laid out in the same way as they are under the registry root of the stack image.")
+	flag.StringVar(&event, "event", string(v1alpha1.EventCreate),
+		"The event to render the claim for. Hooks for create and update fall back to the reconcile hooks, as they do in the controller.")
+	flag.StringVar(&referencesDir, "references", "",
+		"A directory with a directory for each secret or config map which the claim references, named after the object, "+
+			"with a file for each key.")
+	flag.StringVar(&outputDir, "output-dir", "",
+		"Write the rendered objects to this directory, with a file for each object, instead of printing them.")
+	flag.StringVar(&diffDir, "diff", "",
+		"Compare the rendered objects with the objects in the YAML files under this directory, instead of printing them. "+
+			"Exits with status 1 if they differ.")
+	flag.BoolVar(&verbose, "verbose", false, "Log what the engines do.")
+	flag.Parse()
+
+	logger := logr.Logger(log.NullLogger{})
+	if verbose {
+		logger = zap.Logger(true)
+	}
+
+	if configFile == "" || claimFile == "" {
+		fail(fmt.Errorf("--stack-configuration and --claim are required"))
+	}
+
+	claim, objs, err := render(configFile, claimFile, stackRoot, v1alpha1.EventName(event), referencesDir, logger)
+	if err != nil {
+		fail(err)
+	}
+
+	switch {
+	case diffDir != "":
+		same, err := diff(objs, diffDir, claim.GetNamespace())
+		if err != nil {
+			fail(err)
+		}
+		if !same {
+			os.Exit(1)
+		}
+	case outputDir != "":
+		if err := writeObjects(objs, outputDir); err != nil {
+			fail(err)
+		}
+	default:
+		if err := printObjects(objs); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "stack-render: %v\n", err)
+	os.Exit(2)
+}
+
+// render renders each of the hooks which the stack configuration runs for the event on the claim, and returns
+// the claim, along with all of the rendered objects in the order of the hooks.
+func render(
+	configFile, claimFile, stackRoot string, event v1alpha1.EventName, referencesDir string, logger logr.Logger,
+) (*unstructured.Unstructured, []*unstructured.Unstructured, error) {
+	if !event.IsValid() {
+		return nil, nil, fmt.Errorf("unknown event %q; events are %v", event, v1alpha1.EventNames)
+	}
+
+	sc := &v1alpha1.StackConfiguration{}
+	if err := readYAML(configFile, sc); err != nil {
+		return nil, nil, err
+	}
+	if err := sc.Validate(engines.Types(), engines.ReferenceTypes()); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", configFile, err)
+	}
+
+	claim := &unstructured.Unstructured{}
+	if err := readYAML(claimFile, claim); err != nil {
+		return nil, nil, err
+	}
+	if claim.GetNamespace() == "" {
+		claim.SetNamespace("default")
+	}
+
+	gvk := claim.GroupVersionKind()
+
+	var hooks []v1alpha1.HookConfiguration
+	for _, e := range event.Fallbacks() {
+		var ok bool
+		hooks, ok = sc.HooksFor(gvk, e)
+		if !ok {
+			return nil, nil, fmt.Errorf("the stack configuration has no behavior for %s", gvk)
+		}
+		if len(hooks) > 0 {
+			event = e
+			break
+		}
+	}
+	if len(hooks) == 0 {
+		return nil, nil, fmt.Errorf("the stack configuration has no hooks for %s on %s", event, gvk)
+	}
+
+	workDir, err := ioutil.TempDir("", "stack-render")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	objs := make([]*unstructured.Unstructured, 0)
+	for i := range hooks {
+		hc := &hooks[i]
+		rendered, err := engines.RenderLocal(context.Background(), claim, hc, engines.LocalOptions{
+			Log:           logger,
+			ConfigName:    types.NamespacedName{Namespace: sc.GetNamespace(), Name: sc.GetName()},
+			StackRoot:     stackRoot,
+			ReferencesDir: referencesDir,
+			WorkDir:       filepath.Join(workDir, fmt.Sprintf("%s-%d", event, i)),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("hooks[%s][%d]: %v", event, i, err)
+		}
+		objs = append(objs, rendered...)
+	}
+
+	return claim, objs, nil
+}
+
+func readYAML(path string, into interface{}) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.YAMLToJSON(contents)
+	if err == nil {
+		err = json.Unmarshal(data, into)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func printObjects(objs []*unstructured.Unstructured) error {
+	for _, obj := range objs {
+		contents, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("---\n%s", contents)
+	}
+	return nil
+}
+
+// writeObjects writes each object to its own file in the directory, named after the object, so that the
+// objects can be compared one by one no matter how they were rendered.
+func writeObjects(objs []*unstructured.Unstructured, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		contents, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, objectFileName(obj)), contents, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func objectFileName(obj *unstructured.Unstructured) string {
+	kind := strings.ToLower(obj.GetKind())
+	if group := obj.GroupVersionKind().Group; group != "" {
+		kind += "." + group
+	}
+	return fmt.Sprintf("%s_%s_%s.yaml", kind, obj.GetNamespace(), obj.GetName())
+}
+
+// diff compares the rendered objects with the objects under a directory, and prints the differences. Both
+// sets of objects are written out in the same way first, so only differences in the objects themselves are
+// found, rather than differences in how they are split into files or formatted. Expected objects without a
+// namespace are put in the claim's namespace, as rendered objects are.
+func diff(objs []*unstructured.Unstructured, dir, namespace string) (bool, error) {
+	expected, err := engines.DecodeDirectory(dir, namespace)
+	if err != nil {
+		return false, err
+	}
+
+	tmp, err := ioutil.TempDir("", "stack-render-diff")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := writeObjects(expected, filepath.Join(tmp, "expected")); err != nil {
+		return false, err
+	}
+	if err := writeObjects(objs, filepath.Join(tmp, "rendered")); err != nil {
+		return false, err
+	}
+
+	cmd := exec.Command("diff", "-ruN", "expected", "rendered")
+	cmd.Dir = tmp
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,98 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+const gotemplateStack = "../../test/gotemplate"
+
+func TestRenderThenDiff(t *testing.T) {
+	claim, objs, err := render(
+		filepath.Join(gotemplateStack, "stack.yaml"),
+		filepath.Join(gotemplateStack, "sample-cr.yaml"),
+		gotemplateStack,
+		v1alpha1.EventCreate,
+		"",
+		log.NullLogger{},
+	)
+	if err != nil {
+		t.Fatalf("render(...): %v", err)
+	}
+	if len(objs) == 0 {
+		t.Fatalf("render(...): rendered nothing")
+	}
+
+	dir, err := ioutil.TempDir("", "stack-render-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Expected objects are usually written without a namespace, so it is left out of them here as well.
+	expected := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		obj = obj.DeepCopy()
+		obj.SetNamespace("")
+		expected = append(expected, obj)
+	}
+
+	changed := make([]*unstructured.Unstructured, 0, len(expected))
+	for _, obj := range expected {
+		obj = obj.DeepCopy()
+		obj.SetLabels(map[string]string{"changed": "true"})
+		changed = append(changed, obj)
+	}
+
+	cases := map[string]struct {
+		expected []*unstructured.Unstructured
+		want     bool
+	}{
+		"Same": {
+			expected: expected,
+			want:     true,
+		},
+		"Changed": {
+			expected: changed,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			expectedDir := filepath.Join(dir, name)
+			if err := writeObjects(tc.expected, expectedDir); err != nil {
+				t.Fatalf("writeObjects(...): %v", err)
+			}
+
+			same, err := diff(objs, expectedDir, claim.GetNamespace())
+			if err != nil {
+				t.Fatalf("diff(...): %v", err)
+			}
+			if same != tc.want {
+				t.Errorf("diff(...): got %t, want %t", same, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// getClaimStatus reads the status which was previously written to the claim by the render phase. If the claim
+// doesn't have a status yet, or its status can't be understood, an empty status is returned.
+func getClaimStatus(claim *unstructured.Unstructured) *v1alpha1.ClaimStatus {
+	status := &v1alpha1.ClaimStatus{}
+
+	content, ok := claim.Object[claimStatus].(map[string]interface{})
+	if !ok {
+		return status
+	}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(content, status); err != nil {
+		// The status is rewritten from scratch in this case, which is better than refusing to render.
+		return &v1alpha1.ClaimStatus{}
+	}
+
+	return status
+}
+
+// withHookConfiguration fills in the fields of a hook status which come from the hook's configuration
+// rather than from the engine which ran it.
+func withHookConfiguration(hs *v1alpha1.HookStatus, index int, hc *v1alpha1.HookConfiguration) *v1alpha1.HookStatus {
+	hs.Index = index
+	hs.Directory = hc.Directory
+	hs.Engine = hc.Engine.Type
+	return hs
+}
+
+// keepTransitionTimes carries the conditions of a hook's previous status over to its new one, so that the
+// transition times of the conditions which haven't changed are kept. Engines report a hook's conditions
+// from scratch every time that they are asked about it.
+func keepTransitionTimes(hs *v1alpha1.HookStatus, index int, previous []v1alpha1.HookStatus) *v1alpha1.HookStatus {
+	if index >= len(previous) {
+		return hs
+	}
+
+	conditions := hs.Conditions
+	hs.ConditionedStatus = *previous[index].ConditionedStatus.DeepCopy()
+	hs.SetConditions(conditions...)
+	return hs
+}
+
+// claimEvent determines which event applies to a claim which is being reconciled. See the documentation of
+// the event names for the semantics of each event.
+func claimEvent(claim *unstructured.Unstructured, status *v1alpha1.ClaimStatus) v1alpha1.EventName {
+	switch {
+	case meta.WasDeleted(claim):
+		return v1alpha1.EventDelete
+	case status.Event == "":
+		return v1alpha1.EventCreate
+	case status.ObservedGeneration != claim.GetGeneration():
+		return v1alpha1.EventUpdate
+	case (status.Event == v1alpha1.EventCreate || status.Event == v1alpha1.EventUpdate) && !hooksFinished(status):
+		// The claim hasn't changed since the hooks were started, so we keep following them until they are done.
+		return status.Event
+	default:
+		return v1alpha1.EventReconcile
+	}
+}
+
+// hooksFinished returns true if the hooks in the status ran to completion, whether or not they succeeded.
+func hooksFinished(status *v1alpha1.ClaimStatus) bool {
+	if status.Message != "" {
+		// The hooks couldn't be started, so they will need to be tried again.
+		return false
+	}
+
+	for _, hs := range status.Hooks {
+		if hs.Phase != v1alpha1.HookPhaseSucceeded && hs.Phase != v1alpha1.HookPhaseFailed {
+			return false
+		}
+	}
+
+	return len(status.Hooks) > 0
+}
+
+// hooksStarted returns true if any of the current hooks are running in a different job than they were
+// before, which means that they were started since the status was last written.
+func hooksStarted(previous []v1alpha1.HookStatus, current []v1alpha1.HookStatus) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+
+	for i := range current {
+		if current[i].JobName != previous[i].JobName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// summarizeClaimStatus sets the claim's phase and conditions based on the status of its hooks. While a claim
+// is being deleted, the hooks which are running are its delete hooks.
+func summarizeClaimStatus(status *v1alpha1.ClaimStatus, deleting bool) {
+	// While changes are being planned, or are waiting for approval, the claim is waiting on its plan rather
+	// than on its hooks. The claim's other conditions are left as they are, because nothing has changed yet.
+	if plan := status.Plan; plan != nil && plan.Phase != v1alpha1.PlanPhaseApproved && !deleting {
+		if plan.Phase == v1alpha1.PlanPhaseFailed {
+			status.Phase = v1alpha1.ClaimPhaseFailed
+			status.SetConditions(runtimev1alpha1.ReconcileError(errorMessage(plan.Message)))
+			return
+		}
+
+		status.Phase = v1alpha1.ClaimPhasePlanned
+		status.SetConditions(runtimev1alpha1.ReconcileSuccess())
+		return
+	}
+
+	if status.Message != "" {
+		// The hooks couldn't be run at all.
+		status.Phase = v1alpha1.ClaimPhaseFailed
+		status.SetConditions(
+			runtimev1alpha1.Unavailable().WithMessage(status.Message),
+			runtimev1alpha1.ReconcileError(errorMessage(status.Message)),
+		)
+		return
+	}
+
+	status.SetConditions(runtimev1alpha1.ReconcileSuccess())
+
+	if len(status.Hooks) == 0 {
+		status.Phase = v1alpha1.ClaimPhasePending
+		status.SetConditions(runtimev1alpha1.Creating())
+		return
+	}
+
+	phase := v1alpha1.ClaimPhaseRendered
+	for _, hs := range status.Hooks {
+		switch hs.Phase {
+		case v1alpha1.HookPhaseFailed:
+			status.Phase = v1alpha1.ClaimPhaseFailed
+			status.SetConditions(runtimev1alpha1.Unavailable().WithMessage(hs.Message))
+			return
+		case v1alpha1.HookPhaseSucceeded:
+		default:
+			phase = v1alpha1.ClaimPhaseRendering
+		}
+	}
+
+	status.Phase = phase
+	if deleting {
+		if phase == v1alpha1.ClaimPhaseRendering {
+			status.Phase = v1alpha1.ClaimPhaseDeleting
+		}
+		status.SetConditions(runtimev1alpha1.Deleting())
+		return
+	}
+
+	if phase == v1alpha1.ClaimPhaseRendered {
+		status.SetConditions(runtimev1alpha1.Available())
+	} else {
+		status.SetConditions(runtimev1alpha1.Creating())
+	}
+}
+
+// errorMessage turns a message which was recorded on a status back into an error, for the condition helpers
+// which expect one.
+type errorMessage string
+
+func (e errorMessage) Error() string {
+	return string(e)
+}
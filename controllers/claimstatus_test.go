@@ -0,0 +1,136 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+func TestClaimEvent(t *testing.T) {
+	finished := []v1alpha1.HookStatus{{Phase: v1alpha1.HookPhaseSucceeded}, {Phase: v1alpha1.HookPhaseFailed}}
+	running := []v1alpha1.HookStatus{{Phase: v1alpha1.HookPhaseSucceeded}, {Phase: v1alpha1.HookPhaseRunning}}
+
+	cases := map[string]struct {
+		deleted bool
+		status  v1alpha1.ClaimStatus
+		want    v1alpha1.EventName
+	}{
+		"NewClaim": {
+			want: v1alpha1.EventCreate,
+		},
+		"CreateHooksRunning": {
+			status: v1alpha1.ClaimStatus{Event: v1alpha1.EventCreate, ObservedGeneration: 1, Hooks: running},
+			want:   v1alpha1.EventCreate,
+		},
+		"CreateHooksCouldNotStart": {
+			status: v1alpha1.ClaimStatus{Event: v1alpha1.EventCreate, ObservedGeneration: 1, Message: "no engine"},
+			want:   v1alpha1.EventCreate,
+		},
+		"CreateHooksFinished": {
+			status: v1alpha1.ClaimStatus{Event: v1alpha1.EventCreate, ObservedGeneration: 1, Hooks: finished},
+			want:   v1alpha1.EventReconcile,
+		},
+		"Changed": {
+			status: v1alpha1.ClaimStatus{Event: v1alpha1.EventReconcile, ObservedGeneration: 0, Hooks: finished},
+			want:   v1alpha1.EventUpdate,
+		},
+		"ChangedWhileCreateHooksRunning": {
+			status: v1alpha1.ClaimStatus{Event: v1alpha1.EventCreate, ObservedGeneration: 0, Hooks: running},
+			want:   v1alpha1.EventUpdate,
+		},
+		"UpdateHooksRunning": {
+			status: v1alpha1.ClaimStatus{Event: v1alpha1.EventUpdate, ObservedGeneration: 1, Hooks: running},
+			want:   v1alpha1.EventUpdate,
+		},
+		"UpdateHooksFinished": {
+			status: v1alpha1.ClaimStatus{Event: v1alpha1.EventUpdate, ObservedGeneration: 1, Hooks: finished},
+			want:   v1alpha1.EventReconcile,
+		},
+		"ReconcileHooksRunning": {
+			status: v1alpha1.ClaimStatus{Event: v1alpha1.EventReconcile, ObservedGeneration: 1, Hooks: running},
+			want:   v1alpha1.EventReconcile,
+		},
+		"Deleted": {
+			deleted: true,
+			status:  v1alpha1.ClaimStatus{Event: v1alpha1.EventReconcile, ObservedGeneration: 1, Hooks: finished},
+			want:    v1alpha1.EventDelete,
+		},
+		"DeletedBeforeItWasCreated": {
+			deleted: true,
+			want:    v1alpha1.EventDelete,
+		},
+		"DeletedWhileChanged": {
+			deleted: true,
+			status:  v1alpha1.ClaimStatus{Event: v1alpha1.EventUpdate, ObservedGeneration: 0, Hooks: running},
+			want:    v1alpha1.EventDelete,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			claim := &unstructured.Unstructured{}
+			claim.SetGeneration(1)
+			if tc.deleted {
+				now := metav1.Now()
+				claim.SetDeletionTimestamp(&now)
+			}
+
+			if got := claimEvent(claim, &tc.status); got != tc.want {
+				t.Errorf("claimEvent(...): got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHooksStarted(t *testing.T) {
+	cases := map[string]struct {
+		previous []v1alpha1.HookStatus
+		current  []v1alpha1.HookStatus
+		want     bool
+	}{
+		"SameJobs": {
+			previous: []v1alpha1.HookStatus{{JobName: "a"}, {JobName: "b"}},
+			current:  []v1alpha1.HookStatus{{JobName: "a"}, {JobName: "b"}},
+		},
+		"NewJob": {
+			previous: []v1alpha1.HookStatus{{JobName: "a"}, {JobName: "b"}},
+			current:  []v1alpha1.HookStatus{{JobName: "a"}, {JobName: "c"}},
+			want:     true,
+		},
+		"HookAdded": {
+			previous: []v1alpha1.HookStatus{{JobName: "a"}},
+			current:  []v1alpha1.HookStatus{{JobName: "a"}, {JobName: "b"}},
+			want:     true,
+		},
+		"FirstRun": {
+			current: []v1alpha1.HookStatus{{JobName: "a"}},
+			want:    true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := hooksStarted(tc.previous, tc.current); got != tc.want {
+				t.Errorf("hooksStarted(...): got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
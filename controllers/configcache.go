@@ -0,0 +1,196 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// A render controller keeps its stack configuration, and the hooks which it resolves for its GVK, between
+// reconciles. The render controller watches stack configurations, and when its own changes, the cache is
+// invalidated and every claim of the GVK is reconciled again, so that changes to the hooks roll out without
+// the claims having to change.
+
+// stackConfigCache is a render controller's cached stack configuration. The cached objects are shared
+// between reconciles, so they must not be changed; the hooks are copied before they are returned.
+type stackConfigCache struct {
+	mu sync.Mutex
+
+	cfg *v1alpha1.StackConfiguration
+
+	// epoch counts invalidations, so that a configuration which was read before an invalidation isn't
+	// cached after it.
+	epoch int
+
+	// hooks are the resolved hooks for each event which has been looked up, and whether a behavior is
+	// configured for the GVK at all.
+	hooks map[v1alpha1.EventName]cachedHooks
+
+	// revision is the revision of the cached configuration's behavior. See stackRevision.
+	revision string
+
+	// announced is the revision which the claims were last reconciled for, which outlives invalidations.
+	announced string
+}
+
+type cachedHooks struct {
+	hooks []v1alpha1.HookConfiguration
+	ok    bool
+}
+
+// config returns the cached stack configuration, or nil if there isn't one, along with the current epoch.
+func (c *stackConfigCache) config() (*v1alpha1.StackConfiguration, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg, c.epoch
+}
+
+// setConfig caches a stack configuration which was read during the given epoch. If the cache has been
+// invalidated since, the configuration may be out of date, so it isn't cached.
+func (c *stackConfigCache) setConfig(cfg *v1alpha1.StackConfiguration, epoch int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+	c.cfg = cfg
+	c.hooks = map[v1alpha1.EventName]cachedHooks{}
+	c.revision = ""
+}
+
+// hooksFor returns copies of the hooks which the cached stack configuration has for an event on claims of
+// the given GVK, resolving them the first time that they are asked for. False is returned if no behavior is
+// configured for the GVK. The stack configuration which the hooks were resolved from is passed in, so that
+// hooks are never cached for a configuration which has since been replaced.
+func (c *stackConfigCache) hooksFor(
+	cfg *v1alpha1.StackConfiguration, gvk schema.GroupVersionKind, event v1alpha1.EventName,
+) ([]v1alpha1.HookConfiguration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, found := c.hooks[event]
+	if !found || c.cfg != cfg {
+		cached.hooks, cached.ok = cfg.HooksFor(gvk, event)
+		if c.cfg == cfg {
+			c.hooks[event] = cached
+		}
+	}
+
+	if cached.hooks == nil {
+		return nil, cached.ok
+	}
+	hooks := make([]v1alpha1.HookConfiguration, 0, len(cached.hooks))
+	for i := range cached.hooks {
+		hooks = append(hooks, *cached.hooks[i].DeepCopy())
+	}
+	return hooks, cached.ok
+}
+
+// revisionFor returns the revision of the behavior which the cached stack configuration has for the GVK,
+// working it out the first time that it is asked for.
+func (c *stackConfigCache) revisionFor(cfg *v1alpha1.StackConfiguration, gvk schema.GroupVersionKind) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cfg == cfg && c.revision != "" {
+		return c.revision, nil
+	}
+
+	revision, err := stackRevision(cfg, gvk)
+	if err != nil {
+		return "", err
+	}
+	if c.cfg == cfg {
+		c.revision = revision
+	}
+	return revision, nil
+}
+
+// announce records the revision which the claims are being reconciled for, and returns true if it is
+// different from the last one.
+func (c *stackConfigCache) announce(revision string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := revision != c.announced
+	c.announced = revision
+	return changed
+}
+
+// invalidate forgets the cached stack configuration, so that the next reconcile reads it again.
+func (c *stackConfigCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = nil
+	c.hooks = nil
+	c.revision = ""
+	c.epoch++
+}
+
+// claimsForConfig maps an event for a stack configuration to requests for every claim of the render
+// controller's GVK, if the stack configuration is the controller's own, and the revision of its behavior for
+// the GVK has changed. The controller's cache is invalidated either way, so that the claims are reconciled
+// with the new configuration.
+func (r *RenderPhaseReconciler) claimsForConfig(o handler.MapObject) []reconcile.Request {
+	if (types.NamespacedName{Namespace: o.Meta.GetNamespace(), Name: o.Meta.GetName()}) != r.ConfigName {
+		return nil
+	}
+
+	r.configCache.invalidate()
+
+	sc, ok := o.Object.(*v1alpha1.StackConfiguration)
+	if !ok {
+		return nil
+	}
+	revision, err := stackRevision(sc, *r.GVK)
+	if err != nil {
+		r.Log.Error(err, "Error working out the revision of a changed stack configuration!", "stackConfiguration", r.ConfigName)
+		return nil
+	}
+	if !r.configCache.announce(revision) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
+	defer cancel()
+
+	claims := &unstructured.UnstructuredList{}
+	claims.SetGroupVersionKind(r.GVK.GroupVersion().WithKind(r.GVK.Kind + "List"))
+	if err := r.Client.List(ctx, claims); err != nil {
+		r.Log.Error(err, "Error listing claims to reconcile for a changed stack configuration!", "stackConfiguration", r.ConfigName)
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(claims.Items))
+	for _, claim := range claims.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: claim.GetNamespace(), Name: claim.GetName()},
+		})
+	}
+
+	r.Log.V(0).Info("Stack configuration changed; reconciling claims", "stackConfiguration", r.ConfigName,
+		"revision", revision, "claims", len(requests))
+	return requests
+}
@@ -0,0 +1,101 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+func TestClaimsForConfig(t *testing.T) {
+	sc := rolloutConfig(v1alpha1.RolloutStrategy{}, "widget")
+	claims := []unstructured.Unstructured{rolloutClaim("a", nil), rolloutClaim("b", nil)}
+	allClaims := []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "default", Name: "a"}},
+		{NamespacedName: types.NamespacedName{Namespace: "default", Name: "b"}},
+	}
+
+	gvk := widgetGVK
+	r := &RenderPhaseReconciler{
+		Client:     &rolloutClient{sc: sc, claims: claims},
+		Log:        ctrl.Log,
+		GVK:        &gvk,
+		ConfigName: client.ObjectKey{Namespace: sc.GetNamespace(), Name: sc.GetName()},
+	}
+
+	// The events are handled in order, because whether the claims are reconciled depends on the revision which
+	// they were last reconciled for.
+	steps := []struct {
+		name        string
+		change      func(sc *v1alpha1.StackConfiguration)
+		want        []reconcile.Request
+		invalidated bool
+	}{
+		{
+			name:   "AnotherStackConfiguration",
+			change: func(sc *v1alpha1.StackConfiguration) { sc.SetName("gadgets") },
+		},
+		{
+			name:        "FirstRevision",
+			change:      func(sc *v1alpha1.StackConfiguration) {},
+			want:        allClaims,
+			invalidated: true,
+		},
+		{
+			name:        "SameRevision",
+			change:      func(sc *v1alpha1.StackConfiguration) { sc.SetLabels(map[string]string{"team": "widgets"}) },
+			invalidated: true,
+		},
+		{
+			name: "HooksChanged",
+			change: func(sc *v1alpha1.StackConfiguration) {
+				sc.Spec.Behaviors.Resources[0].Hooks[v1alpha1.EventReconcile][0].Directory = "other"
+			},
+			want:        allClaims,
+			invalidated: true,
+		},
+		{
+			name:        "HooksChangedBack",
+			change:      func(sc *v1alpha1.StackConfiguration) {},
+			want:        allClaims,
+			invalidated: true,
+		},
+	}
+
+	for _, step := range steps {
+		changed := sc.DeepCopy()
+		step.change(changed)
+
+		_, epoch := r.configCache.config()
+		r.configCache.setConfig(sc, epoch)
+		got := r.claimsForConfig(handler.MapObject{Meta: changed, Object: changed})
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: claimsForConfig(...): got %v, want %v", step.name, got, step.want)
+		}
+		if cached, _ := r.configCache.config(); (cached == nil) != step.invalidated {
+			t.Errorf("%s: claimsForConfig(...): got invalidated %t, want %t", step.name, cached == nil, step.invalidated)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	kmeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+	"github.com/suskin/stack-template-engine/engines"
+)
+
+// HelmChartInstallReconciler installs the charts which HelmChartInstalls reference. An install is rendered
+// in the same way as a claim with a single reconcile hook for the chart, whose spec is the install's values.
+type HelmChartInstallReconciler struct {
+	Client client.Client
+	Log    logr.Logger
+
+	// Images are the defaults for the containers of render jobs.
+	Images engines.ImageOptions
+
+	// Config, Scheme and Mapper are used to create clients which act as the service accounts of installs.
+	Config *rest.Config
+	Scheme *runtime.Scheme
+	Mapper kmeta.RESTMapper
+}
+
+const (
+	installTimeout = 60 * time.Second
+
+	// installHookIndex is the position of the chart's hook. An install only has the one.
+	installHookIndex = 0
+)
+
+// +kubebuilder:rbac:groups=helm.samples.stacks.crossplane.io,resources=helmchartinstalls,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=helm.samples.stacks.crossplane.io,resources=helmchartinstalls/status,verbs=get;update;patch
+
+func (r *HelmChartInstallReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), installTimeout)
+	defer cancel()
+
+	hci := &v1alpha1.HelmChartInstall{}
+	if err := r.Client.Get(ctx, req.NamespacedName, hci); err != nil {
+		if kerrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	claim, err := installClaim(hci)
+	if err != nil {
+		return ctrl.Result{}, r.fail(ctx, hci, err)
+	}
+
+	if meta.WasDeleted(hci) {
+		return ctrl.Result{}, r.uninstall(ctx, hci, claim)
+	}
+
+	return ctrl.Result{}, r.install(ctx, hci, claim)
+}
+
+// install runs the job which renders and applies the chart, and records the release on the install's status.
+// A new revision is started whenever the job's inputs change. Once a revision has been applied, the objects
+// which the previous revision applied but this one didn't are pruned.
+func (r *HelmChartInstallReconciler) install(
+	ctx context.Context, hci *v1alpha1.HelmChartInstall, claim *unstructured.Unstructured,
+) error {
+	// The finalizer is added before anything is installed, so that the release's objects can be deleted
+	// along with the install.
+	if !meta.FinalizerExists(hci, finalizerName) {
+		meta.AddFinalizer(hci, finalizerName)
+		if err := r.Client.Update(ctx, hci); err != nil {
+			r.Log.V(0).Info("Error adding finalizer to install", "install", hci, "err", err)
+			return err
+		}
+	}
+
+	hc, err := installHook(hci)
+	if err != nil {
+		return r.fail(ctx, hci, err)
+	}
+
+	// Values are read, and the chart's objects are applied and pruned, as the install's service account.
+	if err := checkInstallServiceAccount(ctx, r.Client, hci); err != nil {
+		return r.fail(ctx, hci, err)
+	}
+	applyClient, err := impersonatingClient(r.Config, r.Scheme, r.Mapper, hci.GetNamespace(), hci.Spec.ServiceAccountName)
+	if err != nil {
+		return r.fail(ctx, hci, err)
+	}
+
+	refs, err := engines.ResolveValuesFrom(ctx, applyClient, hci.GetNamespace(), hci.Spec.ValuesFrom)
+	if err != nil {
+		r.Log.V(0).Info("Error resolving the install's values", "install", hci, "err", err)
+		return r.fail(ctx, hci, err)
+	}
+
+	engine, err := engines.Lookup(hc.Engine.Type)
+	if err != nil {
+		return r.fail(ctx, hci, err)
+	}
+
+	engineRunner := engine.New(engines.EngineOptions{
+		Log:    r.Log,
+		Images: r.Images,
+
+		ServiceAccountName: hci.Spec.ServiceAccountName,
+		ApplyClient:        applyClient,
+		References:         refs,
+
+		ReleaseName: hci.Spec.ReleaseName,
+		Namespace:   hci.Spec.Namespace,
+	})
+
+	cm, err := engineRunner.CreateConfig(claim, hc)
+	if err != nil {
+		r.Log.Error(err, "Error creating engine configuration!", "install", hci)
+		return r.fail(ctx, hci, err)
+	}
+	if err := r.Client.Create(ctx, cm); err != nil && !kerrors.IsAlreadyExists(err) {
+		r.Log.Error(err, "Error creating config map!", "install", hci)
+		return r.fail(ctx, hci, err)
+	}
+
+	hs, err := engineRunner.RunEngine(ctx, r.Client, claim, cm, hc.Source.Image, v1alpha1.EventReconcile, installHookIndex, hc)
+	if err != nil {
+		r.Log.Error(err, "Error running engine!", "install", hci)
+		return r.fail(ctx, hci, err)
+	}
+
+	status := &hci.Status
+	if hs.JobName != status.JobName {
+		status.Revision++
+		status.JobName = hs.JobName
+	}
+	status.ReleaseName = hci.Spec.ReleaseName
+	if status.ReleaseName == "" {
+		status.ReleaseName = hci.GetName()
+	}
+	status.Namespace = hci.Spec.Namespace
+	if status.Namespace == "" {
+		status.Namespace = hci.GetNamespace()
+	}
+	status.ObservedGeneration = hci.GetGeneration()
+	status.Message = hs.Message
+	status.SetConditions(append(hs.Conditions, runtimev1alpha1.ReconcileSuccess())...)
+
+	switch hs.Phase {
+	case v1alpha1.HookPhaseSucceeded:
+		status.Phase = v1alpha1.ReleasePhaseDeployed
+		if hs.Resources != nil {
+			if err := engines.Prune(ctx, applyClient, claim, installHookIndex, status.Resources, hs.Resources); err != nil {
+				r.Log.Error(err, "Error pruning objects which are no longer rendered!", "install", hci)
+				return r.fail(ctx, hci, err)
+			}
+			status.Resources = hs.Resources
+		}
+	case v1alpha1.HookPhaseFailed:
+		status.Phase = v1alpha1.ReleasePhaseFailed
+	default:
+		status.Phase = v1alpha1.ReleasePhaseInstalling
+	}
+
+	if err := deleteJobsExcept(ctx, r.Client, r.Log, claim, map[string]bool{hs.JobName: true}); err != nil {
+		r.Log.Error(err, "Error deleting stale jobs!", "install", hci)
+		return err
+	}
+
+	return r.setStatus(ctx, hci)
+}
+
+// uninstall deletes the objects which the release applied, and then releases the install. Objects which the
+// release no longer manages, or which its service account can no longer delete, are left alone.
+func (r *HelmChartInstallReconciler) uninstall(
+	ctx context.Context, hci *v1alpha1.HelmChartInstall, claim *unstructured.Unstructured,
+) error {
+	if !meta.FinalizerExists(hci, finalizerName) {
+		return nil
+	}
+
+	hci.Status.Phase = v1alpha1.ReleasePhaseUninstalling
+	if err := r.setStatus(ctx, hci); err != nil {
+		return err
+	}
+
+	if err := checkInstallServiceAccount(ctx, r.Client, hci); err != nil {
+		return r.fail(ctx, hci, err)
+	}
+	applyClient, err := impersonatingClient(r.Config, r.Scheme, r.Mapper, hci.GetNamespace(), hci.Spec.ServiceAccountName)
+	if err != nil {
+		return r.fail(ctx, hci, err)
+	}
+
+	if err := engines.Prune(ctx, applyClient, claim, installHookIndex, hci.Status.Resources, nil); err != nil {
+		r.Log.Error(err, "Error deleting the release's objects!", "install", hci)
+		return r.fail(ctx, hci, err)
+	}
+
+	meta.RemoveFinalizer(hci, finalizerName)
+	if err := r.Client.Update(ctx, hci); err != nil && !kerrors.IsNotFound(err) {
+		r.Log.V(0).Info("Error removing finalizer from install", "install", hci, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// installClaim returns the claim which an install is rendered as. The claim is the install itself as far
+// as its identity goes, so that the install owns the render job, but its spec is the install's values.
+func installClaim(hci *v1alpha1.HelmChartInstall) (*unstructured.Unstructured, error) {
+	claim := &unstructured.Unstructured{}
+	claim.SetGroupVersionKind(v1alpha1.HelmChartInstallGroupVersionKind)
+	claim.SetNamespace(hci.GetNamespace())
+	claim.SetName(hci.GetName())
+	claim.SetUID(hci.GetUID())
+	claim.SetGeneration(hci.GetGeneration())
+	claim.SetLabels(hci.GetLabels())
+
+	if hci.Spec.Values != nil {
+		var values interface{}
+		if err := json.Unmarshal(hci.Spec.Values.Raw, &values); err != nil {
+			return nil, fmt.Errorf("values: %v", err)
+		}
+		claim.Object["spec"] = values
+	}
+
+	return claim, nil
+}
+
+// checkInstallServiceAccount returns an error unless an install's service account is one which the install
+// may act as. Anyone who can create an install in a namespace can act as the service accounts of the
+// namespace, which they could also do by creating a pod there. The service accounts of stacks are refused,
+// since they are bound to the stack's cluster rules, which the namespace doesn't otherwise grant. The
+// service account is read from the api server rather than from a cache, so that its labels are current.
+func checkInstallServiceAccount(ctx context.Context, kube client.Client, hci *v1alpha1.HelmChartInstall) error {
+	name := hci.Spec.ServiceAccountName
+	if name == "" {
+		return fmt.Errorf("serviceAccountName is required")
+	}
+
+	sa := &unstructured.Unstructured{}
+	sa.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ServiceAccount"))
+	if err := kube.Get(ctx, client.ObjectKey{Namespace: hci.GetNamespace(), Name: name}, sa); err != nil {
+		if kerrors.IsNotFound(err) {
+			return fmt.Errorf("service account %q doesn't exist in namespace %s", name, hci.GetNamespace())
+		}
+		return err
+	}
+
+	if config, ok := sa.GetLabels()[LabelStackConfigurationName]; ok {
+		return fmt.Errorf("service account %q holds the permissions of stack configuration %s/%s, so installs can't use it",
+			name, sa.GetLabels()[LabelStackConfigurationNamespace], config)
+	}
+
+	return nil
+}
+
+// installHook returns the hook which renders an install's chart.
+func installHook(hci *v1alpha1.HelmChartInstall) (*v1alpha1.HookConfiguration, error) {
+	hc := &v1alpha1.HookConfiguration{
+		Directory: hci.Spec.Chart.Directory,
+		Source:    v1alpha1.StackConfigurationSource{Image: hci.Spec.Chart.Image},
+	}
+	hci.Spec.Engine.DeepCopyInto(&hc.Engine)
+
+	switch hc.Engine.Type {
+	case "":
+		hc.Engine.Type = engines.Helm3EngineType
+	case engines.Helm2EngineType, engines.Helm3EngineType:
+	default:
+		return nil, fmt.Errorf("engine type must be %s or %s, not %q",
+			engines.Helm2EngineType, engines.Helm3EngineType, hc.Engine.Type)
+	}
+
+	return hc, nil
+}
+
+// fail records an error which prevented the chart from being installed or uninstalled on the install's
+// status. The original error is returned so that the install is requeued.
+func (r *HelmChartInstallReconciler) fail(ctx context.Context, hci *v1alpha1.HelmChartInstall, installErr error) error {
+	hci.Status.Phase = v1alpha1.ReleasePhaseFailed
+	hci.Status.Message = installErr.Error()
+	hci.Status.SetConditions(runtimev1alpha1.ReconcileError(installErr))
+
+	if err := r.setStatus(ctx, hci); err != nil {
+		r.Log.Error(err, "Error recording failure on install status!", "install", hci, "installErr", installErr)
+	}
+
+	return installErr
+}
+
+// setStatus writes the install's status. Writing the status triggers another reconcile, so it's only
+// written if it differs from the status which the controller's cache has for the install.
+func (r *HelmChartInstallReconciler) setStatus(ctx context.Context, hci *v1alpha1.HelmChartInstall) error {
+	current := &v1alpha1.HelmChartInstall{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Namespace: hci.GetNamespace(), Name: hci.GetName()}, current); err == nil &&
+		equality.Semantic.DeepEqual(current.Status, hci.Status) {
+		return nil
+	}
+
+	if err := r.Client.Status().Update(ctx, hci); err != nil && !kerrors.IsNotFound(err) {
+		r.Log.V(0).Info("Error updating install status", "install", hci, "err", err)
+		return err
+	}
+	return nil
+}
+
+func (r *HelmChartInstallReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.HelmChartInstall{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
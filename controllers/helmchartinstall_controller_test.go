@@ -0,0 +1,82 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+func TestCheckInstallServiceAccount(t *testing.T) {
+	installer := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "installer"}}
+	stack := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "stack-default-widgets",
+		Labels:    permissionsLabels(types.NamespacedName{Namespace: "default", Name: "widgets"}),
+	}}
+	elsewhere := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "elsewhere"}}
+	kube := fake.NewFakeClientWithScheme(scheme.Scheme, installer, stack, elsewhere)
+
+	cases := map[string]struct {
+		name string
+		want string
+	}{
+		"ServiceAccount": {name: "installer"},
+		"NoServiceAccount": {
+			want: "serviceAccountName is required",
+		},
+		"MissingServiceAccount": {
+			name: "missing",
+			want: `service account "missing" doesn't exist in namespace default`,
+		},
+		"OtherNamespace": {
+			name: "elsewhere",
+			want: `service account "elsewhere" doesn't exist in namespace default`,
+		},
+		"StackServiceAccount": {
+			name: "stack-default-widgets",
+			want: "holds the permissions of stack configuration default/widgets",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			hci := &v1alpha1.HelmChartInstall{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "widget"},
+				Spec:       v1alpha1.HelmChartInstallSpec{ServiceAccountName: tc.name},
+			}
+
+			err := checkInstallServiceAccount(context.Background(), kube, hci)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("checkInstallServiceAccount(...): %v", err)
+			case tc.want != "" && err == nil:
+				t.Errorf("checkInstallServiceAccount(...): got no error, want %q", tc.want)
+			case tc.want != "" && !strings.Contains(err.Error(), tc.want):
+				t.Errorf("checkInstallServiceAccount(...): got %q, want it to contain %q", err, tc.want)
+			}
+		})
+	}
+}
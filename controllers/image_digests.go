@@ -0,0 +1,121 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+	"github.com/suskin/stack-template-engine/engines"
+)
+
+// AnnotationResolveImageDigests makes the setup phase resolve the tags of a stack configuration's images
+// again whenever its value changes, for example to a timestamp. See the documentation of ImageDigestPolicy.
+var AnnotationResolveImageDigests = v1alpha1.GroupVersion.Group + "/resolve-image-digests"
+
+// resolveImageDigests resolves the tags of the stack configuration's images to digests, and records the
+// digests in its status. Tags are only resolved if they haven't been yet, if the resolve annotation has
+// changed, or if the poll interval has passed since they were last resolved. The time until the next tag is
+// due to be resolved is returned, or zero if the stack configuration doesn't poll.
+//
+// If a tag can't be resolved, the image keeps the digest which it was resolved to before, if it has one, and
+// an error is returned.
+func (r *SetupPhaseReconciler) resolveImageDigests(ctx context.Context, sc *v1alpha1.StackConfiguration) (time.Duration, error) {
+	request := sc.GetAnnotations()[AnnotationResolveImageDigests]
+	requested := request != sc.Status.ResolveRequest
+
+	var interval time.Duration
+	if pi := sc.Spec.ImageDigests.PollInterval; pi != nil {
+		interval = pi.Duration
+	}
+
+	now := metav1.Now()
+	images := sc.SourceImages()
+	resolved := make([]v1alpha1.ImageDigest, 0, len(images))
+	problems := make([]string, 0)
+	var next time.Duration
+
+	for _, image := range images {
+		id, ok := sc.Status.ImageDigest(image)
+
+		if !ok || requested || (interval > 0 && !now.Time.Before(id.ResolvedAt.Add(interval))) {
+			digest, err := engines.ResolveImageDigest(ctx, image)
+			if err != nil {
+				r.Log.Error(err, "Error resolving the digest of a stack image!", "stackConfiguration", sc, "image", image)
+				problems = append(problems, err.Error())
+			} else {
+				if ok && id.Digest != digest {
+					r.Log.V(0).Info("Moving stack image to a new digest", "stackConfiguration", sc, "image", image,
+						"previousDigest", id.Digest, "digest", digest)
+				}
+				id = v1alpha1.ImageDigest{Image: image, Digest: digest, ResolvedAt: now}
+				ok = true
+			}
+		}
+
+		if !ok {
+			continue
+		}
+		resolved = append(resolved, id)
+
+		if interval > 0 {
+			// An image which failed to resolve is already due, so it's tried again when the setup phase
+			// retries.
+			due := id.ResolvedAt.Add(interval).Sub(now.Time)
+			if due > 0 && (next == 0 || due < next) {
+				next = due
+			}
+		}
+	}
+
+	sc.Status.Images = resolved
+
+	if len(problems) > 0 {
+		return next, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	// The request is only recorded once it has been carried out, so that failures are retried.
+	sc.Status.ResolveRequest = request
+	return next, nil
+}
+
+// pinImages replaces the stack images of the hooks with the digests which their tags were resolved to. Images
+// whose tags haven't been resolved, because the registry couldn't be reached or needs credentials, are left
+// as they are, so that they're rendered from their tags; they are returned. The setup phase reports why they
+// couldn't be resolved in the stack configuration's conditions.
+func pinImages(sc *v1alpha1.StackConfiguration, hooks []v1alpha1.HookConfiguration) []string {
+	unpinned := make([]string, 0)
+	for i := range hooks {
+		image := hooks[i].Source.Image
+		if image == "" {
+			continue
+		}
+
+		pinned, ok := sc.Status.PinnedImage(image)
+		if !ok {
+			unpinned = append(unpinned, image)
+			continue
+		}
+		hooks[i].Source.Image = pinned
+	}
+
+	return unpinned
+}
@@ -0,0 +1,351 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	kmeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// Rendered resources are applied as a service account which has only the permissions that the stack
+// configuration declares. The stack's rules are granted by two cluster roles, which the setup phase applies
+// when the stack configuration changes: one for the stack's namespaced rules, which is bound in the namespace
+// of each claim, and one for the stack's cluster rules, which is bound cluster wide. The render phase only
+// creates the service account and its bindings, the first time it sees a claim in a namespace.
+//
+// A stack can only be granted what the cluster role named by the controller's --stack-permissions-role flag
+// allows, so that creating a stack configuration doesn't let anyone grant themselves more than an admin has
+// agreed to. The controller is bound to the same role, rather than being allowed to bind or escalate, so the
+// api server refuses to grant anything else as well.
+//
+// Render jobs run as the service account, and engines which render inside of the controller apply with a
+// client which impersonates it, so the api server refuses anything which the stack isn't allowed to do.
+
+const (
+	permissionsFieldManager = "stack-template-engine"
+
+	// DefaultPermissionsRole is the cluster role which is installed with the controller to limit the
+	// permissions of stacks. It aggregates the cluster roles which are labelled with
+	// LabelAggregateToStackPermissions.
+	DefaultPermissionsRole = "stack-helm-stack-permissions"
+)
+
+// Labels which are put on the service accounts and RBAC objects of a stack, so that they can be found again
+// when the stack configuration goes away.
+var (
+	LabelStackConfigurationName      = v1alpha1.GroupVersion.Group + "/stack-configuration-name"
+	LabelStackConfigurationNamespace = v1alpha1.GroupVersion.Group + "/stack-configuration-namespace"
+
+	// LabelAggregateToStackPermissions adds a cluster role's rules to the default permissions role.
+	LabelAggregateToStackPermissions = v1alpha1.GroupVersion.Group + "/aggregate-to-stack-permissions"
+)
+
+var (
+	// inventoryRule lets render jobs record their inventory. The controller creates the inventory config maps,
+	// so the jobs only need to update them.
+	inventoryRule = rbacv1.PolicyRule{
+		APIGroups: []string{""},
+		Resources: []string{"configmaps"},
+		Verbs:     []string{"get", "patch"},
+	}
+
+	// permissionsKinds are the kinds of objects which are created for a stack's permissions.
+	permissionsKinds = []schema.GroupVersionKind{
+		corev1.SchemeGroupVersion.WithKind("ServiceAccount"),
+		rbacv1.SchemeGroupVersion.WithKind("RoleBinding"),
+		rbacv1.SchemeGroupVersion.WithKind("ClusterRole"),
+		rbacv1.SchemeGroupVersion.WithKind("ClusterRoleBinding"),
+	}
+)
+
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;create;patch;delete;impersonate
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings;clusterroles;clusterrolebindings,verbs=get;list;create;patch;delete
+
+// serviceAccountName returns the name of the service account which a stack's rendered resources are applied
+// as. The binding of the stack's namespaced rules has the same name.
+func serviceAccountName(configName types.NamespacedName) string {
+	return fmt.Sprintf("stack-%s-%s", configName.Namespace, configName.Name)
+}
+
+// clusterRoleName returns the name of the cluster role which grants a stack's cluster rules.
+func clusterRoleName(configName types.NamespacedName) string {
+	return fmt.Sprintf("stack-template-engine:%s:%s", configName.Namespace, configName.Name)
+}
+
+// namespacedRoleName returns the name of the cluster role which holds a stack's namespaced rules.
+func namespacedRoleName(configName types.NamespacedName) string {
+	return clusterRoleName(configName) + ":namespaced"
+}
+
+func permissionsLabels(configName types.NamespacedName) map[string]string {
+	return map[string]string{
+		LabelStackConfigurationName:      configName.Name,
+		LabelStackConfigurationNamespace: configName.Namespace,
+	}
+}
+
+// applyRoles applies the cluster roles which hold a stack's rules, if the rules are allowed. If they aren't,
+// the roles are left as they are, and the rules which aren't allowed are returned.
+func (r *SetupPhaseReconciler) applyRoles(ctx context.Context, sc *v1alpha1.StackConfiguration) ([]string, error) {
+	allowed, err := r.allowedRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var denied []string
+	denied = append(denied, deniedRules(allowed, sc.Spec.Permissions.Rules)...)
+	denied = append(denied, deniedRules(allowed, sc.Spec.Permissions.ClusterRules)...)
+	if len(denied) > 0 {
+		return denied, nil
+	}
+
+	configName := types.NamespacedName{Namespace: sc.GetNamespace(), Name: sc.GetName()}
+	labels := permissionsLabels(configName)
+
+	rules := make([]rbacv1.PolicyRule, 0, len(sc.Spec.Permissions.Rules)+1)
+	rules = append(rules, sc.Spec.Permissions.Rules...)
+	rules = append(rules, inventoryRule)
+
+	clusterRules := make([]rbacv1.PolicyRule, 0, len(sc.Spec.Permissions.ClusterRules))
+	clusterRules = append(clusterRules, sc.Spec.Permissions.ClusterRules...)
+
+	objs := []runtime.Object{
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: namespacedRoleName(configName), Labels: labels},
+			Rules:      rules,
+		},
+		// The cluster role grants nothing if the stack has no cluster rules.
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: clusterRoleName(configName), Labels: labels},
+			Rules:      clusterRules,
+		},
+	}
+
+	for _, obj := range objs {
+		if err := r.Client.Patch(ctx, obj, client.Apply, client.FieldOwner(permissionsFieldManager), client.ForceOwnership); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// allowedRules returns the rules of the cluster role which limits what stacks can be granted. The role is
+// read as an unstructured object, so that it is read from the api server rather than from a cache. If no role
+// is configured, or it doesn't exist, nothing can be granted.
+func (r *SetupPhaseReconciler) allowedRules(ctx context.Context) ([]rbacv1.PolicyRule, error) {
+	if r.PermissionsRole == "" {
+		return nil, nil
+	}
+
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(rbacv1.SchemeGroupVersion.WithKind("ClusterRole"))
+	if err := r.Client.Get(ctx, types.NamespacedName{Name: r.PermissionsRole}, u); err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	role := &rbacv1.ClusterRole{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, role); err != nil {
+		return nil, err
+	}
+	return role.Rules, nil
+}
+
+// deniedRules returns the requested permissions which none of the allowed rules cover, one for each verb and
+// resource or URL. A wildcard is only covered by the same wildcard.
+func deniedRules(allowed, requested []rbacv1.PolicyRule) []string {
+	var denied []string
+	for _, rule := range requested {
+		for _, verb := range rule.Verbs {
+			for _, url := range rule.NonResourceURLs {
+				if !anyRule(allowed, func(a rbacv1.PolicyRule) bool {
+					return matchesValue(a.Verbs, verb) && matchesURL(a.NonResourceURLs, url)
+				}) {
+					denied = append(denied, fmt.Sprintf("%s %s", verb, url))
+				}
+			}
+
+			for _, group := range rule.APIGroups {
+				for _, resource := range rule.Resources {
+					names := rule.ResourceNames
+					if len(names) == 0 {
+						names = []string{""}
+					}
+
+					for _, name := range names {
+						if !anyRule(allowed, func(a rbacv1.PolicyRule) bool {
+							return matchesValue(a.Verbs, verb) &&
+								matchesValue(a.APIGroups, group) &&
+								matchesValue(a.Resources, resource) &&
+								(len(a.ResourceNames) == 0 || name != "" && matchesValue(a.ResourceNames, name))
+						}) {
+							denied = append(denied, describePermission(verb, group, resource, name))
+						}
+					}
+				}
+			}
+		}
+	}
+	return denied
+}
+
+func anyRule(rules []rbacv1.PolicyRule, matches func(rbacv1.PolicyRule) bool) bool {
+	for _, rule := range rules {
+		if matches(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesValue returns whether a value is in a rule's list of values, or the list has a wildcard.
+func matchesValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesURL returns whether a URL is in a rule's list of non-resource URLs, or under a prefix in the list
+// which ends with a wildcard.
+func matchesURL(urls []string, url string) bool {
+	for _, u := range urls {
+		if u == url || strings.HasSuffix(u, "*") && strings.HasPrefix(url, strings.TrimSuffix(u, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func describePermission(verb, group, resource, name string) string {
+	if group != "" {
+		resource = resource + "." + group
+	}
+	if name != "" {
+		resource = resource + "/" + name
+	}
+	return fmt.Sprintf("%s %s", verb, resource)
+}
+
+// ensurePermissions creates the service account for a stack in the given namespace, and binds the roles which
+// the setup phase applied to it. This is done the first time the namespace is seen, because the objects don't
+// change when the stack's rules do. A client which acts as the service account is returned.
+func (r *RenderPhaseReconciler) ensurePermissions(ctx context.Context, namespace string) (client.Client, error) {
+	name := serviceAccountName(r.ConfigName)
+
+	r.boundNamespacesMu.Lock()
+	defer r.boundNamespacesMu.Unlock()
+
+	if !r.boundNamespaces[namespace] {
+		labels := permissionsLabels(r.ConfigName)
+		subjects := []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      name,
+				Namespace: namespace,
+			},
+		}
+
+		objs := []runtime.Object{
+			&corev1.ServiceAccount{
+				TypeMeta:   metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "ServiceAccount"},
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: namespacedRoleName(r.ConfigName)},
+				Subjects:   subjects,
+			},
+			&rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: clusterRoleName(r.ConfigName) + ":" + namespace, Labels: labels},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: clusterRoleName(r.ConfigName)},
+				Subjects:   subjects,
+			},
+		}
+
+		for _, obj := range objs {
+			if err := r.Client.Patch(ctx, obj, client.Apply, client.FieldOwner(permissionsFieldManager), client.ForceOwnership); err != nil {
+				return nil, err
+			}
+		}
+
+		if r.boundNamespaces == nil {
+			r.boundNamespaces = map[string]bool{}
+		}
+		r.boundNamespaces[namespace] = true
+	}
+
+	return impersonatingClient(r.Config, r.Scheme, r.Mapper, namespace, name)
+}
+
+// impersonatingClient returns a client which acts as the given service account. The client doesn't use a
+// cache.
+func impersonatingClient(
+	config *rest.Config, scheme *runtime.Scheme, mapper kmeta.RESTMapper, namespace, name string,
+) (client.Client, error) {
+	cfg := rest.CopyConfig(config)
+	cfg.Impersonate = rest.ImpersonationConfig{
+		UserName: fmt.Sprintf("system:serviceaccount:%s:%s", namespace, name),
+	}
+
+	return client.New(cfg, client.Options{Scheme: scheme, Mapper: mapper})
+}
+
+// deletePermissions deletes the service accounts and RBAC objects which were created for a stack, in every
+// namespace. They are listed as unstructured objects, so that they are read from the api server rather than
+// from a cache.
+func (r *SetupPhaseReconciler) deletePermissions(ctx context.Context, configName types.NamespacedName) error {
+	for _, gvk := range permissionsKinds {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+
+		if err := r.Client.List(ctx, list, client.MatchingLabels(permissionsLabels(configName))); err != nil {
+			return err
+		}
+
+		for i := range list.Items {
+			if err := r.Client.Delete(ctx, &list.Items[i]); err != nil && !kerrors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestDeniedRules(t *testing.T) {
+	configMaps := rbacv1.PolicyRule{
+		APIGroups: []string{""},
+		Resources: []string{"configmaps"},
+		Verbs:     []string{"get", "list", "create"},
+	}
+
+	cases := map[string]struct {
+		allowed   []rbacv1.PolicyRule
+		requested []rbacv1.PolicyRule
+		want      []string
+	}{
+		"Covered": {
+			allowed:   []rbacv1.PolicyRule{configMaps},
+			requested: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "create"}}},
+		},
+		"NothingAllowed": {
+			requested: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}}},
+			want:      []string{"get configmaps"},
+		},
+		"VerbNotAllowed": {
+			allowed:   []rbacv1.PolicyRule{configMaps},
+			requested: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "delete"}}},
+			want:      []string{"delete configmaps"},
+		},
+		"CoveredAcrossRules": {
+			allowed: []rbacv1.PolicyRule{
+				configMaps,
+				{APIGroups: []string{"apps"}, Resources: []string{"*"}, Verbs: []string{"*"}},
+			},
+			requested: []rbacv1.PolicyRule{{APIGroups: []string{"", "apps"}, Resources: []string{"configmaps"}, Verbs: []string{"get"}}},
+		},
+		"WildcardRequested": {
+			allowed:   []rbacv1.PolicyRule{configMaps},
+			requested: []rbacv1.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}},
+			want:      []string{"* *.*"},
+		},
+		"EscalationRequested": {
+			allowed: []rbacv1.PolicyRule{configMaps},
+			requested: []rbacv1.PolicyRule{{
+				APIGroups: []string{"rbac.authorization.k8s.io"},
+				Resources: []string{"clusterroles"},
+				Verbs:     []string{"bind", "escalate"},
+			}},
+			want: []string{"bind clusterroles.rbac.authorization.k8s.io", "escalate clusterroles.rbac.authorization.k8s.io"},
+		},
+		"ResourceNamesAllowed": {
+			allowed: []rbacv1.PolicyRule{{
+				APIGroups:     []string{""},
+				Resources:     []string{"configmaps"},
+				ResourceNames: []string{"settings"},
+				Verbs:         []string{"get"},
+			}},
+			requested: []rbacv1.PolicyRule{{
+				APIGroups:     []string{""},
+				Resources:     []string{"configmaps"},
+				ResourceNames: []string{"settings", "other"},
+				Verbs:         []string{"get"},
+			}},
+			want: []string{"get configmaps/other"},
+		},
+		"AllNamesRequestedWhereOneIsAllowed": {
+			allowed: []rbacv1.PolicyRule{{
+				APIGroups:     []string{""},
+				Resources:     []string{"configmaps"},
+				ResourceNames: []string{"settings"},
+				Verbs:         []string{"get"},
+			}},
+			requested: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}}},
+			want:      []string{"get configmaps"},
+		},
+		"NonResourceURLs": {
+			allowed:   []rbacv1.PolicyRule{{NonResourceURLs: []string{"/healthz", "/metrics/*"}, Verbs: []string{"get"}}},
+			requested: []rbacv1.PolicyRule{{NonResourceURLs: []string{"/healthz", "/metrics/cadvisor", "/version"}, Verbs: []string{"get"}}},
+			want:      []string{"get /version"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := deniedRules(tc.allowed, tc.requested)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("deniedRules(...): got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+	"github.com/suskin/stack-template-engine/engines"
+)
+
+// Annotations which claims use to require approval for their changes, and to approve them. See the
+// documentation of ClaimPlan.
+var (
+	// AnnotationRequireApproval makes changes to a claim wait for approval when it is "true".
+	AnnotationRequireApproval = v1alpha1.GroupVersion.Group + "/require-approval"
+
+	// AnnotationApprove approves the claim's plan with the ID that it is set to.
+	AnnotationApprove = v1alpha1.GroupVersion.Group + "/approve"
+)
+
+// requiresApproval returns true if changes to the claim need to be approved before they are applied.
+func requiresApproval(cfg *v1alpha1.StackConfiguration, claim *unstructured.Unstructured) bool {
+	return cfg.Spec.RequireApproval || claim.GetAnnotations()[AnnotationRequireApproval] == "true"
+}
+
+// planHooks plans what the given hooks for an event would change, and records the plan on the claim's status.
+// True is returned once the plan has been approved, or if it doesn't change anything, which means that the
+// hooks can be run.
+//
+// Errors which prevent the hooks from being planned are recorded on the plan rather than as the claim's
+// message, because the hooks themselves haven't been run.
+func (r *RenderPhaseReconciler) planHooks(
+	ctx context.Context,
+	claim *unstructured.Unstructured,
+	cfg *v1alpha1.StackConfiguration,
+	event v1alpha1.EventName,
+	hooks []v1alpha1.HookConfiguration,
+	status *v1alpha1.ClaimStatus,
+) (bool, error) {
+	plan := &v1alpha1.ClaimPlan{
+		Event:      event,
+		Generation: claim.GetGeneration(),
+		Hooks:      make([]v1alpha1.HookPlan, 0, len(hooks)),
+	}
+
+	applyClient, err := r.ensurePermissions(ctx, claim.GetNamespace())
+	if err != nil {
+		r.Log.Error(err, "Error setting up the stack's permissions!", "claim", claim)
+		return false, r.failPlan(ctx, claim, status, plan, err)
+	}
+
+	for i := range hooks {
+		hp, err := r.planHook(ctx, claim, applyClient, event, i, &hooks[i], status.Hooks)
+		if err != nil {
+			r.Log.Error(err, "Error planning hook!", "claim", claim, "hookConfig", hooks[i])
+			return false, r.failPlan(ctx, claim, status, plan, err)
+		}
+		plan.Hooks = append(plan.Hooks, *hp)
+	}
+
+	if err := summarizePlan(plan, claim); err != nil {
+		return false, r.failPlan(ctx, claim, status, plan, err)
+	}
+
+	status.Plan = plan
+	return plan.Phase == v1alpha1.PlanPhaseApproved, nil
+}
+
+// planHook plans what an individual hook would change. What the hook would prune is planned from the
+// inventory of its previous run.
+func (r *RenderPhaseReconciler) planHook(
+	ctx context.Context,
+	claim *unstructured.Unstructured,
+	applyClient client.Client,
+	event v1alpha1.EventName,
+	index int,
+	hookCfg *v1alpha1.HookConfiguration,
+	previous []v1alpha1.HookStatus,
+) (*v1alpha1.HookPlan, error) {
+	engine, err := engines.Lookup(hookCfg.Engine.Type)
+	if err != nil {
+		r.Log.V(0).Info("Unrecognized engine type! Skipping hook.", "claim", claim, "hookConfig", hookCfg)
+		return &v1alpha1.HookPlan{Index: index, Phase: v1alpha1.HookPhaseFailed, Message: err.Error()}, nil
+	}
+
+	engineRunner, cm, err := r.prepareEngine(ctx, claim, applyClient, engine, hookCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	planner, ok := engineRunner.(engines.ResourceEnginePlanner)
+	if !ok {
+		msg := fmt.Sprintf("engine type %q can't plan changes", hookCfg.Engine.Type)
+		return &v1alpha1.HookPlan{Index: index, Phase: v1alpha1.HookPhaseFailed, Message: msg}, nil
+	}
+
+	hp, err := planner.PlanEngine(ctx, r.Client, claim, cm, hookCfg.Source.Image, event, index, hookCfg)
+	if err != nil {
+		return nil, err
+	}
+	hp.Index = index
+
+	if hp.Phase != v1alpha1.HookPhaseSucceeded {
+		return hp, nil
+	}
+
+	var inventory []corev1.ObjectReference
+	for _, p := range previous {
+		if p.Index == index {
+			inventory = p.Resources
+		}
+	}
+
+	hp.Delete, err = engines.PlanPrune(ctx, applyClient, claim, index, inventory, hp.Resources)
+	return hp, err
+}
+
+// summarizePlan sets the phase of a plan based on the plans of its hooks. Once every hook has been planned,
+// the plan is given its ID, and it is approved if the claim approves that ID or if nothing would change.
+func summarizePlan(plan *v1alpha1.ClaimPlan, claim *unstructured.Unstructured) error {
+	plan.Phase = ""
+	for _, hp := range plan.Hooks {
+		switch hp.Phase {
+		case v1alpha1.HookPhaseFailed:
+			plan.Phase = v1alpha1.PlanPhaseFailed
+			plan.Message = hp.Message
+			return nil
+		case v1alpha1.HookPhaseSucceeded:
+		default:
+			plan.Phase = v1alpha1.PlanPhasePlanning
+		}
+	}
+
+	if plan.Phase == v1alpha1.PlanPhasePlanning {
+		return nil
+	}
+
+	id, err := engines.PlanID(plan)
+	if err != nil {
+		return err
+	}
+	plan.ID = id
+
+	switch {
+	case !planChanges(plan):
+		plan.Phase = v1alpha1.PlanPhaseApproved
+	case claim.GetAnnotations()[AnnotationApprove] == id:
+		plan.Phase = v1alpha1.PlanPhaseApproved
+	default:
+		plan.Phase = v1alpha1.PlanPhaseAwaitingApproval
+	}
+
+	return nil
+}
+
+// planChanges returns true if any of the hooks in the plan would change something.
+func planChanges(plan *v1alpha1.ClaimPlan) bool {
+	for _, hp := range plan.Hooks {
+		if len(hp.Create) > 0 || len(hp.Update) > 0 || len(hp.Delete) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// failPlan records an error which prevented the hooks from being planned on the claim's plan. The original
+// error is returned so that the claim is requeued.
+func (r *RenderPhaseReconciler) failPlan(
+	ctx context.Context,
+	claim *unstructured.Unstructured,
+	status *v1alpha1.ClaimStatus,
+	plan *v1alpha1.ClaimPlan,
+	planErr error,
+) error {
+	plan.Phase = v1alpha1.PlanPhaseFailed
+	plan.Message = planErr.Error()
+	status.Plan = plan
+
+	if err := r.setClaimStatus(ctx, claim, status); err != nil {
+		r.Log.Error(err, "Error recording plan failure on claim status!", "claim", claim, "planErr", planErr)
+	}
+
+	return planErr
+}
@@ -0,0 +1,258 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
+	batchv1 "k8s.io/api/batch/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	kmeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// A renderController is a render controller which was started by the setup phase.
+//
+// Controllers can't be removed from a manager once they have been added, so each render controller runs
+// in a manager of its own, which is stopped when the controller is no longer needed. Stopping the manager
+// also stops the informers which were watching the controller's GVK.
+type renderController struct {
+	// gvk is the GVK which the controller renders.
+	gvk schema.GroupVersionKind
+
+	// configName is the stack configuration which the controller was started for.
+	configName types.NamespacedName
+
+	cancel context.CancelFunc
+
+	// done is closed once the controller's manager has stopped.
+	done chan struct{}
+}
+
+// NewRenderController starts a render controller for the given GVK, unless one is already running. A kind is
+// only ever rendered by a single controller, at a single version, so if another stack configuration has
+// already started a controller for the kind, an error is returned. If the same stack configuration started
+// one for another version of the kind, that controller is stopped first. An error is also returned if the
+// GVK's CRD isn't installed.
+func (r *SetupPhaseReconciler) NewRenderController(gvk *schema.GroupVersionKind, configName types.NamespacedName) error {
+	// TODO
+	// - What if we have multiple controller workers watching the stack configuration? Do we need to worry about trying to not
+	//   create multiple render controllers for a single gvk?
+
+	r.renderControllersMu.Lock()
+	defer r.renderControllersMu.Unlock()
+
+	gk := gvk.GroupKind()
+	if rc, ok := r.renderControllers[gk]; ok {
+		if rc.configName != configName {
+			return fmt.Errorf("%s is already rendered by stack configuration %s", gk, rc.configName)
+		}
+		if rc.gvk == *gvk {
+			return nil
+		}
+
+		// The claims of the kind are the same at every version, so the new controller picks up where the
+		// old one stops.
+		r.Log.V(0).Info("Stopping render controller of another version", "gvk", rc.gvk, "stackConfiguration", configName)
+		rc.cancel()
+		<-rc.done
+		delete(r.renderControllers, gk)
+	}
+
+	// The controller would start, but then fail to watch anything, so it's better to find out now.
+	if _, err := r.Manager.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+		if kmeta.IsNoMatchError(err) {
+			return fmt.Errorf("the CRD for %s is not installed", gvk)
+		}
+		return err
+	}
+
+	mgr, err := ctrl.NewManager(r.Manager.GetConfig(), ctrl.Options{
+		Scheme: r.Manager.GetScheme(),
+		// The metrics for the render controllers are served by the main manager, so this one
+		// shouldn't bind to anything.
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		r.Log.V(0).Info("unable to create manager for controller", "gvk", gvk, "err", err)
+		return err
+	}
+
+	apiType := &unstructured.Unstructured{}
+	apiType.SetGroupVersionKind(*gvk)
+
+	log := ctrl.Log.WithName("controllers").WithName(fmt.Sprintf("%s.%s/%s", gvk.Kind, gvk.Group, gvk.Version))
+
+	reconciler := &RenderPhaseReconciler{
+		Client:       mgr.GetClient(),
+		Log:          log,
+		GVK:          gvk,
+		ConfigName:   configName,
+		RegistryRoot: r.RegistryRoot,
+		Images:       r.Images,
+
+		ResolveImageDigests: r.ResolveImageDigests,
+
+		Config: mgr.GetConfig(),
+		Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(),
+	}
+
+	r.Log.V(0).Info("Adding new controller to manager", "gvk", gvk, "stackConfiguration", configName)
+
+	// Changes to the stack configuration are rolled out to every claim of the GVK.
+	err = ctrl.NewControllerManagedBy(mgr).
+		For(apiType).
+		Owns(&batchv1.Job{}).
+		Watches(&source.Kind{Type: &v1alpha1.StackConfiguration{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(reconciler.claimsForConfig)}).
+		Complete(reconciler)
+
+	if err != nil {
+		r.Log.V(0).Info("unable to create controller", "gvk", gvk, "err", err)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := &renderController{
+		gvk:        *gvk,
+		configName: configName,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+
+	if r.renderControllers == nil {
+		r.renderControllers = map[schema.GroupKind]*renderController{}
+	}
+	r.renderControllers[gk] = rc
+
+	go func() {
+		if err := mgr.Start(ctx.Done()); err != nil {
+			log.Error(err, "Render controller stopped unexpectedly!")
+		}
+		close(rc.done)
+
+		// If the controller stopped on its own, forgetting about it lets it be started again the next
+		// time that its stack configuration is reconciled.
+		r.renderControllersMu.Lock()
+		defer r.renderControllersMu.Unlock()
+		if r.renderControllers[gk] == rc {
+			delete(r.renderControllers, gk)
+		}
+	}()
+
+	return nil
+}
+
+// stopRenderControllers stops the render controllers which were started for the given stack configuration,
+// except for the ones whose kinds should be kept.
+//
+// Once a controller has stopped, nothing would remove the render finalizer from the claims of its GVK, and
+// they could never be deleted, so the finalizer is removed from all of them. Their delete hooks aren't run,
+// since the behavior which they came from is gone. If the finalizers can't be removed, an error is returned,
+// and they are removed the next time that any render controllers are stopped.
+func (r *SetupPhaseReconciler) stopRenderControllers(
+	ctx context.Context, configName types.NamespacedName, keep map[schema.GroupKind]bool,
+) error {
+	r.renderControllersMu.Lock()
+	stopped := make([]*renderController, 0)
+	for gk, rc := range r.renderControllers {
+		if rc.configName != configName || keep[gk] {
+			continue
+		}
+
+		r.Log.V(0).Info("Stopping render controller", "gvk", rc.gvk, "stackConfiguration", configName)
+		rc.cancel()
+		delete(r.renderControllers, gk)
+		stopped = append(stopped, rc)
+
+		if r.unreleasedGVKs == nil {
+			r.unreleasedGVKs = map[schema.GroupVersionKind]bool{}
+		}
+		r.unreleasedGVKs[rc.gvk] = true
+	}
+	r.renderControllersMu.Unlock()
+
+	// A controller which is still running could add the finalizer back.
+	for _, rc := range stopped {
+		select {
+		case <-rc.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	r.renderControllersMu.Lock()
+	unreleased := make([]schema.GroupVersionKind, 0, len(r.unreleasedGVKs))
+	for gvk := range r.unreleasedGVKs {
+		// If the kind is being rendered again, its controller takes care of its claims.
+		if _, ok := r.renderControllers[gvk.GroupKind()]; ok {
+			delete(r.unreleasedGVKs, gvk)
+			continue
+		}
+		unreleased = append(unreleased, gvk)
+	}
+	r.renderControllersMu.Unlock()
+
+	for _, gvk := range unreleased {
+		if err := r.releaseClaims(ctx, gvk); err != nil {
+			return err
+		}
+
+		r.renderControllersMu.Lock()
+		delete(r.unreleasedGVKs, gvk)
+		r.renderControllersMu.Unlock()
+	}
+
+	return nil
+}
+
+// releaseClaims removes the render finalizer from every claim of the given GVK.
+func (r *SetupPhaseReconciler) releaseClaims(ctx context.Context, gvk schema.GroupVersionKind) error {
+	claims := &unstructured.UnstructuredList{}
+	claims.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	if err := r.Client.List(ctx, claims); err != nil {
+		// If the CRD is gone, so are the claims.
+		if kmeta.IsNoMatchError(err) {
+			return nil
+		}
+		return err
+	}
+
+	for i := range claims.Items {
+		claim := &claims.Items[i]
+		if !meta.FinalizerExists(claim, finalizerName) {
+			continue
+		}
+
+		r.Log.V(0).Info("Releasing claim which is no longer rendered", "gvk", gvk, "claim", claim.GetNamespace()+"/"+claim.GetName())
+		meta.RemoveFinalizer(claim, finalizerName)
+		if err := r.Client.Update(ctx, claim); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -18,14 +18,23 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
 	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	kmeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -38,16 +47,47 @@ type RenderPhaseReconciler struct {
 	Client     client.Client
 	Log        logr.Logger
 	GVK        *schema.GroupVersionKind
-	EventName  v1alpha1.EventName
 	ConfigName types.NamespacedName
+
+	// RegistryRoot is where stack files are found on the controller's filesystem, for engines
+	// which render inside of the controller.
+	RegistryRoot string
+
+	// Images are the defaults for the containers of render jobs.
+	Images engines.ImageOptions
+
+	// ResolveImageDigests makes render jobs load the stack from the digests which the setup phase resolved
+	// the tags of the stack's images to.
+	ResolveImageDigests bool
+
+	// Config, Scheme and Mapper are used to create clients which act as the service accounts of stacks.
+	Config *rest.Config
+	Scheme *runtime.Scheme
+	Mapper kmeta.RESTMapper
+
+	// configCache is the stack configuration, and the hooks which have been resolved from it. It is
+	// invalidated when the stack configuration changes.
+	configCache stackConfigCache
+
+	// boundNamespaces are the namespaces where the stack's service account has been created and bound.
+	boundNamespaces   map[string]bool
+	boundNamespacesMu sync.Mutex
 }
 
 const (
 	renderTimeout = 60 * time.Second
+
+	claimStatus = "status"
+)
+
+var (
+	// finalizerName is the finalizer which is added to every claim that the render phase handles, so
+	// that the claim's delete hooks can run before the claim goes away.
+	finalizerName = v1alpha1.GroupVersion.Group + "/render"
 )
 
-// +kubebuilder:rbac:groups=helm.samples.stacks.crossplane.io,resources=helmchartinstalls,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups=helm.samples.stacks.crossplane.io,resources=helmchartinstalls/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 
 func (r *RenderPhaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), renderTimeout)
@@ -67,7 +107,7 @@ func (r *RenderPhaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		return ctrl.Result{}, err
 	}
 
-	r.Log.V(0).Info("Hello World!", "instanceName", req.NamespacedName, "instance", i)
+	r.Log.V(1).Info("Reconciling claim", "claim", req.NamespacedName)
 
 	// FIXME TODO we are conflating the setup and render phases here, because originally
 	// I was writing this controller as an experiment for a controller which only supported
@@ -91,17 +131,53 @@ func (r *RenderPhaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 	//       + The result of the job
 	//       + The logs of the job (maybe; it might be too much)
 
-	// TODO remaining functionality for the render phase:
-	// - Surface the job result somehow (for usability)
-	// - Support for deletion, unless we assume that garbage collection will do it for us
+	if meta.WasDeleted(i) {
+		return ctrl.Result{}, r.delete(ctx, i)
+	}
+
+	// Claims which were rendered with an older revision of their behavior are rolled out to at the pace
+	// which the stack configuration allows.
+	wait, err := r.waitForRollout(ctx, i)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if wait {
+		r.Log.V(0).Info("Waiting for the rollout of the stack configuration to reach the claim", "claim", i)
+		return ctrl.Result{RequeueAfter: rolloutRetryInterval}, nil
+	}
+
 	return ctrl.Result{}, r.render(ctx, i)
 }
 
 func (r *RenderPhaseReconciler) render(ctx context.Context, claim *unstructured.Unstructured) error {
+	status := getClaimStatus(claim)
+
 	cfg, err := r.getStackConfiguration(ctx, claim)
-	// TODO check for errors
+	if err != nil {
+		return r.failRender(ctx, claim, status, err)
+	}
+
+	// The finalizer is added before anything is rendered, so that the delete hooks get a chance to
+	// clean up whatever the other hooks create. If there turn out to be no delete hooks, the finalizer
+	// is removed as soon as the claim is deleted.
+	if !meta.FinalizerExists(claim, finalizerName) {
+		meta.AddFinalizer(claim, finalizerName)
+		if err := r.Client.Update(ctx, claim); err != nil {
+			r.Log.V(0).Info("Error adding finalizer to claim", "claim", claim, "err", err)
+			return err
+		}
+	}
 
-	trb, err := r.getBehavior(ctx, claim, cfg)
+	var trb []v1alpha1.HookConfiguration
+	var event v1alpha1.EventName
+
+	// If there are no hooks for the event which applies to the claim, we fall back to the reconcile hooks.
+	for _, event = range claimEvent(claim, status).Fallbacks() {
+		trb, err = r.getBehavior(ctx, claim, cfg, event)
+		if trb != nil || err != nil {
+			break
+		}
+	}
 
 	if trb == nil {
 		// TODO error condition with a real error returned
@@ -112,45 +188,363 @@ func (r *RenderPhaseReconciler) render(ctx context.Context, claim *unstructured.
 		return err
 	}
 
-	for _, hookCfg := range trb {
-		engineType := hookCfg.Engine.Type
+	if requiresApproval(cfg, claim) {
+		approved, err := r.planHooks(ctx, claim, cfg, event, trb, status)
+		if err != nil {
+			return err
+		}
+		if !approved {
+			r.Log.V(0).Info("Waiting for the claim's plan to be approved", "claim", claim, "plan", status.Plan)
+			if err := r.deleteStaleJobs(ctx, claim, status); err != nil {
+				r.Log.Error(err, "Error deleting stale jobs!", "claim", claim)
+				return err
+			}
+			return r.setClaimStatus(ctx, claim, status)
+		}
+	} else {
+		status.Plan = nil
+	}
 
-		var engineRunner engines.ResourceEngineRunner
+	// The revision is recorded before the hooks are run, so that a claim which fails counts against the
+	// rollout.
+	revision, err := r.configCache.revisionFor(cfg, *r.GVK)
+	if err != nil {
+		return r.failRender(ctx, claim, status, err)
+	}
+	status.StackRevision = revision
 
-		// TODO this should probably not be a hard-coded raw string
-		if engineType == "helm2" {
-			engineRunner = engines.NewHelm2EngineRunner(r.Log)
-		} else {
+	if err := r.runHooks(ctx, claim, cfg, event, trb, status); err != nil {
+		return err
+	}
+
+	if err := r.deleteStaleJobs(ctx, claim, status); err != nil {
+		r.Log.Error(err, "Error deleting stale jobs!", "claim", claim)
+		return err
+	}
+
+	return r.setClaimStatus(ctx, claim, status)
+}
+
+// delete runs the delete hooks for a claim which is being deleted. The claim's finalizer is only removed once
+// all of the delete hooks have succeeded, so that anything which garbage collection won't clean up, such as
+// cluster-scoped resources, can be cleaned up by the hooks.
+func (r *RenderPhaseReconciler) delete(ctx context.Context, claim *unstructured.Unstructured) error {
+	if !meta.FinalizerExists(claim, finalizerName) {
+		return nil
+	}
+
+	status := getClaimStatus(claim)
+
+	cfg, err := r.getStackConfiguration(ctx, claim)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			// Without a stack configuration, there are no delete hooks to wait for.
+			r.Log.V(0).Info("Stack configuration is gone; releasing claim without running delete hooks", "claim", claim)
+			return r.removeFinalizer(ctx, claim)
+		}
+		return r.failRender(ctx, claim, status, err)
+	}
+
+	hooks, err := r.getBehavior(ctx, claim, cfg, v1alpha1.EventDelete)
+	if err != nil {
+		return r.failRender(ctx, claim, status, err)
+	}
+
+	if len(hooks) == 0 {
+		r.Log.V(0).Info("No delete hooks are configured; releasing claim", "claim", claim)
+		return r.removeFinalizer(ctx, claim)
+	}
+
+	// Delete hooks aren't planned, so a claim can always be deleted.
+	status.Plan = nil
+
+	if err := r.runHooks(ctx, claim, cfg, v1alpha1.EventDelete, hooks, status); err != nil {
+		return err
+	}
+
+	if err := r.setClaimStatus(ctx, claim, status); err != nil {
+		return err
+	}
+
+	for _, hs := range status.Hooks {
+		if hs.Phase != v1alpha1.HookPhaseSucceeded {
+			// We will be notified again when the hook's job makes progress.
+			r.Log.V(0).Info("Waiting for delete hooks to succeed before releasing claim", "claim", claim)
+			return nil
+		}
+	}
+
+	return r.removeFinalizer(ctx, claim)
+}
+
+func (r *RenderPhaseReconciler) removeFinalizer(ctx context.Context, claim *unstructured.Unstructured) error {
+	meta.RemoveFinalizer(claim, finalizerName)
+	if err := r.Client.Update(ctx, claim); err != nil && !kerrors.IsNotFound(err) {
+		r.Log.V(0).Info("Error removing finalizer from claim", "claim", claim, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// runHooks runs the given hooks for an event, and records their status. If there is an error which prevents
+// the hooks from running, the error is recorded on the claim's status before being returned.
+func (r *RenderPhaseReconciler) runHooks(
+	ctx context.Context,
+	claim *unstructured.Unstructured,
+	cfg *v1alpha1.StackConfiguration,
+	event v1alpha1.EventName,
+	hooks []v1alpha1.HookConfiguration,
+	status *v1alpha1.ClaimStatus,
+) error {
+	// Running the engines is idempotent, so the hooks are run on every reconcile. A hook is only started
+	// again if its inputs have changed; otherwise the status of the hook's existing run is returned.
+	// Rendered resources are applied as the stack's service account, which is set up before anything runs.
+	applyClient, err := r.ensurePermissions(ctx, claim.GetNamespace())
+	if err != nil {
+		r.Log.Error(err, "Error setting up the stack's permissions!", "claim", claim)
+		return r.failRender(ctx, claim, status, err)
+	}
+
+	previous := status.Hooks
+	status.Event = event
+	status.Hooks = make([]v1alpha1.HookStatus, 0, len(hooks))
+	status.Message = ""
+
+	for i, hookCfg := range hooks {
+		engine, err := engines.Lookup(hookCfg.Engine.Type)
+		if err != nil {
 			r.Log.V(0).Info("Unrecognized engine type! Skipping hook.", "claim", claim, "hookConfig", hookCfg)
+			hs := &v1alpha1.HookStatus{
+				Phase:   v1alpha1.HookPhaseFailed,
+				Message: err.Error(),
+			}
+			hs.SetConditions(runtimev1alpha1.Unavailable().WithMessage(hs.Message))
+			status.Hooks = append(status.Hooks, *withHookConfiguration(keepTransitionTimes(hs, i, previous), i, &hookCfg))
 			continue
 		}
 
-		cm, err := engineRunner.CreateConfig(claim, &hookCfg)
-
-		// engineCfg, err := r.createBehaviorEngineConfiguration(ctx, claim, &hookCfg)
+		engineRunner, cm, err := r.prepareEngine(ctx, claim, applyClient, engine, &hookCfg)
+		if err != nil {
+			return r.failRender(ctx, claim, status, err)
+		}
 
+		hs, err := engineRunner.RunEngine(ctx, r.Client, claim, cm, hookCfg.Source.Image, event, i, &hookCfg)
 		if err != nil {
-			r.Log.Error(err, "Error creating engine configuration!", "claim", claim, "hookConfig", hookCfg)
-			return err
+			r.Log.Error(err, "Error running engine!", "claim", claim, "hookConfig", hookCfg)
+			return r.failRender(ctx, claim, status, err)
+		}
+
+		if err := r.pruneHook(ctx, applyClient, claim, event, i, previous, hs); err != nil {
+			r.Log.Error(err, "Error pruning objects which are no longer rendered!", "claim", claim, "hookConfig", hookCfg)
+			return r.failRender(ctx, claim, status, err)
+		}
+
+		status.Hooks = append(status.Hooks, *withHookConfiguration(keepTransitionTimes(hs, i, previous), i, &hookCfg))
+	}
+
+	if hooksStarted(previous, status.Hooks) {
+		now := metav1.Now()
+		status.LastRenderTime = &now
+	}
+	status.ObservedGeneration = claim.GetGeneration()
+
+	return nil
+}
+
+// prepareEngine creates the runner for a hook's engine, and creates the engine's configuration.
+func (r *RenderPhaseReconciler) prepareEngine(
+	ctx context.Context,
+	claim *unstructured.Unstructured,
+	applyClient client.Client,
+	engine engines.Engine,
+	hookCfg *v1alpha1.HookConfiguration,
+) (engines.ResourceEngineRunner, *corev1.ConfigMap, error) {
+	// Referenced secrets and config maps are read as the stack's service account, so the stack needs
+	// permission to read them.
+	refs, err := engines.ResolveReferences(ctx, applyClient, claim, hookCfg)
+	if err != nil {
+		r.Log.V(0).Info("Error resolving the hook's references", "claim", claim, "hookConfig", hookCfg, "err", err)
+		return nil, nil, err
+	}
+
+	// Engines which read the source themselves don't need a copy of it.
+	if !engine.ReadsSources || !engines.ReadsSourceInProcess(hookCfg.Source) {
+		if err := engines.PrepareSource(ctx, r.Client, r.ConfigName.Namespace, claim, hookCfg.Source); err != nil {
+			r.Log.V(0).Info("Error preparing the hook's source", "claim", claim, "hookConfig", hookCfg, "err", err)
+			return nil, nil, err
 		}
+	}
+
+	engineRunner := engine.New(engines.EngineOptions{
+		Log:          r.Log,
+		ConfigName:   r.ConfigName,
+		RegistryRoot: r.RegistryRoot,
+		Images:       r.Images,
+
+		ServiceAccountName: serviceAccountName(r.ConfigName),
+		ApplyClient:        applyClient,
+		References:         refs,
+	})
 
+	cm, err := engineRunner.CreateConfig(claim, hookCfg)
+
+	// engineCfg, err := r.createBehaviorEngineConfiguration(ctx, claim, &hookCfg)
+
+	if err != nil {
+		r.Log.Error(err, "Error creating engine configuration!", "claim", claim, "hookConfig", hookCfg)
+		return nil, nil, err
+	}
+
+	// Engines which render inside of the controller may not need a config map.
+	if cm != nil {
 		err = r.createConfigMap(ctx, cm)
 		if err != nil {
 			r.Log.Error(err, "Error creating config map!", "claim", claim, "hookConfig", hookCfg)
+			return nil, nil, err
+		}
+	}
+
+	return engineRunner, cm, nil
+}
+
+// pruneHook deletes the objects which a hook applied the last time that it ran, but didn't apply this time.
+// Objects are only pruned once the hook has succeeded. Until then, the inventory from the hook's previous run
+// is carried over, so that it isn't forgotten while the hook is running. Delete hooks delete what they render,
+// so nothing is pruned for them. Objects are pruned with the client which the hook applied them with.
+func (r *RenderPhaseReconciler) pruneHook(
+	ctx context.Context,
+	kube client.Client,
+	claim *unstructured.Unstructured,
+	event v1alpha1.EventName,
+	index int,
+	previous []v1alpha1.HookStatus,
+	hs *v1alpha1.HookStatus,
+) error {
+	var inventory []corev1.ObjectReference
+	for _, p := range previous {
+		if p.Index == index {
+			inventory = p.Resources
+		}
+	}
+
+	if hs.Resources == nil {
+		hs.Resources = inventory
+		return nil
+	}
+
+	if event == v1alpha1.EventDelete || hs.Phase != v1alpha1.HookPhaseSucceeded {
+		return nil
+	}
+
+	return engines.Prune(ctx, kube, claim, index, inventory, hs.Resources)
+}
+
+// deleteStaleJobs deletes the jobs for a claim which are not running or planning any of the claim's current
+// hooks, for example because they were run for an older generation of the claim.
+func (r *RenderPhaseReconciler) deleteStaleJobs(
+	ctx context.Context, claim *unstructured.Unstructured, status *v1alpha1.ClaimStatus,
+) error {
+	current := map[string]bool{}
+	for _, hs := range status.Hooks {
+		current[hs.JobName] = true
+	}
+	if status.Plan != nil {
+		for _, hp := range status.Plan.Hooks {
+			current[hp.JobName] = true
+		}
+	}
+
+	return deleteJobsExcept(ctx, r.Client, r.Log, claim, current)
+}
+
+// deleteJobsExcept deletes the render jobs for a claim, and their inventories, except for the jobs with the
+// given names. The engine configurations and source copies which only the deleted jobs used go with them.
+func deleteJobsExcept(
+	ctx context.Context, kube client.Client, log logr.Logger, claim *unstructured.Unstructured, keep map[string]bool,
+) error {
+	jobs := &batchv1.JobList{}
+	if err := kube.List(ctx, jobs,
+		client.InNamespace(claim.GetNamespace()),
+		client.MatchingLabels{engines.LabelClaimUID: string(claim.GetUID())},
+	); err != nil {
+		return err
+	}
+
+	// Config maps which the kept jobs mount are still in use, as are their inventories.
+	inUse := map[string]bool{}
+	listed := 0
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if !keep[job.GetName()] {
+			continue
+		}
+		listed++
+		inUse[job.GetName()] = true
+		for _, v := range job.Spec.Template.Spec.Volumes {
+			if v.ConfigMap != nil {
+				inUse[v.ConfigMap.Name] = true
+			}
+		}
+	}
+
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if keep[job.GetName()] {
+			continue
+		}
+
+		log.V(0).Info("Deleting stale job", "claim", claim, "job", job.GetName())
+
+		// The job's pods should go along with the job.
+		err := kube.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !kerrors.IsNotFound(err) {
 			return err
 		}
 
-		// TODO support specifying the image on the hook. We could start by just injecting the source image on the
-		// hook configuration, in the same way we do for engine type.
-		stackImage := cfg.Spec.Behaviors.Source.Image
+		// So should its inventory, which has the same name as the job.
+		inventory := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: job.GetNamespace(), Name: job.GetName()}}
+		if err := kube.Delete(ctx, inventory); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
 
-		result, err := engineRunner.RunEngine(ctx, r.Client, claim, cm, stackImage, &hookCfg)
-		// TODO check for errors
+	// Jobs are listed from a cache, which may not have seen a job which was just created yet. Until it has,
+	// we can't tell which config maps the job uses. Hooks which didn't run a job have no job name.
+	wanted := 0
+	for name := range keep {
+		if name != "" {
+			wanted++
+		}
+	}
+	if listed < wanted {
+		return nil
+	}
 
-		err = r.setClaimStatus(claim, result)
+	// Config maps are listed as unstructured objects, so that they are read from the api server rather than
+	// from a cache.
+	configMaps := &unstructured.UnstructuredList{}
+	configMaps.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMapList"))
+	if err := kube.List(ctx, configMaps,
+		client.InNamespace(claim.GetNamespace()),
+		client.MatchingLabels{engines.LabelClaimUID: string(claim.GetUID())},
+	); err != nil {
+		return err
 	}
 
-	return err
+	for i := range configMaps.Items {
+		cm := &configMaps.Items[i]
+		if inUse[cm.GetName()] {
+			continue
+		}
+
+		log.V(0).Info("Deleting unused config map", "claim", claim, "configMap", cm.GetName())
+		if err := kube.Delete(ctx, cm); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return engines.ReleaseSources(ctx, kube, claim, inUse)
 }
 
 // This mostly exists to encapsulate the logging and the ignoring of already exists errors
@@ -175,6 +569,13 @@ func (r *RenderPhaseReconciler) getStackConfiguration(
 	// See the template stacks internal design doc for details, but
 	// the most likely source of the stack configuration is the stack object itself.
 	// Other potential sources include a configmap
+	//
+	// The stack configuration is cached until it changes; see stackConfigCache.
+
+	cached, epoch := r.configCache.config()
+	if cached != nil {
+		return cached, nil
+	}
 
 	sc := &v1alpha1.StackConfiguration{}
 	if err := r.Client.Get(ctx, r.ConfigName, sc); err != nil {
@@ -183,24 +584,31 @@ func (r *RenderPhaseReconciler) getStackConfiguration(
 		return nil, err
 	}
 
+	// The setup phase refuses invalid configurations, but leaves the render controllers of the last valid
+	// one running, so they have to refuse to render from them too until they are fixed.
+	if err := sc.Validate(engines.Types(), engines.ReferenceTypes()); err != nil {
+		return nil, fmt.Errorf("stack configuration %s is invalid: %v", r.ConfigName, err)
+	}
+
+	r.configCache.setConfig(sc, epoch)
 	r.Log.V(0).Info("getStackConfiguration returning configuration", "configuration", sc)
 	return sc, nil
 }
 
 // When a behavior is triggered, we want to know which behavior exactly we are executing.
 //
-// In most cases, this will probably be configured ahead of time by the setup controller, rather
-// than being fetched at runtime by the render controller.
+// The hooks are resolved once for each event, and cached along with the stack configuration.
 func (r *RenderPhaseReconciler) getBehavior(
 	ctx context.Context,
 	claim *unstructured.Unstructured,
 	sc *v1alpha1.StackConfiguration,
+	event v1alpha1.EventName,
 ) ([]v1alpha1.HookConfiguration, error) {
-	gv, k := claim.GetObjectKind().GroupVersionKind().ToAPIVersionAndKind()
-	gvk := v1alpha1.GVK(fmt.Sprintf("%s.%s", k, gv))
+	gvk := claim.GetObjectKind().GroupVersionKind()
 
-	// TODO handle missing keys gracefully
-	scb, ok := sc.Spec.Behaviors.CRDs[gvk]
+	// Anything which isn't specified at the hook level is inherited from the CRD level, and then from the
+	// configuration level. This includes the engine and its images, and the stack source.
+	resolvedCfgs, ok := r.configCache.hooksFor(sc, gvk, event)
 
 	if !ok {
 		// TODO error condition with a real error returned
@@ -212,19 +620,7 @@ func (r *RenderPhaseReconciler) getBehavior(
 		return nil, nil
 	}
 
-	hooks := scb.Hooks
-
-	if len(hooks) == 0 {
-		// TODO error condition with a real error returned
-		// TODO it'd be nice to enforce this on acceptance or creation if possible
-		// TODO theoretically we should be able to enforce this at the schema level
-		r.Log.V(0).Info("Couldn't find hooks for configured behavior!", "claim", claim, "configuration", sc)
-		return nil, nil
-
-	}
-
-	hookCfgs := hooks[r.EventName]
-	if len(hookCfgs) == 0 {
+	if len(resolvedCfgs) == 0 {
 		// TODO error condition with a real error returned
 		// TODO it'd be nice to enforce this on acceptance or creation if possible
 		r.Log.V(0).Info("Couldn't find resources for configured behavior!", "claim", claim, "configuration", sc)
@@ -232,23 +628,11 @@ func (r *RenderPhaseReconciler) getBehavior(
 
 	}
 
-	// If a directory is not provided, we will use the root of the stack artifact. However, it is recommended to
-	// specify a directory for clarity.
-	resolvedCfgs := make([]v1alpha1.HookConfiguration, 0)
-	for _, cfg := range hookCfgs {
-		// If no engine is specified at the hook level, we want to use the engine specified at the CRD level.
-		// If no engine is specified at the hook *or* CRD level, we want to use the engine specified at the configuration level.
-		if cfg.Engine.Type == "" {
-			if scb.Engine.Type != "" {
-				r.Log.V(0).Info("Inheriting engine for hook from CRD-level behavior configuration", "engineType", scb.Engine.Type)
-				cfg.Engine.Type = scb.Engine.Type
-			} else {
-				r.Log.V(0).Info("Inheriting engine for hook from top-level behavior configuration", "engineType", sc.Spec.Behaviors.Engine.Type)
-				cfg.Engine.Type = sc.Spec.Behaviors.Engine.Type
-			}
+	if r.ResolveImageDigests {
+		if unpinned := pinImages(sc, resolvedCfgs); len(unpinned) > 0 {
+			r.Log.V(0).Info("Rendering from the tags of stack images whose digests haven't been resolved", "claim", claim,
+				"images", unpinned)
 		}
-
-		resolvedCfgs = append(resolvedCfgs, cfg)
 	}
 
 	r.Log.V(0).Info("Returning hook configurations", "hook configurations", resolvedCfgs)
@@ -256,12 +640,53 @@ func (r *RenderPhaseReconciler) getBehavior(
 	return resolvedCfgs, nil
 }
 
+// setClaimStatus writes the given status to the claim, after summarizing the status of the individual hooks.
 func (r *RenderPhaseReconciler) setClaimStatus(
-	claim *unstructured.Unstructured, result *unstructured.Unstructured,
+	ctx context.Context, claim *unstructured.Unstructured, status *v1alpha1.ClaimStatus,
 ) error {
 	// The claim is the CR that triggered this whole thing.
-	// The result is the result of trying to apply or delete the templates rendered from processing the claim.
-	// If the processing happens in a job, the status should be updated after the job completes, which may mean
-	// waiting for it to complete by using a watcher.
-	return nil
+	// The status has the results of trying to apply or delete the templates rendered from processing the claim.
+	// When the processing happens in a job, the render controller is notified as the job progresses, because
+	// the claim is the job's controller.
+	summarizeClaimStatus(status, meta.WasDeleted(claim))
+
+	// Writing the status triggers another reconcile, so it's only written if it has changed.
+	if equality.Semantic.DeepEqual(getClaimStatus(claim), status) {
+		return nil
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		r.Log.Error(err, "Error converting claim status!", "claim", claim, "status", status)
+		return err
+	}
+	claim.Object[claimStatus] = content
+
+	err = r.Client.Status().Update(ctx, claim)
+	if kerrors.IsNotFound(err) {
+		// Claim CRDs are written by stack authors, so the status subresource may not be enabled.
+		// In that case, the status is updated along with the rest of the object.
+		err = r.Client.Update(ctx, claim)
+	}
+
+	if err != nil {
+		r.Log.V(0).Info("Error updating claim status", "claim", claim, "err", err)
+	}
+
+	return err
+}
+
+// failRender records an error which prevented the hooks from running on the claim's status. The original error
+// is returned so that the claim is requeued.
+func (r *RenderPhaseReconciler) failRender(
+	ctx context.Context, claim *unstructured.Unstructured, status *v1alpha1.ClaimStatus, renderErr error,
+) error {
+	status.Message = renderErr.Error()
+	status.ObservedGeneration = claim.GetGeneration()
+
+	if err := r.setClaimStatus(ctx, claim, status); err != nil {
+		r.Log.Error(err, "Error recording render failure on claim status!", "claim", claim, "renderErr", renderErr)
+	}
+
+	return renderErr
 }
@@ -0,0 +1,119 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/suskin/stack-template-engine/engines"
+)
+
+func TestDeleteJobsExcept(t *testing.T) {
+	claim := rolloutClaim("claim", nil)
+	claim.SetUID("claim-uid")
+	labels := map[string]string{engines.LabelClaimUID: "claim-uid"}
+
+	// renderJob returns a job which mounts the given engine configuration, and its inventory.
+	renderJob := func(name, config string) []runtime.Object {
+		return []runtime.Object{
+			&batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels},
+				Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{{
+						Name: "engine-configuration",
+						VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: config},
+						}},
+					}},
+				}}},
+			},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels}},
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: config, Labels: labels}},
+		}
+	}
+
+	cases := map[string]struct {
+		keep           map[string]bool
+		wantJobs       []string
+		wantConfigMaps []string
+	}{
+		"StaleJob": {
+			keep:           map[string]bool{"current": true},
+			wantJobs:       []string{"current"},
+			wantConfigMaps: []string{"current", "current-config"},
+		},
+		"HookWithoutAJob": {
+			keep:           map[string]bool{"current": true, "": true},
+			wantJobs:       []string{"current"},
+			wantConfigMaps: []string{"current", "current-config"},
+		},
+		"JobNotCachedYet": {
+			// The new job's configuration can't be told apart from the stale job's, so neither is deleted.
+			keep:           map[string]bool{"current": true, "new": true},
+			wantJobs:       []string{"current"},
+			wantConfigMaps: []string{"current", "current-config", "stale-config"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			objs := append(renderJob("current", "current-config"), renderJob("stale", "stale-config")...)
+			kube := fake.NewFakeClientWithScheme(scheme.Scheme, objs...)
+
+			if err := deleteJobsExcept(context.Background(), kube, ctrl.Log, &claim, tc.keep); err != nil {
+				t.Fatalf("deleteJobsExcept(...): %v", err)
+			}
+
+			jobs := &batchv1.JobList{}
+			if err := kube.List(context.Background(), jobs, client.InNamespace("default")); err != nil {
+				t.Fatal(err)
+			}
+			gotJobs := make([]string, 0)
+			for _, j := range jobs.Items {
+				gotJobs = append(gotJobs, j.GetName())
+			}
+
+			configMaps := &corev1.ConfigMapList{}
+			if err := kube.List(context.Background(), configMaps, client.InNamespace("default")); err != nil {
+				t.Fatal(err)
+			}
+			gotConfigMaps := make([]string, 0)
+			for _, cm := range configMaps.Items {
+				gotConfigMaps = append(gotConfigMaps, cm.GetName())
+			}
+			sort.Strings(gotConfigMaps)
+
+			if !reflect.DeepEqual(gotJobs, tc.wantJobs) {
+				t.Errorf("deleteJobsExcept(...): left jobs %q, want %q", gotJobs, tc.wantJobs)
+			}
+			if !reflect.DeepEqual(gotConfigMaps, tc.wantConfigMaps) {
+				t.Errorf("deleteJobsExcept(...): left config maps %q, want %q", gotConfigMaps, tc.wantConfigMaps)
+			}
+		})
+	}
+}
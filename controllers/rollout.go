@@ -0,0 +1,140 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// When a claim's behavior changes, the claims which were rendered before the change are rendered again, as
+// quickly as the stack configuration's rollout strategy allows. Each claim records the revision of the
+// behavior which its hooks were last run with, so the progress of a rollout is worked out from the claims
+// themselves whenever an out of date claim is reconciled:
+// - Claims which have the current revision, and have been rendered, are available
+// - Claims which have the current revision, but are still rendering or have failed, are unavailable
+// - Claims with any other revision are out of date, and wait until the strategy lets them through
+//
+// Claims which are waiting are checked again periodically. Claims which have never been rendered aren't
+// held back, and neither are claims which are being deleted.
+
+const (
+	rolloutRetryInterval = 10 * time.Second
+
+	revisionHashLength = 10
+)
+
+// stackRevision returns the revision of a stack configuration's behavior for a GVK. The revision is a hash
+// of the hooks for every event, resolved in the same way as they are when the claim is rendered, and of the
+// digests which the stack's images were resolved to.
+func stackRevision(sc *v1alpha1.StackConfiguration, gvk schema.GroupVersionKind) (string, error) {
+	hooks := map[v1alpha1.EventName][]v1alpha1.HookConfiguration{}
+	images := map[string]string{}
+	for _, event := range v1alpha1.EventNames {
+		hooks[event], _ = sc.HooksFor(gvk, event)
+
+		// The time that an image was resolved doesn't matter, only what it was resolved to.
+		for _, hc := range hooks[event] {
+			if id, ok := sc.Status.ImageDigest(hc.Source.Image); ok {
+				images[id.Image] = id.Digest
+			}
+		}
+	}
+
+	data, err := json.Marshal(struct {
+		Hooks  map[v1alpha1.EventName][]v1alpha1.HookConfiguration `json:"hooks"`
+		Images map[string]string                                   `json:"images,omitempty"`
+	}{hooks, images})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:revisionHashLength], nil
+}
+
+// waitForRollout returns true if the claim is out of date, and the stack configuration's rollout strategy
+// doesn't let it be rendered with the current revision yet. If the stack configuration can't be read, the
+// claim isn't held back, so that rendering it reports the problem.
+func (r *RenderPhaseReconciler) waitForRollout(ctx context.Context, claim *unstructured.Unstructured) (bool, error) {
+	sc, err := r.getStackConfiguration(ctx, claim)
+	if err != nil {
+		return false, nil
+	}
+
+	strategy := sc.Spec.Rollout
+	if strategy.Type == "" || strategy.Type == v1alpha1.RolloutAllAtOnce {
+		return false, nil
+	}
+
+	revision, err := r.configCache.revisionFor(sc, *r.GVK)
+	if err != nil {
+		return false, err
+	}
+
+	status := getClaimStatus(claim)
+	if status.StackRevision == revision || (len(status.Hooks) == 0 && status.LastRenderTime == nil) {
+		return false, nil
+	}
+
+	// Unstructured lists are read from the api server rather than from a cache, so claims which were let
+	// through by the previous reconcile are counted.
+	claims := &unstructured.UnstructuredList{}
+	claims.SetGroupVersionKind(r.GVK.GroupVersion().WithKind(r.GVK.Kind + "List"))
+	if err := r.Client.List(ctx, claims); err != nil {
+		return false, err
+	}
+
+	updated, unavailable := 0, 0
+	for i := range claims.Items {
+		s := getClaimStatus(&claims.Items[i])
+		if s.StackRevision != revision {
+			continue
+		}
+		updated++
+		if s.Phase != v1alpha1.ClaimPhaseRendered {
+			unavailable++
+		}
+	}
+
+	// Validation requires both sizes to be positive, but a size which isn't must never stop the render
+	// controller, so the smallest useful size is used instead.
+	switch strategy.Type {
+	case v1alpha1.RolloutBatches:
+		batchSize := strategy.BatchSize
+		if batchSize <= 0 {
+			batchSize = 1
+		}
+		// The current batch is full once the number of updated claims is a multiple of the batch size, and
+		// the next one can't start until all of them are available.
+		return updated%batchSize == 0 && unavailable > 0, nil
+	case v1alpha1.RolloutMaxUnavailable:
+		maxUnavailable := strategy.MaxUnavailable
+		if maxUnavailable <= 0 {
+			maxUnavailable = 1
+		}
+		return unavailable >= maxUnavailable, nil
+	default:
+		return false, fmt.Errorf("unknown rollout strategy %q", strategy.Type)
+	}
+}
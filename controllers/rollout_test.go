@@ -0,0 +1,285 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+	"github.com/suskin/stack-template-engine/engines"
+)
+
+var widgetGVK = schema.GroupVersionKind{Group: "example.org", Version: "v1alpha1", Kind: "Widget"}
+
+// rolloutClient serves a stack configuration and a list of claims, which is all that waitForRollout reads.
+type rolloutClient struct {
+	client.Client
+
+	sc     *v1alpha1.StackConfiguration
+	claims []unstructured.Unstructured
+}
+
+func (c *rolloutClient) Get(_ context.Context, _ client.ObjectKey, obj runtime.Object) error {
+	c.sc.DeepCopyInto(obj.(*v1alpha1.StackConfiguration))
+	return nil
+}
+
+func (c *rolloutClient) List(_ context.Context, list runtime.Object, _ ...client.ListOption) error {
+	list.(*unstructured.UnstructuredList).Items = c.claims
+	return nil
+}
+
+func rolloutConfig(strategy v1alpha1.RolloutStrategy, directory string) *v1alpha1.StackConfiguration {
+	return &v1alpha1.StackConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "widgets"},
+		Spec: v1alpha1.StackConfigurationSpec{
+			Rollout: strategy,
+			Behaviors: v1alpha1.StackConfigurationBehaviors{
+				Engine: v1alpha1.ResourceEngineConfiguration{Type: engines.Helm3EngineType},
+				Source: v1alpha1.StackConfigurationSource{Image: "example.org/widget-stack:v1"},
+				Resources: []v1alpha1.ResourceBehavior{{
+					Selector: v1alpha1.GVKSelector{Group: widgetGVK.Group, Kind: widgetGVK.Kind},
+					StackConfigurationBehavior: v1alpha1.StackConfigurationBehavior{
+						Hooks: map[v1alpha1.EventName]v1alpha1.HookConfigurations{
+							v1alpha1.EventReconcile: {{Directory: directory}},
+						},
+					},
+				}},
+			},
+		},
+	}
+}
+
+func rolloutClaim(name string, status *v1alpha1.ClaimStatus) unstructured.Unstructured {
+	claim := unstructured.Unstructured{}
+	claim.SetGroupVersionKind(widgetGVK)
+	claim.SetNamespace("default")
+	claim.SetName(name)
+	if status != nil {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+		if err != nil {
+			panic(err)
+		}
+		claim.Object[claimStatus] = content
+	}
+	return claim
+}
+
+func TestStackRevision(t *testing.T) {
+	base := rolloutConfig(v1alpha1.RolloutStrategy{}, "widget")
+	resolved := base.DeepCopy()
+	resolved.Status.Images = []v1alpha1.ImageDigest{{
+		Image:      "example.org/widget-stack:v1",
+		Digest:     "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		ResolvedAt: metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}}
+
+	cases := map[string]struct {
+		change func(sc *v1alpha1.StackConfiguration)
+		same   bool
+	}{
+		"Unchanged": {
+			change: func(sc *v1alpha1.StackConfiguration) {},
+			same:   true,
+		},
+		"HookDirectoryChanged": {
+			change: func(sc *v1alpha1.StackConfiguration) {
+				sc.Spec.Behaviors.Resources[0].Hooks[v1alpha1.EventReconcile][0].Directory = "other"
+			},
+		},
+		"InheritedEngineChanged": {
+			change: func(sc *v1alpha1.StackConfiguration) { sc.Spec.Behaviors.Engine.Image = "example.org/helm:v2" },
+		},
+		"ImageResolvedAgainToTheSameDigest": {
+			change: func(sc *v1alpha1.StackConfiguration) {
+				sc.Status.Images[0].ResolvedAt = metav1.NewTime(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC))
+			},
+			same: true,
+		},
+		"ImageMovedToANewDigest": {
+			change: func(sc *v1alpha1.StackConfiguration) {
+				sc.Status.Images[0].Digest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+			},
+		},
+		"RolloutStrategyChanged": {
+			change: func(sc *v1alpha1.StackConfiguration) {
+				sc.Spec.Rollout = v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutBatches, BatchSize: 2}
+			},
+			same: true,
+		},
+		"OtherKindChanged": {
+			change: func(sc *v1alpha1.StackConfiguration) {
+				sc.Spec.Behaviors.Resources = append(sc.Spec.Behaviors.Resources, v1alpha1.ResourceBehavior{
+					Selector: v1alpha1.GVKSelector{Group: "example.org", Kind: "Gadget"},
+					StackConfigurationBehavior: v1alpha1.StackConfigurationBehavior{
+						Hooks: map[v1alpha1.EventName]v1alpha1.HookConfigurations{
+							v1alpha1.EventReconcile: {{Directory: "gadget"}},
+						},
+					},
+				})
+			},
+			same: true,
+		},
+	}
+
+	want, err := stackRevision(resolved, widgetGVK)
+	if err != nil {
+		t.Fatalf("stackRevision(...): %v", err)
+	}
+	if len(want) != revisionHashLength {
+		t.Errorf("stackRevision(...): got %q, want %d characters", want, revisionHashLength)
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sc := resolved.DeepCopy()
+			tc.change(sc)
+
+			got, err := stackRevision(sc, widgetGVK)
+			if err != nil {
+				t.Fatalf("stackRevision(...): %v", err)
+			}
+			if (got == want) != tc.same {
+				t.Errorf("stackRevision(...): got %q, base revision %q, want same: %t", got, want, tc.same)
+			}
+		})
+	}
+}
+
+func TestWaitForRollout(t *testing.T) {
+	current, err := stackRevision(rolloutConfig(v1alpha1.RolloutStrategy{}, "widget"), widgetGVK)
+	if err != nil {
+		t.Fatalf("stackRevision(...): %v", err)
+	}
+
+	rendered := func(revision string) *v1alpha1.ClaimStatus {
+		now := metav1.Now()
+		return &v1alpha1.ClaimStatus{Phase: v1alpha1.ClaimPhaseRendered, StackRevision: revision, LastRenderTime: &now}
+	}
+	rendering := func(revision string) *v1alpha1.ClaimStatus {
+		s := rendered(revision)
+		s.Phase = v1alpha1.ClaimPhaseRendering
+		return s
+	}
+
+	cases := map[string]struct {
+		strategy v1alpha1.RolloutStrategy
+		claim    *v1alpha1.ClaimStatus
+		others   []*v1alpha1.ClaimStatus
+
+		// cached skips validation, as if the configuration had been cached before it became invalid.
+		cached bool
+
+		want bool
+	}{
+		"AllAtOnce": {
+			claim:  rendered("old"),
+			others: []*v1alpha1.ClaimStatus{rendering(current)},
+		},
+		"NewClaim": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutBatches, BatchSize: 1},
+			others:   []*v1alpha1.ClaimStatus{rendering(current)},
+		},
+		"UpToDateClaim": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutBatches, BatchSize: 1},
+			claim:    rendering(current),
+		},
+		"BatchHasRoom": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutBatches, BatchSize: 2},
+			claim:    rendered("old"),
+			others:   []*v1alpha1.ClaimStatus{rendering(current)},
+		},
+		"BatchIsFull": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutBatches, BatchSize: 2},
+			claim:    rendered("old"),
+			others:   []*v1alpha1.ClaimStatus{rendered(current), rendering(current)},
+			want:     true,
+		},
+		"BatchIsAvailable": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutBatches, BatchSize: 2},
+			claim:    rendered("old"),
+			others:   []*v1alpha1.ClaimStatus{rendered(current), rendered(current)},
+		},
+		"ZeroBatchSize": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutBatches},
+			claim:    rendered("old"),
+			others:   []*v1alpha1.ClaimStatus{rendering(current)},
+			cached:   true,
+			want:     true,
+		},
+		"UnderMaxUnavailable": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutMaxUnavailable, MaxUnavailable: 2},
+			claim:    rendered("old"),
+			others:   []*v1alpha1.ClaimStatus{rendering(current), rendered(current)},
+		},
+		"AtMaxUnavailable": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutMaxUnavailable, MaxUnavailable: 2},
+			claim:    rendered("old"),
+			others:   []*v1alpha1.ClaimStatus{rendering(current), rendering(current), rendering("old")},
+			want:     true,
+		},
+		"ZeroMaxUnavailable": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutMaxUnavailable},
+			claim:    rendered("old"),
+			cached:   true,
+		},
+		"InvalidConfiguration": {
+			strategy: v1alpha1.RolloutStrategy{Type: v1alpha1.RolloutBatches},
+			claim:    rendered("old"),
+			others:   []*v1alpha1.ClaimStatus{rendering(current)},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sc := rolloutConfig(tc.strategy, "widget")
+
+			claim := rolloutClaim("claim", tc.claim)
+			claims := []unstructured.Unstructured{claim}
+			for i, s := range tc.others {
+				claims = append(claims, rolloutClaim(string(rune('a'+i)), s))
+			}
+
+			gvk := widgetGVK
+			r := &RenderPhaseReconciler{
+				Client:     &rolloutClient{sc: sc, claims: claims},
+				Log:        ctrl.Log,
+				GVK:        &gvk,
+				ConfigName: client.ObjectKey{Namespace: sc.GetNamespace(), Name: sc.GetName()},
+			}
+			if tc.cached {
+				r.configCache.setConfig(sc, 0)
+			}
+
+			got, err := r.waitForRollout(context.Background(), &claim)
+			if err != nil {
+				t.Fatalf("waitForRollout(...): %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("waitForRollout(...): got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
@@ -18,20 +18,24 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
 	"github.com/go-logr/logr"
-	batchv1 "k8s.io/api/batch/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kmeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/version"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	v1alpha1 "github.com/suskin/stack-template-engine/api/v1alpha1"
+	"github.com/suskin/stack-template-engine/engines"
 )
 
 // StackConfigurationReconciler reconciles a StackConfiguration object
@@ -39,15 +43,42 @@ type SetupPhaseReconciler struct {
 	Client  client.Client
 	Log     logr.Logger
 	Manager manager.Manager
+
+	// RegistryRoot and Images are passed along to the render controllers.
+	RegistryRoot string
+	Images       engines.ImageOptions
+
+	// ResolveImageDigests makes the stack images of render jobs refer to digests rather than tags. It is
+	// passed along to the render controllers as well.
+	ResolveImageDigests bool
+
+	// PermissionsRole is the cluster role whose rules are all that a stack's permissions can be granted.
+	PermissionsRole string
+
+	// renderControllers are the render controllers which have been started, by the kind which they
+	// render. A kind is only rendered at one version, so that two controllers never reconcile the same
+	// claims.
+	renderControllers   map[schema.GroupKind]*renderController
+	renderControllersMu sync.Mutex
+
+	// unreleasedGVKs are the GVKs whose render controllers have been stopped, but whose claims may still
+	// have the render finalizer.
+	unreleasedGVKs map[schema.GroupVersionKind]bool
 }
 
 type Behavior struct {
-	cfg *v1alpha1.StackConfigurationBehavior
-	gvk *schema.GroupVersionKind
+	// key identifies the behavior in the stack configuration's status.
+	key      string
+	cfg      *v1alpha1.StackConfigurationBehavior
+	selector *v1alpha1.GVKSelector
+
+	// err is why the behavior can't be set up, if it can't be.
+	err error
 }
 
 const (
-	setupTimeout = 60 * time.Second
+	setupTimeout       = 60 * time.Second
+	setupRetryInterval = 30 * time.Second
 )
 
 // +kubebuilder:rbac:groups=helm.samples.stacks.crossplane.io,resources=stackconfigurations,verbs=get;list;watch;create;update;patch;delete
@@ -60,52 +91,166 @@ func (r *SetupPhaseReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 	i := &v1alpha1.StackConfiguration{}
 	if err := r.Client.Get(ctx, req.NamespacedName, i); err != nil {
 		if kerrors.IsNotFound(err) {
-			return ctrl.Result{}, nil
+			// The stack configuration is gone, so nothing should be rendering with it anymore.
+			if err := r.stopRenderControllers(ctx, req.NamespacedName, nil); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, r.deletePermissions(ctx, req.NamespacedName)
 		}
 		return ctrl.Result{}, err
 	}
 
-	r.Log.V(0).Info("Hello World!", "instanceName", req.NamespacedName, "instance", i)
+	r.Log.V(1).Info("Reconciling stack configuration", "stackConfiguration", req.NamespacedName)
+
+	if meta.WasDeleted(i) {
+		return ctrl.Result{}, r.stopRenderControllers(ctx, req.NamespacedName, nil)
+	}
 
-	return ctrl.Result{}, r.setup(i)
+	return r.setup(ctx, i)
 }
 
-func (r *SetupPhaseReconciler) setup(sc *v1alpha1.StackConfiguration) error {
+func (r *SetupPhaseReconciler) setup(ctx context.Context, sc *v1alpha1.StackConfiguration) (ctrl.Result, error) {
 	// For each behavior:
 	// - Grab the configuration values:
 	//   * Source stack; image or url
 	//   * Source GVK
-	//   * Event type
 	//   * The coordinates of the behavior in the configuration, so it can be found again. Or,
 	//     the behavior itself
-	// - Create a render controller, passing it the configuration values
+	// - Create a render controller, passing it the configuration values. A single render controller
+	//   handles every event for a GVK, and decides which hooks to run when a claim is reconciled.
 
 	// Questions
 	// Should we grab all of the configuration at setup time, or at render time?
 	// - At render time, so that we're always using the latest version of the object
 	// - Though, the ideal would be if we cached the configuration and changed it if it changed
 
+	if err := sc.Validate(engines.Types(), engines.ReferenceTypes()); err != nil {
+		// Retrying won't help until the configuration is changed, which will trigger another reconcile.
+		// The render controllers are left running, so that claims can still be released if the CRDs or the
+		// configuration are deleted, but they won't render anything from the invalid configuration.
+		r.Log.Error(err, "Refusing to set up invalid stack configuration!", "stackConfiguration", sc)
+		sc.Status.SetConditions(runtimev1alpha1.Unavailable().WithMessage(err.Error()), runtimev1alpha1.ReconcileError(err))
+		return ctrl.Result{}, r.setStatus(ctx, sc)
+	}
+
+	// The stack's roles are applied before anything renders with them. If the stack asks for more than it can
+	// be granted, its roles are left as they were, so the render controllers keep the permissions which were
+	// last allowed.
+	denied, err := r.applyRoles(ctx, sc)
+	if err != nil {
+		r.Log.Error(err, "Error applying the stack's roles!", "stackConfiguration", sc)
+		return ctrl.Result{}, err
+	}
+	if len(denied) > 0 {
+		err := fmt.Errorf("the stack's permissions aren't allowed by the %q cluster role: %s", r.PermissionsRole, strings.Join(denied, ", "))
+		r.Log.Error(err, "Refusing to grant the stack's permissions!", "stackConfiguration", sc)
+		sc.Status.SetConditions(runtimev1alpha1.Unavailable().WithMessage(err.Error()), runtimev1alpha1.ReconcileError(err))
+
+		// Nothing triggers a reconcile when the allowed rules change, so we check back periodically.
+		return ctrl.Result{RequeueAfter: setupRetryInterval}, r.setStatus(ctx, sc)
+	}
+
+	var resolveErr error
+	var pollAfter time.Duration
+	if r.ResolveImageDigests {
+		pollAfter, resolveErr = r.resolveImageDigests(ctx, sc)
+	}
+
 	behaviors := r.getBehaviors(sc)
 	configName, err := client.ObjectKeyFromObject(sc)
 
 	if err != nil {
 		r.Log.V(0).Info("setup exiting early because of error getting stack config object key", "err", err, "stackConfiguration", sc)
-		return err
+		return ctrl.Result{}, err
 	}
 
-	for _, b := range behaviors {
-		gvk := b.gvk
-		// TODO it'd be great to create the CRD for the user if it doesn't exist yet - /ht @muvaf for this idea
+	previous := make(map[string]v1alpha1.BehaviorStatus, len(sc.Status.Behaviors))
+	for _, bs := range sc.Status.Behaviors {
+		previous[bs.Selector] = bs
+	}
 
-		// TODO we don't want to be hard-coding the event name here.
-		event := v1alpha1.EventName("reconcile")
+	statuses := make([]v1alpha1.BehaviorStatus, 0, len(behaviors))
+	kinds := make(map[schema.GroupKind]bool, len(behaviors))
+	failed := 0
 
-		if err := r.NewRenderController(gvk, event, configName); err != nil {
-			// TODO what do we want to do if some of the registrations succeed and some of them fail?
-			r.Log.Error(err, "Error creating new render controller!", "gvk", gvk)
+	for _, b := range behaviors {
+		// Starting from the previous status keeps the transition times of conditions which haven't changed.
+		bs := previous[b.key]
+		bs.Selector = b.key
+		bs.Events = behaviorEvents(b.cfg)
+		bs.Versions = nil
+
+		err := b.err
+		if err == nil {
+			bs.Group, bs.Kind = b.selector.Group, b.selector.Kind
+			// TODO it'd be great to create the CRD for the user if it doesn't exist yet - /ht @muvaf for this idea
+
+			var gvk schema.GroupVersionKind
+			gvk, err = r.selectGVK(b.selector)
+			if err == nil {
+				err = r.NewRenderController(&gvk, configName)
+			}
+			if err == nil {
+				kinds[gvk.GroupKind()] = true
+				bs.Versions = []string{gvk.Version}
+			}
 		}
+
+		if err != nil {
+			r.Log.Error(err, "Error creating new render controller!", "gvk", b.key)
+			failed++
+			bs.Active = false
+			bs.SetConditions(runtimev1alpha1.Unavailable().WithMessage(err.Error()), runtimev1alpha1.ReconcileError(err))
+		} else {
+			bs.Active = true
+			bs.SetConditions(runtimev1alpha1.Available(), runtimev1alpha1.ReconcileSuccess())
+		}
+
+		statuses = append(statuses, bs)
+	}
+
+	// Anything which was removed from the configuration shouldn't be rendered anymore.
+	releaseErr := r.stopRenderControllers(ctx, configName, kinds)
+	if releaseErr != nil {
+		r.Log.Error(releaseErr, "Error releasing the claims of stopped render controllers!", "stackConfiguration", sc)
+	}
+
+	sc.Status.Behaviors = statuses
+	// Tags are resolved again when the next one is due.
+	result := ctrl.Result{RequeueAfter: pollAfter}
+	switch {
+	case failed > 0:
+		err := fmt.Errorf("%d of %d behaviors could not be set up", failed, len(behaviors))
+		sc.Status.SetConditions(runtimev1alpha1.Unavailable().WithMessage(err.Error()), runtimev1alpha1.ReconcileError(err))
+
+		// Nothing triggers a reconcile when a missing CRD is installed, so we check back periodically.
+		result.RequeueAfter = setupRetryInterval
+	case resolveErr != nil:
+		// Claims are still rendered, from the tags of the images which couldn't be resolved, so the stack
+		// configuration is available.
+		err := fmt.Errorf("the digests of the stack's images could not be resolved, so they are rendered from their tags: %v", resolveErr)
+		sc.Status.SetConditions(runtimev1alpha1.Available(), runtimev1alpha1.ReconcileError(err))
+
+		// Registries can be unavailable for a while, so we check back periodically as well.
+		result.RequeueAfter = setupRetryInterval
+	default:
+		sc.Status.SetConditions(runtimev1alpha1.Available(), runtimev1alpha1.ReconcileSuccess())
 	}
 
+	// Releasing the claims is retried until it works, so that none of them are stuck.
+	if releaseErr != nil {
+		result.RequeueAfter = setupRetryInterval
+	}
+
+	return result, r.setStatus(ctx, sc)
+}
+
+// setStatus writes the status of the stack configuration.
+func (r *SetupPhaseReconciler) setStatus(ctx context.Context, sc *v1alpha1.StackConfiguration) error {
+	if err := r.Client.Status().Update(ctx, sc); err != nil {
+		r.Log.V(0).Info("Error updating stack configuration status", "stackConfiguration", sc, "err", err)
+		return err
+	}
 	return nil
 }
 
@@ -113,55 +258,91 @@ func (r *SetupPhaseReconciler) setup(sc *v1alpha1.StackConfiguration) error {
 // For example, the engine may be configured at multiple levels. Another example is that
 // behaviors may be configured at multiple levels, if there are stack-level behaviors in
 // addition to object-level behaviors.
+//
+// The behaviors are returned in the order that they are matched in. Legacy behaviors whose
+// GVK can't be parsed are returned with an error, so that they can be reported.
 func (r *SetupPhaseReconciler) getBehaviors(sc *v1alpha1.StackConfiguration) []Behavior {
-	scbs := sc.Spec.Behaviors.CRDs
-
 	behaviors := make([]Behavior, 0)
 
-	for rawGvk, scb := range scbs {
-		// We are assuming strings look like "Kind.group.com/version"
-		gvkSplit := strings.SplitN(string(rawGvk), ".", 2)
-		gvk := schema.FromAPIVersionAndKind(gvkSplit[1], gvkSplit[0])
-
+	for i := range sc.Spec.Behaviors.Resources {
+		rb := &sc.Spec.Behaviors.Resources[i]
 		behaviors = append(behaviors, Behavior{
-			gvk: &gvk,
-			cfg: &scb,
+			key:      rb.Selector.String(),
+			cfg:      &rb.StackConfigurationBehavior,
+			selector: &rb.Selector,
 		})
 	}
 
-	return behaviors
-}
-
-func (r *SetupPhaseReconciler) NewRenderController(gvk *schema.GroupVersionKind, event v1alpha1.EventName, configName types.NamespacedName) error {
-	// TODO
-	// - In the future, we may want to be able to stop listening when a stack is uninstalled.
-	// - What if we have multiple controller workers watching the stack configuration? Do we need to worry about trying to not
-	//   create multiple render controllers for a single gvk?
+	legacy := make([]Behavior, 0, len(sc.Spec.Behaviors.CRDs))
+	for rawGvk, scb := range sc.Spec.Behaviors.CRDs {
+		scb := scb
+		b := Behavior{
+			key: string(rawGvk),
+			cfg: &scb,
+		}
 
-	apiType := &unstructured.Unstructured{}
-	apiType.SetGroupVersionKind(*gvk)
+		selector, err := rawGvk.Selector()
+		if err != nil {
+			b.err = err
+		} else {
+			b.selector = &selector
+		}
 
-	reconciler := &RenderPhaseReconciler{
-		Client:     r.Manager.GetClient(),
-		Log:        ctrl.Log.WithName("controllers").WithName(fmt.Sprintf("%s.%s/%s", gvk.Kind, gvk.Group, gvk.Version)),
-		GVK:        gvk,
-		EventName:  event,
-		ConfigName: configName,
+		legacy = append(legacy, b)
 	}
 
-	r.Log.V(0).Info("Adding new controller to manager")
+	sort.Slice(legacy, func(i, j int) bool { return legacy[i].key < legacy[j].key })
 
-	err := ctrl.NewControllerManagedBy(r.Manager).
-		For(apiType).
-		Owns(&batchv1.Job{}).
-		Complete(reconciler)
+	return append(behaviors, legacy...)
+}
 
+// selectGVK returns the GVK which a selector's claims are rendered at, which is the highest installed
+// version of its kind that it matches. Every version of a kind serves the same claims, so rendering more
+// than one of them would have several controllers fighting over each claim. An error is returned if the
+// selector's kind isn't installed, or none of its installed versions match.
+func (r *SetupPhaseReconciler) selectGVK(selector *v1alpha1.GVKSelector) (schema.GroupVersionKind, error) {
+	mappings, err := r.Manager.GetRESTMapper().RESTMappings(selector.GroupKind())
 	if err != nil {
-		r.Log.V(0).Info("unable to create controller", "gvk", gvk, "err", err)
-		return err
+		if kmeta.IsNoMatchError(err) {
+			return schema.GroupVersionKind{}, fmt.Errorf("the CRD for %s is not installed", selector)
+		}
+		return schema.GroupVersionKind{}, err
 	}
 
-	return nil
+	return highestMatchingVersion(selector, mappings)
+}
+
+// highestMatchingVersion returns the GVK of the highest version of the given mappings which the selector
+// matches.
+func highestMatchingVersion(selector *v1alpha1.GVKSelector, mappings []*kmeta.RESTMapping) (schema.GroupVersionKind, error) {
+	var selected *schema.GroupVersionKind
+	for _, m := range mappings {
+		gvk := m.GroupVersionKind
+		if !selector.Matches(gvk) {
+			continue
+		}
+		if selected == nil || version.CompareKubeAwareVersionStrings(gvk.Version, selected.Version) > 0 {
+			selected = &gvk
+		}
+	}
+
+	if selected == nil {
+		return schema.GroupVersionKind{}, fmt.Errorf("none of the installed versions of %s match", selector)
+	}
+
+	return *selected, nil
+}
+
+// behaviorEvents returns the events which a behavior has hooks for, in the order that they are
+// listed in EventNames.
+func behaviorEvents(scb *v1alpha1.StackConfigurationBehavior) []v1alpha1.EventName {
+	events := make([]v1alpha1.EventName, 0, len(scb.Hooks))
+	for _, event := range v1alpha1.EventNames {
+		if _, ok := scb.Hooks[event]; ok {
+			events = append(events, event)
+		}
+	}
+	return events
 }
 
 func (r *SetupPhaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
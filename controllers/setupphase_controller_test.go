@@ -0,0 +1,75 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	kmeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+func TestHighestMatchingVersion(t *testing.T) {
+	// Discovery lists the preferred version first, which isn't necessarily the highest one.
+	mappings := make([]*kmeta.RESTMapping, 0)
+	for _, v := range []string{"v1beta1", "v1alpha1", "v1", "v2alpha1"} {
+		mappings = append(mappings, &kmeta.RESTMapping{GroupVersionKind: widgetGVK.GroupKind().WithVersion(v)})
+	}
+
+	cases := map[string]struct {
+		selector v1alpha1.GVKSelector
+		want     string
+		wantErr  bool
+	}{
+		"AnyVersion": {
+			selector: v1alpha1.GVKSelector{Group: "example.org", Kind: "Widget"},
+			want:     "v1",
+		},
+		"ListedVersions": {
+			selector: v1alpha1.GVKSelector{Group: "example.org", Kind: "Widget", Versions: []string{"v1alpha1", "v1beta1"}},
+			want:     "v1beta1",
+		},
+		"MaxVersion": {
+			selector: v1alpha1.GVKSelector{Group: "example.org", Kind: "Widget", MaxVersion: "v1beta1"},
+			want:     "v1beta1",
+		},
+		"AlphaVersionsOnly": {
+			selector: v1alpha1.GVKSelector{Group: "example.org", Kind: "Widget", MaxVersion: "v2alpha1"},
+			want:     "v2alpha1",
+		},
+		"NoMatch": {
+			selector: v1alpha1.GVKSelector{Group: "example.org", Kind: "Widget", Versions: []string{"v3"}},
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := highestMatchingVersion(&tc.selector, mappings)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("highestMatchingVersion(...): got error %v, want error: %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if want := (schema.GroupVersionKind{Group: "example.org", Version: tc.want, Kind: "Widget"}); got != want {
+				t.Errorf("highestMatchingVersion(...): got %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The tag of a stack image is resolved to a digest by asking the image's registry for the tag's manifest,
+// with the docker registry HTTP API. The digest is the one which the registry reports for the manifest, so
+// it is the same digest that the image would be pulled by. Registries which require a bearer token are
+// asked for an anonymous one, so only public images can be resolved. Private images can be pinned to a
+// digest in the stack configuration instead.
+
+const (
+	// Images without a registry are on docker hub, which serves the registry API from this host.
+	dockerHubRegistry = "registry-1.docker.io"
+
+	manifestDigestHeader = "Docker-Content-Digest"
+)
+
+// manifestMediaTypes are the types of manifests which are accepted for a tag. Lists and indexes are accepted,
+// so that the digest of a multi-platform image is the digest of the whole image, as it is when it's pulled.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+var (
+	manifestDigest  = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+	challengeParams = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// imageReference is an image which is referred to by a tag, or which is already pinned to a digest.
+type imageReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseImageReference splits an image into its registry, repository, tag and digest, with the same defaults
+// as docker: images without a registry are on docker hub, and images without a tag or a digest are tagged
+// latest.
+func parseImageReference(image string) imageReference {
+	ref := imageReference{registry: dockerHubRegistry, repository: image, tag: "latest"}
+
+	// A digest comes after everything else, and may follow a tag.
+	if i := strings.Index(image, "@"); i >= 0 {
+		image, ref.digest = image[:i], image[i+1:]
+		ref.repository, ref.tag = image, ""
+	}
+
+	// The first component of the image is the registry if it looks like a host name.
+	if i := strings.Index(image, "/"); i > 0 {
+		host := image[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.registry, ref.repository = host, image[i+1:]
+		}
+	}
+	switch ref.registry {
+	case "docker.io", "index.docker.io":
+		ref.registry = dockerHubRegistry
+	}
+
+	// A colon after the last slash starts the tag; one before it is a registry's port.
+	if i := strings.LastIndex(ref.repository, ":"); i > strings.LastIndex(ref.repository, "/") {
+		ref.repository, ref.tag = ref.repository[:i], ref.repository[i+1:]
+	}
+
+	// Official images on docker hub are in the library namespace.
+	if ref.registry == dockerHubRegistry && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+
+	return ref
+}
+
+// manifestURL returns the URL of the manifest of the image's digest, or of its tag if it doesn't have one.
+// Registries on the local machine are usually served without TLS, so they are reached over plain HTTP.
+func (ref imageReference) manifestURL() string {
+	scheme := "https"
+	host := ref.registry
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	if host == "localhost" || host == "127.0.0.1" {
+		scheme = "http"
+	}
+	reference := ref.tag
+	if ref.digest != "" {
+		reference = ref.digest
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, ref.registry, ref.repository, reference)
+}
+
+// ResolveImageDigest returns the digest of the manifest which an image's tag currently refers to, as
+// sha256:<hex>. An image which is already pinned to a digest resolves to that digest, without asking its
+// registry.
+func ResolveImageDigest(ctx context.Context, image string) (string, error) {
+	ref := parseImageReference(image)
+	if ref.digest != "" {
+		if !manifestDigest.MatchString(ref.digest) {
+			return "", fmt.Errorf("resolving %s: %q is not a digest of the form sha256:<hex>", image, ref.digest)
+		}
+		return ref.digest, nil
+	}
+	manifest := ref.manifestURL()
+
+	// The digest is usually reported by a HEAD request, which registries don't count against pull limits.
+	// If it isn't, the manifest is downloaded and hashed.
+	resp, err := requestManifest(ctx, http.MethodHead, manifest)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %v", image, err)
+	}
+	digest := resp.Header.Get(manifestDigestHeader)
+	resp.Body.Close()
+
+	if digest == "" {
+		resp, err = requestManifest(ctx, http.MethodGet, manifest)
+		if err != nil {
+			return "", fmt.Errorf("resolving %s: %v", image, err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("resolving %s: %v", image, err)
+		}
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+
+	if !manifestDigest.MatchString(digest) {
+		return "", fmt.Errorf("resolving %s: the registry reported an unsupported digest %q", image, digest)
+	}
+
+	return digest, nil
+}
+
+// requestManifest requests a manifest from a registry. If the registry asks for a bearer token, an anonymous
+// one is requested, and the manifest is requested again with it. Responses other than 200 are errors.
+func requestManifest(ctx context.Context, method, manifest string) (*http.Response, error) {
+	resp, err := doManifestRequest(ctx, method, manifest, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		token, err := anonymousToken(ctx, challenge)
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = doManifestRequest(ctx, method, manifest, token); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, manifest, resp.Status)
+	}
+
+	return resp, nil
+}
+
+func doManifestRequest(ctx context.Context, method, manifest, token string) (*http.Response, error) {
+	req, err := http.NewRequest(method, manifest, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+// anonymousToken requests an anonymous bearer token from the token service which a registry's challenge
+// names.
+func anonymousToken(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("the registry requires authentication (%q)", challenge)
+	}
+
+	params := map[string]string{}
+	for _, m := range challengeParams.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("the registry's challenge has no realm (%q)", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", err
+	}
+	q := realm.Query()
+	for _, p := range []string{"service", "scope"} {
+		if params[p] != "" {
+			q.Set(p, params[p])
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting a token from %s: %s", realm.Host, resp.Status)
+	}
+
+	body := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("the token service at %s didn't return a token", realm.Host)
+}
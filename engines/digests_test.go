@@ -0,0 +1,119 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"testing"
+)
+
+const testDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+func TestParseImageReference(t *testing.T) {
+	cases := map[string]struct {
+		image   string
+		want    imageReference
+		wantURL string
+	}{
+		"OfficialImage": {
+			image:   "alpine",
+			want:    imageReference{registry: dockerHubRegistry, repository: "library/alpine", tag: "latest"},
+			wantURL: "https://registry-1.docker.io/v2/library/alpine/manifests/latest",
+		},
+		"OfficialImageWithTag": {
+			image: "alpine:3.11",
+			want:  imageReference{registry: dockerHubRegistry, repository: "library/alpine", tag: "3.11"},
+		},
+		"DockerHubNamespace": {
+			image: "crossplane/stack-source:v1",
+			want:  imageReference{registry: dockerHubRegistry, repository: "crossplane/stack-source", tag: "v1"},
+		},
+		"ExplicitDockerHub": {
+			image: "docker.io/alpine:3.11",
+			want:  imageReference{registry: dockerHubRegistry, repository: "library/alpine", tag: "3.11"},
+		},
+		"ExplicitDockerHubIndex": {
+			image: "index.docker.io/crossplane/stack-source",
+			want:  imageReference{registry: dockerHubRegistry, repository: "crossplane/stack-source", tag: "latest"},
+		},
+		"OtherRegistry": {
+			image:   "quay.io/example/widget-stack:v2",
+			want:    imageReference{registry: "quay.io", repository: "example/widget-stack", tag: "v2"},
+			wantURL: "https://quay.io/v2/example/widget-stack/manifests/v2",
+		},
+		"RegistryWithPort": {
+			image:   "registry.example.org:5000/widget-stack:v2",
+			want:    imageReference{registry: "registry.example.org:5000", repository: "widget-stack", tag: "v2"},
+			wantURL: "https://registry.example.org:5000/v2/widget-stack/manifests/v2",
+		},
+		"RegistryWithPortWithoutTag": {
+			image: "registry.example.org:5000/widget-stack",
+			want:  imageReference{registry: "registry.example.org:5000", repository: "widget-stack", tag: "latest"},
+		},
+		"Localhost": {
+			image:   "localhost/widget-stack",
+			want:    imageReference{registry: "localhost", repository: "widget-stack", tag: "latest"},
+			wantURL: "http://localhost/v2/widget-stack/manifests/latest",
+		},
+		"LocalhostWithPort": {
+			image:   "localhost:5000/example/widget-stack:dev",
+			want:    imageReference{registry: "localhost:5000", repository: "example/widget-stack", tag: "dev"},
+			wantURL: "http://localhost:5000/v2/example/widget-stack/manifests/dev",
+		},
+		"Digest": {
+			image:   "quay.io/example/widget-stack@" + testDigest,
+			want:    imageReference{registry: "quay.io", repository: "example/widget-stack", digest: testDigest},
+			wantURL: "https://quay.io/v2/example/widget-stack/manifests/" + testDigest,
+		},
+		"TagAndDigest": {
+			image: "registry.example.org:5000/widget-stack:v2@" + testDigest,
+			want:  imageReference{registry: "registry.example.org:5000", repository: "widget-stack", tag: "v2", digest: testDigest},
+		},
+		"OfficialImageWithDigest": {
+			image: "alpine@" + testDigest,
+			want:  imageReference{registry: dockerHubRegistry, repository: "library/alpine", digest: testDigest},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := parseImageReference(tc.image)
+			if got != tc.want {
+				t.Errorf("parseImageReference(%q): got %+v, want %+v", tc.image, got, tc.want)
+			}
+			if tc.wantURL != "" {
+				if url := got.manifestURL(); url != tc.wantURL {
+					t.Errorf("parseImageReference(%q).manifestURL(): got %q, want %q", tc.image, url, tc.wantURL)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveImageDigestOfPinnedImage(t *testing.T) {
+	// The registry isn't reachable from tests, so this only passes if the digest is taken from the image.
+	got, err := ResolveImageDigest(context.Background(), "registry.invalid/widget-stack:v1@"+testDigest)
+	if err != nil {
+		t.Fatalf("ResolveImageDigest(...): %v", err)
+	}
+	if got != testDigest {
+		t.Errorf("ResolveImageDigest(...): got %q, want %q", got, testDigest)
+	}
+
+	if _, err := ResolveImageDigest(context.Background(), "registry.invalid/widget-stack@sha256:abc"); err == nil {
+		t.Errorf("ResolveImageDigest(...): got no error for a malformed digest")
+	}
+}
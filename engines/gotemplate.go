@@ -0,0 +1,372 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package engines
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// GoTemplateEngineRunner renders templates with text/template inside of the controller, and applies the
+// rendered objects with the controller's client. This is much lighter than running a job, which makes it
+// a good fit for simple stacks.
+//
+// Templates from config map and URL sources are read inside of the controller, and checked against their
+// digests; see ReadSourceFiles. Templates from images, git and OCI sources can't be, so they are loaded by
+// a job, in the same way as the stack is loaded for the job engines; see LoadStackFiles. The job only runs
+// when the source changes, so rendering doesn't usually start any jobs. Stacks which don't have a source are
+// packaged with their controller, so their templates are read from the hook's directory under the registry
+// root on the controller's own filesystem.
+//
+// Each file in the directory with a .yaml or .yml extension is executed, with the claim object as its
+// data, so templates refer to fields like {{ .spec.someField }} and {{ .metadata.name }}. Files whose
+// names start with an underscore, and files with a .tpl extension, are only parsed, so that they can
+// define named templates for the other files to include. A file may render multiple objects, separated
+// by "---" lines.
+//
+// The rendered objects are applied with the apply client, which acts as the stack's service account, so
+// objects which the stack's permissions don't cover are refused by the api server.
+//
+// The contents of the secrets and config maps which the hook references are available to the templates
+// as {{ .references.<name>.<key> }}.
+type GoTemplateEngineRunner struct {
+	Log          logr.Logger
+	RegistryRoot string
+	ApplyClient  client.Client
+	References   []Reference
+
+	// ConfigName is the stack configuration, in whose namespace config map sources are read.
+	ConfigName types.NamespacedName
+
+	// Images and ServiceAccountName configure the jobs which load the templates from the stack's source.
+	Images             ImageOptions
+	ServiceAccountName string
+}
+
+const (
+	GoTemplateEngineType = "gotemplate"
+)
+
+var (
+	documentSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+)
+
+func init() {
+	Register(Engine{
+		Type:         GoTemplateEngineType,
+		References:   true,
+		ReadsSources: true,
+		New: func(opts EngineOptions) ResourceEngineRunner {
+			ger := NewGoTemplateEngineRunner(opts.Log, opts.RegistryRoot, opts.ApplyClient, opts.References)
+			ger.ConfigName = opts.ConfigName
+			ger.Images = opts.Images
+			ger.ServiceAccountName = opts.ServiceAccountName
+			return ger
+		},
+	})
+}
+
+// CreateConfig doesn't create a config map, because the templates are executed directly against the claim.
+func (ger *GoTemplateEngineRunner) CreateConfig(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration) (*corev1.ConfigMap, error) {
+	return nil, nil
+}
+
+// RunEngine renders the templates and applies the resulting objects, or deletes them for the delete event.
+// Once the templates have been loaded, rendering happens synchronously, so the hook has finished by the time
+// this returns. Until then, the status of the job which loads them is returned. Errors in the templates fail
+// the hook, while errors talking to the api server are returned so that the claim is retried.
+func (ger *GoTemplateEngineRunner) RunEngine(ctx context.Context, client client.Client, claim *unstructured.Unstructured, config *corev1.ConfigMap, stackSource string, event v1alpha1.EventName, hookIndex int, hc *v1alpha1.HookConfiguration) (*v1alpha1.HookStatus, error) {
+	files, loaded, err := ger.stackFiles(ctx, client, claim, stackSource, event, hookIndex, hc)
+	if err != nil {
+		return nil, err
+	}
+	if loaded.Phase != v1alpha1.HookPhaseSucceeded {
+		return loaded, nil
+	}
+
+	objs, err := ger.render(claim, hc, files)
+	if err != nil {
+		ger.Log.V(0).Info("Error rendering templates!", "claim", claim, "hookConfig", hc, "error", err)
+		return failedHook(loaded.JobName, err), nil
+	}
+
+	// The load job is kept for as long as the hook's status refers to it, so that it isn't run again.
+	hs := &v1alpha1.HookStatus{
+		Phase:     v1alpha1.HookPhaseSucceeded,
+		JobName:   loaded.JobName,
+		Resources: make([]corev1.ObjectReference, 0, len(objs)),
+	}
+
+	for _, obj := range objs {
+		if event == v1alpha1.EventDelete {
+			err = ger.ApplyClient.Delete(ctx, obj)
+			if kerrors.IsNotFound(err) {
+				err = nil
+			}
+		} else {
+			err = applyObject(ctx, ger.ApplyClient, obj, FieldManager(claim, hookIndex))
+		}
+
+		if kerrors.IsForbidden(err) {
+			err = fmt.Errorf("%s %s/%s is not covered by the stack's permissions: %v", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+		}
+		if err != nil {
+			ger.Log.V(0).Info("Error acting on rendered object", "claim", claim, "event", event, "object", obj, "error", err)
+			return nil, err
+		}
+
+		hs.Resources = append(hs.Resources, objectReference(obj))
+	}
+
+	hs.SetConditions(runtimev1alpha1.Available())
+	return hs, nil
+}
+
+// PlanEngine renders the templates and applies the resulting objects with a server-side dry run, to find what
+// applying them would change. Like RunEngine, errors in the templates fail the hook.
+func (ger *GoTemplateEngineRunner) PlanEngine(ctx context.Context, client client.Client, claim *unstructured.Unstructured, config *corev1.ConfigMap, stackSource string, event v1alpha1.EventName, hookIndex int, hc *v1alpha1.HookConfiguration) (*v1alpha1.HookPlan, error) {
+	files, loaded, err := ger.stackFiles(ctx, client, claim, stackSource, event, hookIndex, hc)
+	if err != nil {
+		return nil, err
+	}
+	if loaded.Phase != v1alpha1.HookPhaseSucceeded {
+		return &v1alpha1.HookPlan{
+			Phase:   loaded.Phase,
+			JobName: loaded.JobName,
+			Message: loaded.Message,
+		}, nil
+	}
+
+	objs, err := ger.render(claim, hc, files)
+	if err != nil {
+		ger.Log.V(0).Info("Error rendering templates!", "claim", claim, "hookConfig", hc, "error", err)
+		return &v1alpha1.HookPlan{
+			Phase:   v1alpha1.HookPhaseFailed,
+			JobName: loaded.JobName,
+			Message: err.Error(),
+		}, nil
+	}
+
+	hp := &v1alpha1.HookPlan{
+		Phase:     v1alpha1.HookPhaseSucceeded,
+		JobName:   loaded.JobName,
+		Resources: make([]corev1.ObjectReference, 0, len(objs)),
+	}
+
+	for _, obj := range objs {
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(obj.GroupVersionKind())
+
+		err := ger.ApplyClient.Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}, live)
+		exists := err == nil
+		if kerrors.IsNotFound(err) {
+			err = nil
+		}
+		if err == nil {
+			err = dryRunApplyObject(ctx, ger.ApplyClient, obj, FieldManager(claim, hookIndex))
+		}
+
+		if kerrors.IsForbidden(err) {
+			err = fmt.Errorf("%s %s/%s is not covered by the stack's permissions: %v", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+		}
+		if err != nil {
+			ger.Log.V(0).Info("Error planning rendered object", "claim", claim, "event", event, "object", obj, "error", err)
+			return nil, err
+		}
+
+		ref := objectReference(obj)
+		hp.Resources = append(hp.Resources, ref)
+
+		switch {
+		case !exists:
+			hp.Create = append(hp.Create, ref)
+		case !sameObject(live, obj):
+			hp.Update = append(hp.Update, ref)
+		}
+	}
+
+	return hp, nil
+}
+
+// stackFiles returns the files in the hook's directory, along with the status of the job which loaded them.
+// Until the files have been loaded, only the job's status is returned. Files which are read from the registry
+// root, or from a config map or URL source, don't need a job, so their status is successful as soon as they
+// have been read.
+func (ger *GoTemplateEngineRunner) stackFiles(ctx context.Context, kube client.Client, claim *unstructured.Unstructured, stackSource string, event v1alpha1.EventName, hookIndex int, hc *v1alpha1.HookConfiguration) (map[string][]byte, *v1alpha1.HookStatus, error) {
+	if stackSource == "" && hc.Source.IsZero() {
+		files, err := readStackDirectory(filepath.Join(ger.RegistryRoot, hc.Directory))
+		if err != nil {
+			ger.Log.V(0).Info("Error reading templates!", "claim", claim, "hookConfig", hc, "error", err)
+			return nil, failedHook("", err), nil
+		}
+		return files, &v1alpha1.HookStatus{Phase: v1alpha1.HookPhaseSucceeded}, nil
+	}
+
+	if stackSource == "" && ReadsSourceInProcess(hc.Source) {
+		files, err := ReadSourceFiles(ctx, kube, ger.ConfigName.Namespace, hc.Source, hc.Directory)
+		if err != nil {
+			return nil, nil, err
+		}
+		return files, &v1alpha1.HookStatus{Phase: v1alpha1.HookPhaseSucceeded}, nil
+	}
+
+	return LoadStackFiles(ctx, kube, claim, stackSource, event, hookIndex, hc, ger.Images, ger.ServiceAccountName)
+}
+
+// failedHook returns the status of a hook which failed with the given error.
+func failedHook(jobName string, err error) *v1alpha1.HookStatus {
+	hs := &v1alpha1.HookStatus{
+		Phase:   v1alpha1.HookPhaseFailed,
+		JobName: jobName,
+		Message: err.Error(),
+	}
+	hs.SetConditions(runtimev1alpha1.Unavailable().WithMessage(hs.Message))
+	return hs
+}
+
+// render executes the templates in the given files, which are keyed by their paths in the hook's directory,
+// and decodes the objects that they render.
+func (ger *GoTemplateEngineRunner) render(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration, files map[string][]byte) ([]*unstructured.Unstructured, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		switch path.Ext(name) {
+		case ".yaml", ".yml", ".tpl":
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	root := template.New(hc.Directory)
+	root.Funcs(templateFuncs(root))
+
+	executed := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, err := root.New(name).Parse(string(files[name])); err != nil {
+			return nil, err
+		}
+
+		if path.Ext(name) != ".tpl" && !strings.HasPrefix(path.Base(name), "_") {
+			executed = append(executed, name)
+		}
+	}
+
+	// If the hook maps values, the templates see them as the claim's spec.
+	data, err := claimWithValues(claim, hc)
+	if err != nil {
+		return nil, err
+	}
+	if len(ger.References) > 0 {
+		data.Object[referencesValuesKey] = referenceValues(ger.References)
+	}
+
+	objs := make([]*unstructured.Unstructured, 0)
+	for _, name := range executed {
+		buf := &bytes.Buffer{}
+		if err := root.ExecuteTemplate(buf, name, data.Object); err != nil {
+			return nil, err
+		}
+
+		rendered, err := decodeObjects(buf.String(), claim.GetNamespace())
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, rendered...)
+	}
+
+	return objs, nil
+}
+
+// RenderLocal renders the templates without applying them. The templates are read from the stack root.
+func (ger *GoTemplateEngineRunner) RenderLocal(ctx context.Context, claim *unstructured.Unstructured, config *corev1.ConfigMap, hc *v1alpha1.HookConfiguration, opts LocalOptions) ([]*unstructured.Unstructured, error) {
+	files, err := readStackDirectory(filepath.Join(opts.StackRoot, hc.Directory))
+	if err != nil {
+		return nil, err
+	}
+	return ger.render(claim, hc, files)
+}
+
+// decodeObjects decodes the objects in a YAML stream, which may have several documents separated by "---"
+// lines. Objects without a namespace are put in the given namespace.
+func decodeObjects(stream string, namespace string) ([]*unstructured.Unstructured, error) {
+	objs := make([]*unstructured.Unstructured, 0)
+	for _, doc := range documentSeparator.Split(stream, -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		data, err := yaml.YAMLToJSON([]byte(doc))
+		if err != nil {
+			return nil, err
+		}
+		if string(data) == "null" {
+			// The document only had comments in it.
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(data); err != nil {
+			return nil, err
+		}
+
+		// The api server ignores the namespace of cluster-scoped objects, so it's safe to set it on
+		// everything.
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
+
+// applyObject applies the object with server-side apply, as the given field manager. Conflicts with other
+// field managers are resolved in favor of the rendered object.
+func applyObject(ctx context.Context, kube client.Client, obj *unstructured.Unstructured, fieldManager string) error {
+	return kube.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+}
+
+// dryRunApplyObject applies the object in the same way as applyObject, but with a dry run, so nothing is
+// changed. The object is replaced with what the api server would have stored.
+func dryRunApplyObject(ctx context.Context, kube client.Client, obj *unstructured.Unstructured, fieldManager string) error {
+	return kube.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership, client.DryRunAll)
+}
+
+func NewGoTemplateEngineRunner(log logr.Logger, registryRoot string, applyClient client.Client, refs []Reference) *GoTemplateEngineRunner {
+	return &GoTemplateEngineRunner{
+		Log:          log,
+		RegistryRoot: registryRoot,
+		ApplyClient:  applyClient,
+		References:   refs,
+	}
+}
@@ -0,0 +1,178 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+const (
+	// Both helm engines are configured with a values file.
+	valuesFile = "values.yaml"
+
+	// Helm doesn't allow release names to be longer than this.
+	maxReleaseNameLength = 53
+)
+
+// helmRunner runs a version of helm. The versions are configured and run in the same way, and only differ
+// in the arguments which helm is invoked with, so each helm engine is a helmRunner with its own args.
+type helmRunner struct {
+	Log                logr.Logger
+	ConfigName         types.NamespacedName
+	Images             ImageOptions
+	ServiceAccountName string
+	References         []Reference
+
+	// ReleaseName and Namespace override the claim's name and namespace as the name and namespace of the
+	// release. See EngineOptions.
+	ReleaseName string
+	Namespace   string
+
+	// args returns the arguments which this version of helm renders a claim's chart with. The values files of
+	// the runner's references have to come before the claim's values file, so that the claim's values take
+	// precedence over them.
+	args func(rel *release, claim *unstructured.Unstructured, refs []Reference) []string
+}
+
+func newHelmRunner(
+	log logr.Logger, configName types.NamespacedName, images ImageOptions, serviceAccountName string, refs []Reference,
+	args func(rel *release, claim *unstructured.Unstructured, refs []Reference) []string,
+) helmRunner {
+	return helmRunner{
+		Log:                log,
+		ConfigName:         configName,
+		Images:             images,
+		ServiceAccountName: serviceAccountName,
+		References:         refs,
+		args:               args,
+	}
+}
+
+// When a behavior executes, the resource engine is configured by the
+// object which triggered the behavior. This method encapsulates the logic to
+// create the resource engine configuration from the object's fields. The
+// hook's value mappings, if it has any, decide what ends up in the values file.
+func (hr *helmRunner) CreateConfig(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration) (*corev1.ConfigMap, error) {
+	stringConfigContents, err := valuesYAML(claim, hc, hr.ConfigName, hr.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	return engineConfigMap(claim, map[string]string{valuesFile: stringConfigContents}, hr.Log)
+}
+
+// TODO we could potentially have a method create the job, and a higher-level one execute it.
+func (hr *helmRunner) RunEngine(ctx context.Context, client client.Client, claim *unstructured.Unstructured, config *corev1.ConfigMap, stackSource string, event v1alpha1.EventName, hookIndex int, hc *v1alpha1.HookConfiguration) (*v1alpha1.HookStatus, error) {
+	job, err := newRenderJob(claim, config, stackSource, event, hookIndex, hc, hr.engine(claim, hc), hr.Images, hr.ServiceAccountName, hr.References, hr.release())
+	if err != nil {
+		hr.Log.V(1).Info("Error generating render job", "claim", claim.GetNamespace()+"/"+claim.GetName(), "error", err)
+		return nil, err
+	}
+
+	return runJob(ctx, client, job)
+}
+
+// PlanEngine runs a plan job for the hook, which renders the hook's resources without applying them.
+func (hr *helmRunner) PlanEngine(ctx context.Context, client client.Client, claim *unstructured.Unstructured, config *corev1.ConfigMap, stackSource string, event v1alpha1.EventName, hookIndex int, hc *v1alpha1.HookConfiguration) (*v1alpha1.HookPlan, error) {
+	job, err := newRenderJob(claim, config, stackSource, event, hookIndex, hc, hr.engine(claim, hc), hr.Images, hr.ServiceAccountName, hr.References, hr.release())
+	if err != nil {
+		hr.Log.V(1).Info("Error generating plan job", "claim", claim.GetNamespace()+"/"+claim.GetName(), "error", err)
+		return nil, err
+	}
+
+	return runPlanJob(ctx, client, job)
+}
+
+// RenderLocal runs helm on the local machine, rather than in a job. The helm on the PATH has to be the
+// version which the engine is for.
+func (hr *helmRunner) RenderLocal(ctx context.Context, claim *unstructured.Unstructured, config *corev1.ConfigMap, hc *v1alpha1.HookConfiguration, opts LocalOptions) ([]*unstructured.Unstructured, error) {
+	return renderContainerLocally(ctx, hr.engine(claim, hc), claim, config, hc, hr.References, opts)
+}
+
+// engine returns the container which runs helm in a render job.
+func (hr *helmRunner) engine(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration) corev1.Container {
+	return corev1.Container{
+		Name:  "engine",
+		Image: hr.Images.engineImage(hc),
+		Command: []string{
+			"helm",
+		},
+		Args: append(hr.args(hr.release(), claim, hr.References), setFileArgs(hr.References)...),
+	}
+}
+
+func (hr *helmRunner) release() *release {
+	return newRelease(hr.ReleaseName, hr.Namespace)
+}
+
+// releaseName returns the name of a helm release, which both helm engines render with. By default, the
+// claim's name is used, so that charts which name their resources after the release name them after the
+// claim. Names which are too long for helm are shortened, with a hash of the full name to keep them unique.
+func releaseName(name string) string {
+	if len(name) <= maxReleaseNameLength {
+		return name
+	}
+
+	h, err := hashObject(name)
+	if err != nil {
+		// Hashing a string can't fail, but truncating is better than nothing.
+		return name[:maxReleaseNameLength]
+	}
+
+	prefix := strings.TrimRight(name[:maxReleaseNameLength-len(h)-1], "-.")
+	return prefix + "-" + h
+}
+
+// A release overrides the name and namespace which a chart is rendered and applied with. Without one, the
+// claim's name and namespace are used.
+type release struct {
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// newRelease returns the release for the given name and namespace, or nil if neither is overridden, so that
+// the jobs for claims are named in the same way as they were before releases could be overridden.
+func newRelease(name, namespace string) *release {
+	if name == "" && namespace == "" {
+		return nil
+	}
+	return &release{Name: name, Namespace: namespace}
+}
+
+// name returns the name of the release for a claim.
+func (r *release) name(claim *unstructured.Unstructured) string {
+	if r != nil && r.Name != "" {
+		return releaseName(r.Name)
+	}
+	return releaseName(claim.GetName())
+}
+
+// namespace returns the namespace which the release's resources are applied in for a claim.
+func (r *release) namespace(claim *unstructured.Unstructured) string {
+	if r != nil && r.Namespace != "" {
+		return r.Namespace
+	}
+	return claim.GetNamespace()
+}
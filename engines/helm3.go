@@ -0,0 +1,72 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package engines
+
+import (
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Helm3EngineRunner renders a chart with Helm 3, which supports apiVersion v2 charts and
+// library charts.
+//
+// Render jobs don't have access to chart repositories, so a chart's dependencies must be
+// vendored in its charts/ directory in the stack image. Helm uses vendored dependencies
+// without needing to fetch anything.
+type Helm3EngineRunner struct {
+	helmRunner
+}
+
+const (
+	Helm3EngineType  = "helm3"
+	helm3EngineImage = "crossplane/helm3-engine:latest"
+)
+
+func init() {
+	Register(Engine{
+		Type:           Helm3EngineType,
+		DefaultImage:   helm3EngineImage,
+		ConfigFileName: valuesFile,
+		References:     true,
+		New: func(opts EngineOptions) ResourceEngineRunner {
+			her := NewHelm3EngineRunner(opts.Log, opts.ConfigName, opts.Images, opts.ServiceAccountName, opts.References)
+			her.ReleaseName = opts.ReleaseName
+			her.Namespace = opts.Namespace
+			return her
+		},
+	})
+}
+
+// helm3Args returns the arguments which Helm 3 renders a chart with.
+func helm3Args(rel *release, claim *unstructured.Unstructured, refs []Reference) []string {
+	args := []string{
+		"template",
+		// Helm 3 requires a release name. Deriving it from the claim's name keeps the
+		// rendered output stable from one run to the next.
+		rel.name(claim),
+		stackDestDir,
+		"--output-dir", resourceCfgDestDir,
+		"--namespace", rel.namespace(claim),
+	}
+	args = append(args, valuesFileArgs(refs)...)
+	return append(args, "--values", engineCfgDir+valuesFile, "--include-crds")
+}
+
+func NewHelm3EngineRunner(log logr.Logger, configName types.NamespacedName, images ImageOptions, serviceAccountName string, refs []Reference) *Helm3EngineRunner {
+	return &Helm3EngineRunner{
+		helmRunner: newHelmRunner(log, configName, images, serviceAccountName, refs, helm3Args),
+	}
+}
@@ -0,0 +1,76 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+func TestHelmEngineArgs(t *testing.T) {
+	refs := []Reference{
+		{ResourceReference: v1alpha1.ResourceReference{Name: "defaults"}, ValuesKey: "values.yaml"},
+		{ResourceReference: v1alpha1.ResourceReference{Name: "creds"}, Data: map[string]string{"password": "hunter2"}},
+	}
+	configName := types.NamespacedName{Namespace: "default", Name: "widgets"}
+
+	cases := map[string]struct {
+		runner *helmRunner
+		want   []string
+	}{
+		"Helm2": {
+			runner: &NewHelm2EngineRunner(nil, configName, ImageOptions{}, "", refs).helmRunner,
+			want: []string{
+				"template", "--name", "widget", "--output-dir", resourceCfgDestDir, "--namespace", "default",
+				"--values", referencesDir + "defaults/values.yaml", "--values", engineCfgDir + valuesFile, stackDestDir,
+				"--set-file", "references.creds.password=" + referencesDir + "creds/password",
+			},
+		},
+		"Helm3": {
+			runner: &NewHelm3EngineRunner(nil, configName, ImageOptions{}, "", refs).helmRunner,
+			want: []string{
+				"template", "widget", stackDestDir, "--output-dir", resourceCfgDestDir, "--namespace", "default",
+				"--values", referencesDir + "defaults/values.yaml", "--values", engineCfgDir + valuesFile, "--include-crds",
+				"--set-file", "references.creds.password=" + referencesDir + "creds/password",
+			},
+		},
+		"Helm3Release": {
+			runner: func() *helmRunner {
+				her := NewHelm3EngineRunner(nil, configName, ImageOptions{}, "", nil)
+				her.ReleaseName = "release"
+				her.Namespace = "target"
+				return &her.helmRunner
+			}(),
+			want: []string{
+				"template", "release", stackDestDir, "--output-dir", resourceCfgDestDir, "--namespace", "target",
+				"--values", engineCfgDir + valuesFile, "--include-crds",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := tc.runner.engine(valuesClaim(), &v1alpha1.HookConfiguration{}).Args
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("engine(...).Args: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// Defaults for the containers of render jobs.
+const (
+	DefaultApplierImage    = "crossplane/kubectl:latest"
+	DefaultSourceImage     = "crossplane/stack-source:latest"
+	DefaultImagePullPolicy = corev1.PullIfNotPresent
+)
+
+// ImageOptions are the controller's defaults for the containers of render jobs. Hooks can override
+// all of them in their engine configuration.
+type ImageOptions struct {
+	// EngineImages are the images of engines, by engine type. Engines which aren't listed use
+	// the default image which they were registered with.
+	EngineImages map[string]string
+
+	ApplierImage string
+
+	// SourceImage loads the stack's files for sources other than images. It needs a shell, git, curl,
+	// tar, sha256sum and oras. Hooks can't override it.
+	SourceImage string
+
+	ImagePullPolicy  corev1.PullPolicy
+	ImagePullSecrets []corev1.LocalObjectReference
+}
+
+// DefaultImageOptions returns the image options which are used when the controller isn't
+// configured otherwise.
+func DefaultImageOptions() ImageOptions {
+	return ImageOptions{
+		EngineImages:    map[string]string{},
+		ApplierImage:    DefaultApplierImage,
+		SourceImage:     DefaultSourceImage,
+		ImagePullPolicy: DefaultImagePullPolicy,
+	}
+}
+
+// engineImage returns the image which a hook's engine runs in.
+func (o ImageOptions) engineImage(hc *v1alpha1.HookConfiguration) string {
+	if hc.Engine.Image != "" {
+		return hc.Engine.Image
+	}
+	if image, ok := o.EngineImages[hc.Engine.Type]; ok && image != "" {
+		return image
+	}
+	if e, err := Lookup(hc.Engine.Type); err == nil {
+		return e.DefaultImage
+	}
+	return ""
+}
+
+// applierImage returns the image which applies a hook's rendered resources.
+func (o ImageOptions) applierImage(hc *v1alpha1.HookConfiguration) string {
+	if hc.Engine.ApplierImage != "" {
+		return hc.Engine.ApplierImage
+	}
+	if o.ApplierImage != "" {
+		return o.ApplierImage
+	}
+	return DefaultApplierImage
+}
+
+// sourceImage returns the image which loads a hook's files from sources other than images.
+func (o ImageOptions) sourceImage() string {
+	if o.SourceImage != "" {
+		return o.SourceImage
+	}
+	return DefaultSourceImage
+}
+
+// imagePullPolicy returns the pull policy for all of a hook's containers.
+func (o ImageOptions) imagePullPolicy(hc *v1alpha1.HookConfiguration) corev1.PullPolicy {
+	if hc.Engine.ImagePullPolicy != "" {
+		return hc.Engine.ImagePullPolicy
+	}
+	if o.ImagePullPolicy != "" {
+		return o.ImagePullPolicy
+	}
+	return DefaultImagePullPolicy
+}
+
+// imagePullSecrets returns the secrets which are used to pull all of a hook's images.
+func (o ImageOptions) imagePullSecrets(hc *v1alpha1.HookConfiguration) []corev1.LocalObjectReference {
+	if len(hc.Engine.ImagePullSecrets) > 0 {
+		return hc.Engine.ImagePullSecrets
+	}
+	return o.ImagePullSecrets
+}
@@ -0,0 +1,208 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Rendered objects are applied with server-side apply, so that each hook owns the fields that it renders. The
+// objects which a hook applied are recorded as its inventory, so that the objects which it stops rendering
+// can be pruned the next time that it runs.
+//
+// Job-based engines record their inventory in a config map which has the same name as the job, one object
+// per line, with the fields of each object separated by tabs.
+
+const (
+	inventoryKey = "inventory"
+
+	// This is the format of a line of the inventory, as a kubectl jsonpath template.
+	inventoryJSONPath = `{.apiVersion}{"\t"}{.kind}{"\t"}{.metadata.namespace}{"\t"}{.metadata.name}{"\n"}`
+)
+
+// FieldManager returns the name of the field manager which a claim's hook applies rendered objects with.
+// The name is unique to the claim and the position of the hook, so that hooks don't fight over fields.
+func FieldManager(claim *unstructured.Unstructured, hookIndex int) string {
+	return fmt.Sprintf("stack-template-engine-%s-%d", claim.GetUID(), hookIndex)
+}
+
+// inventoryConfigMap returns the config map which a render job records the objects that it applied in. It
+// has the same name, labels and owner as the job, so that it is cleaned up along with the claim.
+func inventoryConfigMap(job *batchv1.Job) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            job.GetName(),
+			Namespace:       job.GetNamespace(),
+			Labels:          job.GetLabels(),
+			OwnerReferences: job.GetOwnerReferences(),
+		},
+	}
+}
+
+// readInventory returns the objects which a render job recorded in its inventory. If the job hasn't
+// recorded its inventory, nil is returned.
+func readInventory(ctx context.Context, kube client.Client, job *batchv1.Job) ([]corev1.ObjectReference, error) {
+	data, err := readInventoryData(ctx, kube, job)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory, ok := data[inventoryKey]
+	if !ok {
+		return nil, nil
+	}
+
+	return parseInventory(inventory), nil
+}
+
+// readInventoryData returns the data of a render job's inventory config map. If the config map doesn't
+// exist, nil is returned.
+func readInventoryData(ctx context.Context, kube client.Client, job *batchv1.Job) (map[string]string, error) {
+	// The config map is read as an unstructured object, because unstructured objects are read from the api
+	// server rather than from the cache. Otherwise, every config map in the cluster would be cached.
+	cm := &unstructured.Unstructured{}
+	cm.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+
+	err := kube.Get(ctx, types.NamespacedName{Namespace: job.GetNamespace(), Name: job.GetName()}, cm)
+	if kerrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := unstructured.NestedStringMap(cm.Object, "data")
+	return data, err
+}
+
+// parseInventory parses the lines of an inventory. An empty inventory has no objects, but isn't nil.
+func parseInventory(inventory string) []corev1.ObjectReference {
+	refs := make([]corev1.ObjectReference, 0)
+	for _, line := range strings.Split(inventory, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			continue
+		}
+
+		refs = append(refs, corev1.ObjectReference{
+			APIVersion: fields[0],
+			Kind:       fields[1],
+			Namespace:  fields[2],
+			Name:       fields[3],
+		})
+	}
+	return refs
+}
+
+// Prune deletes the objects which a claim's hook applied previously, but didn't apply this time. Objects
+// which are no longer managed by the hook's field manager are left alone, because something else has
+// taken them over. The client should act as the stack's service account, so objects which the stack is no
+// longer permitted to touch are left alone too.
+func Prune(ctx context.Context, kube client.Client, claim *unstructured.Unstructured, hookIndex int, previous, current []corev1.ObjectReference) error {
+	stale, err := staleObjects(ctx, kube, claim, hookIndex, previous, current)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range stale {
+		err = kube.Delete(ctx, obj, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !kerrors.IsNotFound(err) && !kerrors.IsForbidden(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PlanPrune returns the objects which Prune would delete, without deleting them.
+func PlanPrune(ctx context.Context, kube client.Client, claim *unstructured.Unstructured, hookIndex int, previous, current []corev1.ObjectReference) ([]corev1.ObjectReference, error) {
+	stale, err := staleObjects(ctx, kube, claim, hookIndex, previous, current)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]corev1.ObjectReference, 0, len(stale))
+	for _, obj := range stale {
+		refs = append(refs, objectReference(obj))
+	}
+	return refs, nil
+}
+
+// staleObjects returns the objects which Prune deletes.
+func staleObjects(ctx context.Context, kube client.Client, claim *unstructured.Unstructured, hookIndex int, previous, current []corev1.ObjectReference) ([]*unstructured.Unstructured, error) {
+	applied := make(map[corev1.ObjectReference]bool, len(current))
+	for _, ref := range current {
+		applied[ref] = true
+	}
+
+	fieldManager := FieldManager(claim, hookIndex)
+
+	stale := make([]*unstructured.Unstructured, 0)
+	for _, ref := range previous {
+		if applied[ref] {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(ref.APIVersion)
+		obj.SetKind(ref.Kind)
+
+		err := kube.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, obj)
+		if kerrors.IsNotFound(err) || kerrors.IsForbidden(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !managedBy(obj, fieldManager) {
+			continue
+		}
+
+		stale = append(stale, obj)
+	}
+
+	return stale, nil
+}
+
+// objectReference returns the reference which an object is recorded in an inventory with.
+func objectReference(obj *unstructured.Unstructured) corev1.ObjectReference {
+	return corev1.ObjectReference{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}
+}
+
+func managedBy(obj *unstructured.Unstructured, fieldManager string) bool {
+	for _, mf := range obj.GetManagedFields() {
+		if mf.Manager == fieldManager {
+			return true
+		}
+	}
+	return false
+}
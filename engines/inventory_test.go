@@ -0,0 +1,129 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// managedConfigMap returns a config map whose fields are managed by the given field managers.
+func managedConfigMap(name string, managers ...string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	for _, manager := range managers {
+		cm.ManagedFields = append(cm.ManagedFields, metav1.ManagedFieldsEntry{
+			Manager:   manager,
+			Operation: metav1.ManagedFieldsOperationApply,
+		})
+	}
+	return cm
+}
+
+func configMapRef(name string) corev1.ObjectReference {
+	return corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: name}
+}
+
+func TestPrune(t *testing.T) {
+	claim := valuesClaim()
+	claim.SetUID(types.UID("claim-uid"))
+	hookManager := FieldManager(claim, 1)
+
+	cases := map[string]struct {
+		objects  []*corev1.ConfigMap
+		previous []corev1.ObjectReference
+		current  []corev1.ObjectReference
+		pruned   []string
+		kept     []string
+	}{
+		"ObjectNoLongerRendered": {
+			objects:  []*corev1.ConfigMap{managedConfigMap("stale", hookManager)},
+			previous: []corev1.ObjectReference{configMapRef("stale")},
+			pruned:   []string{"stale"},
+		},
+		"ObjectStillRendered": {
+			objects:  []*corev1.ConfigMap{managedConfigMap("applied", hookManager)},
+			previous: []corev1.ObjectReference{configMapRef("applied")},
+			current:  []corev1.ObjectReference{configMapRef("applied")},
+			kept:     []string{"applied"},
+		},
+		"ObjectManagedByAnotherHook": {
+			objects:  []*corev1.ConfigMap{managedConfigMap("other-hook", FieldManager(claim, 0))},
+			previous: []corev1.ObjectReference{configMapRef("other-hook")},
+			kept:     []string{"other-hook"},
+		},
+		"ObjectManagedByAnotherManager": {
+			objects:  []*corev1.ConfigMap{managedConfigMap("taken-over", "kubectl")},
+			previous: []corev1.ObjectReference{configMapRef("taken-over")},
+			kept:     []string{"taken-over"},
+		},
+		"ObjectSharedWithAnotherManager": {
+			objects:  []*corev1.ConfigMap{managedConfigMap("shared", "kubectl", hookManager)},
+			previous: []corev1.ObjectReference{configMapRef("shared")},
+			pruned:   []string{"shared"},
+		},
+		"ObjectAlreadyDeleted": {
+			previous: []corev1.ObjectReference{configMapRef("missing")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			objs := make([]runtime.Object, 0, len(tc.objects))
+			for _, cm := range tc.objects {
+				objs = append(objs, cm)
+			}
+			kube := fake.NewFakeClientWithScheme(scheme.Scheme, objs...)
+			ctx := context.Background()
+
+			planned, err := PlanPrune(ctx, kube, claim, 1, tc.previous, tc.current)
+			if err != nil {
+				t.Fatalf("PlanPrune: %v", err)
+			}
+			wantPlanned := make([]corev1.ObjectReference, 0, len(tc.pruned))
+			for _, name := range tc.pruned {
+				wantPlanned = append(wantPlanned, configMapRef(name))
+			}
+			if !reflect.DeepEqual(planned, wantPlanned) {
+				t.Errorf("PlanPrune: got %v, want %v", planned, wantPlanned)
+			}
+
+			if err := Prune(ctx, kube, claim, 1, tc.previous, tc.current); err != nil {
+				t.Fatalf("Prune: %v", err)
+			}
+			for _, name := range tc.pruned {
+				err := kube.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &corev1.ConfigMap{})
+				if !kerrors.IsNotFound(err) {
+					t.Errorf("%s: want it to be pruned, got error %v", name, err)
+				}
+			}
+			for _, name := range tc.kept {
+				err := kube.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &corev1.ConfigMap{})
+				if err != nil {
+					t.Errorf("%s: want it to be kept, got error %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	runtimev1alpha1 "github.com/crossplaneio/crossplane-runtime/apis/core/v1alpha1"
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// DefaultRegistryRoot is where a stack's files are found in a stack image.
+const DefaultRegistryRoot = "/.registry"
+
+// The volumes which are shared between the containers of a render job, and where they are mounted.
+const (
+	// The engine configuration, which is generated from the claim, is mounted from a config map.
+	engineCfgVolumeName = "engine-configuration"
+	engineCfgDir        = "/usr/share/engine-configuration/"
+
+	// The stack's files for the hook are copied here from the stack image.
+	stackVolumeName = "stack-configuration"
+	stackDestDir    = "/usr/share/input/"
+
+	// The engine writes the rendered resources here.
+	resourceCfgVolumeName = "resource-configuration"
+	resourceCfgDestDir    = "/usr/share/resource-configuration/"
+
+	// Engines may write temporary files here. It isn't a volume, because only the engine uses it.
+	scratchDir = "/tmp/"
+)
+
+// Labels which are put on every render job, so that the jobs for a claim can be found again.
+var (
+	LabelClaimUID  = v1alpha1.GroupVersion.Group + "/claim-uid"
+	LabelEvent     = v1alpha1.GroupVersion.Group + "/event"
+	LabelHookIndex = v1alpha1.GroupVersion.Group + "/hook-index"
+)
+
+// jobInputs are the inputs which determine what a render job does. If any of them change, the
+// job needs to be run again, so they are hashed into the job's name.
+//
+// The event which a hook is run for isn't an input itself. A claim moves on from its create or update
+// event once its hooks have finished, so if the next event's hooks are the same, they would otherwise be
+// run again for nothing. The event only changes what the job does through the applier's script.
+type jobInputs struct {
+	ApplierScript string `json:"applierScript"`
+	ConfigName    string `json:"configName"`
+	StackSource   string `json:"stackSource"`
+	Directory     string `json:"directory"`
+	Engine        string `json:"engine"`
+
+	EngineImage  string `json:"engineImage"`
+	ApplierImage string `json:"applierImage"`
+
+	// The job's pod is pulled and run with these, so a job which couldn't pull its images, or wasn't allowed
+	// to apply what it rendered, runs again once they are changed.
+	ImagePullPolicy    corev1.PullPolicy             `json:"imagePullPolicy"`
+	ImagePullSecrets   []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	ServiceAccountName string                        `json:"serviceAccountName"`
+
+	References []string `json:"references,omitempty"`
+
+	Release *release `json:"release,omitempty"`
+
+	// Source is set for stacks which don't come from an image. The source is pinned, so it only changes
+	// when the stack does.
+	Source *v1alpha1.StackConfigurationSource `json:"source,omitempty"`
+}
+
+// jobName generates a deterministic name for the job which runs a hook for a claim. The name is
+// derived from the claim's UID, the position of the hook, and a hash of the job's inputs. The engine
+// configuration map's name already includes a hash of its contents, so the configuration is covered
+// by the hash as well.
+func jobName(claim *unstructured.Unstructured, event v1alpha1.EventName, hookIndex int, config *corev1.ConfigMap, source v1alpha1.StackConfigurationSource, hc *v1alpha1.HookConfiguration, engineImage, applierImage string, pullPolicy corev1.PullPolicy, pullSecrets []corev1.LocalObjectReference, serviceAccountName string, refs []Reference, rel *release) (string, error) {
+	inputs := jobInputs{
+		ApplierScript:      applierScript(event),
+		ConfigName:         config.GetName(),
+		StackSource:        source.Image,
+		Directory:          hc.Directory,
+		Engine:             hc.Engine.Type,
+		EngineImage:        engineImage,
+		ApplierImage:       applierImage,
+		ImagePullPolicy:    pullPolicy,
+		ImagePullSecrets:   pullSecrets,
+		ServiceAccountName: serviceAccountName,
+		References:         referenceVersions(refs),
+		Release:            rel,
+	}
+	if source.Image == "" {
+		inputs.Source = &source
+	}
+
+	h, err := hashObject(inputs)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-%d-%s", claim.GetUID(), hookIndex, h), nil
+}
+
+// jobLabels returns the labels which identify the jobs for a claim's hook. The event is the one which the
+// job was first run for.
+func jobLabels(claim *unstructured.Unstructured, event v1alpha1.EventName, hookIndex int) map[string]string {
+	return map[string]string{
+		LabelClaimUID:  string(claim.GetUID()),
+		LabelEvent:     string(event),
+		LabelHookIndex: strconv.Itoa(hookIndex),
+	}
+}
+
+// runJob creates the given job, unless a job with the same name already exists, and returns the
+// status of whichever job is running the hook. Job names are deterministic, so an existing job with
+// the same name was created from the same inputs.
+//
+// Once the job has succeeded, the objects which it applied are read from its inventory.
+func runJob(ctx context.Context, kube client.Client, job *batchv1.Job) (*v1alpha1.HookStatus, error) {
+	existing := &batchv1.Job{}
+	err := kube.Get(ctx, types.NamespacedName{Namespace: job.GetNamespace(), Name: job.GetName()}, existing)
+	if err == nil {
+		hs := HookStatusFromJob(existing)
+		if hs.Phase == v1alpha1.HookPhaseSucceeded {
+			if hs.Resources, err = readInventory(ctx, kube, existing); err != nil {
+				return nil, err
+			}
+		}
+		return hs, nil
+	}
+	if !kerrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	// The job fills in the inventory, but the config map is created here so that it has an owner.
+	if err := kube.Create(ctx, inventoryConfigMap(job)); err != nil && !kerrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	if err := kube.Create(ctx, job); err != nil {
+		if !kerrors.IsAlreadyExists(err) {
+			return nil, err
+		}
+		// Someone else created the job between our lookup and our create, which is fine,
+		// because it will have been created from the same inputs.
+	}
+
+	return HookStatusFromJob(job), nil
+}
+
+// newRenderJob builds the job which runs a hook using a job-based engine. The job has three steps:
+// - The hook's directory is loaded from the stack's source
+// - The engine container renders resources from the stack's files and the engine configuration
+// - The rendered resources are applied, or deleted for the delete event
+//
+// Engines only need to provide the name, image, command and arguments of their engine container. The
+// rest of the containers' settings come from the image options, unless the hook overrides them. The job
+// runs as the given service account, so it can only apply what the stack's permissions allow.
+//
+// The job and its inventory are always in the claim's namespace, but a release can have the rendered
+// resources applied in another namespace.
+func newRenderJob(
+	claim *unstructured.Unstructured,
+	config *corev1.ConfigMap,
+	stackSource string,
+	event v1alpha1.EventName,
+	hookIndex int,
+	hc *v1alpha1.HookConfiguration,
+	engine corev1.Container,
+	images ImageOptions,
+	serviceAccountName string,
+	refs []Reference,
+	rel *release,
+) (*batchv1.Job, error) {
+	// The claim is the controller of the job, so that the render controller, which Owns jobs, is
+	// notified as the job progresses and can update the claim's status.
+	ownerRef := meta.AsController(meta.ReferenceTo(claim, claim.GroupVersionKind()))
+	var jobBackoff int32
+
+	// TODO target stack image will come from the stack object, or maybe the stack install object.
+	// Then for each resource behavior hook, we want to run the hook
+	// TODO update this to use the most recent format, where a hook is a structured object
+
+	namespace := claim.GetNamespace()
+
+	applierImage := images.applierImage(hc)
+	pullPolicy := images.imagePullPolicy(hc)
+	pullSecrets := images.imagePullSecrets(hc)
+
+	// Callers pass the hook's image as the stack source. Hooks whose stack doesn't come from an image are
+	// loaded from the hook's source instead.
+	source := hc.Source
+	if stackSource != "" {
+		source = v1alpha1.StackConfigurationSource{Image: stackSource}
+	}
+	loadStack, sourceVolumes := loadStackContainer(source, hc.Directory, images, pullPolicy)
+
+	name, err := jobName(claim, event, hookIndex, config, source, hc, engine.Image, applierImage, pullPolicy, pullSecrets, serviceAccountName, refs, rel)
+	if err != nil {
+		return nil, err
+	}
+
+	engine.VolumeMounts = []corev1.VolumeMount{
+		{
+			Name:      stackVolumeName,
+			MountPath: stackDestDir,
+		},
+		{
+			Name:      resourceCfgVolumeName,
+			MountPath: resourceCfgDestDir,
+		},
+		{
+			Name:      engineCfgVolumeName,
+			MountPath: engineCfgDir,
+		},
+	}
+	engine.ImagePullPolicy = pullPolicy
+
+	// Only the engine sees the referenced secrets and config maps.
+	refVolumes, refMounts := referenceVolumes(refs)
+	engine.VolumeMounts = append(engine.VolumeMounts, refMounts...)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    jobLabels(claim, event, hookIndex),
+			OwnerReferences: []metav1.OwnerReference{
+				ownerRef,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &jobBackoff,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: serviceAccountName,
+					ImagePullSecrets:   pullSecrets,
+					InitContainers: []corev1.Container{
+						loadStack,
+						engine,
+					},
+					Containers: []corev1.Container{
+						{
+							Name:  "kubectl",
+							Image: applierImage,
+							Command: []string{
+								"sh", "-c",
+							},
+							Args: []string{applierScript(event)},
+							Env: []corev1.EnvVar{
+								{Name: "NAMESPACE", Value: rel.namespace(claim)},
+								{Name: "RESOURCE_DIR", Value: resourceCfgDestDir},
+								{Name: "FIELD_MANAGER", Value: FieldManager(claim, hookIndex)},
+								{Name: "INVENTORY", Value: name},
+								{Name: "INVENTORY_NAMESPACE", Value: namespace},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      resourceCfgVolumeName,
+									MountPath: resourceCfgDestDir,
+								},
+							},
+							ImagePullPolicy: pullPolicy,
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: stackVolumeName,
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+						{
+							Name: resourceCfgVolumeName,
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+						{
+							Name: engineCfgVolumeName,
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: config.GetName(),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, refVolumes...)
+	job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, sourceVolumes...)
+
+	return job, nil
+}
+
+// applierScript returns the script which acts on the rendered resources for an event. Resources are
+// applied for every event except for delete, when they are deleted instead.
+//
+// Resources are applied with server-side apply, and the objects which were applied are recorded in the
+// job's inventory config map, so that the controller can prune the objects which are no longer rendered.
+// The inventory is applied with server-side apply as well, so that the owner which the controller gave the
+// config map is kept.
+func applierScript(event v1alpha1.EventName) string {
+	if event == v1alpha1.EventDelete {
+		return `kubectl delete --namespace "$NAMESPACE" --ignore-not-found -R -f "$RESOURCE_DIR"`
+	}
+
+	return `set -e
+kubectl apply --server-side --force-conflicts --field-manager "$FIELD_MANAGER" --namespace "$NAMESPACE" -R -f "$RESOURCE_DIR" \
+  -o jsonpath='` + inventoryJSONPath + `' > /tmp/inventory
+kubectl create configmap "$INVENTORY" --namespace "$INVENTORY_NAMESPACE" --from-file=` + inventoryKey + `=/tmp/inventory --dry-run=client -o yaml \
+  | kubectl apply --server-side --force-conflicts --field-manager "$FIELD_MANAGER" -f -
+`
+}
+
+// HookStatusFromJob summarizes the progress of a Job which is executing a hook.
+//
+// Render jobs are created with a backoff limit of zero, so a single failed pod
+// means that the job has failed.
+func HookStatusFromJob(job *batchv1.Job) *v1alpha1.HookStatus {
+	hs := &v1alpha1.HookStatus{
+		JobName: job.GetName(),
+	}
+
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		switch c.Type {
+		case batchv1.JobComplete:
+			hs.Phase = v1alpha1.HookPhaseSucceeded
+			hs.SetConditions(runtimev1alpha1.Available())
+			return hs
+		case batchv1.JobFailed:
+			hs.Phase = v1alpha1.HookPhaseFailed
+			hs.Message = c.Message
+			hs.SetConditions(runtimev1alpha1.Unavailable().WithMessage(c.Message))
+			return hs
+		}
+	}
+
+	switch {
+	case job.Status.Succeeded > 0:
+		hs.Phase = v1alpha1.HookPhaseSucceeded
+		hs.SetConditions(runtimev1alpha1.Available())
+	case job.Status.Failed > 0:
+		hs.Phase = v1alpha1.HookPhaseFailed
+		hs.Message = "the job's pod failed"
+		hs.SetConditions(runtimev1alpha1.Unavailable().WithMessage(hs.Message))
+	default:
+		hs.Phase = v1alpha1.HookPhaseRunning
+		hs.SetConditions(runtimev1alpha1.Creating())
+	}
+
+	return hs
+}
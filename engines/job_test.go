@@ -0,0 +1,95 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+func TestJobName(t *testing.T) {
+	config := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "widget-config"}}
+	source := v1alpha1.StackConfigurationSource{Image: "example.org/widget-stack:v1"}
+
+	type inputs struct {
+		event          v1alpha1.EventName
+		hc             v1alpha1.HookConfiguration
+		engineImage    string
+		pullPolicy     corev1.PullPolicy
+		pullSecrets    []corev1.LocalObjectReference
+		serviceAccount string
+	}
+	base := inputs{
+		event:          v1alpha1.EventCreate,
+		hc:             v1alpha1.HookConfiguration{Directory: "widget", Engine: v1alpha1.ResourceEngineConfiguration{Type: Helm3EngineType}},
+		engineImage:    helm3EngineImage,
+		pullPolicy:     corev1.PullIfNotPresent,
+		serviceAccount: "stack-default-widgets",
+	}
+
+	cases := map[string]struct {
+		change func(in *inputs)
+		same   bool
+	}{
+		"Unchanged": {
+			change: func(in *inputs) {},
+			same:   true,
+		},
+		"NextEventWithTheSameScript": {
+			change: func(in *inputs) { in.event = v1alpha1.EventUpdate },
+			same:   true,
+		},
+		"Directory": {
+			change: func(in *inputs) { in.hc.Directory = "gadget" },
+		},
+		"EngineImage": {
+			change: func(in *inputs) { in.engineImage = "example.org/helm:v3.1" },
+		},
+		"ImagePullPolicy": {
+			change: func(in *inputs) { in.pullPolicy = corev1.PullAlways },
+		},
+		"ImagePullSecrets": {
+			change: func(in *inputs) { in.pullSecrets = []corev1.LocalObjectReference{{Name: "registry"}} },
+		},
+		"ServiceAccountName": {
+			change: func(in *inputs) { in.serviceAccount = "stack-default-gadgets" },
+		},
+	}
+
+	nameOf := func(in inputs) string {
+		got, err := jobName(valuesClaim(), in.event, 0, config, source, &in.hc, in.engineImage, "bitnami/kubectl:1.17",
+			in.pullPolicy, in.pullSecrets, in.serviceAccount, nil, nil)
+		if err != nil {
+			t.Fatalf("jobName(...): %v", err)
+		}
+		return got
+	}
+	want := nameOf(base)
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := base
+			tc.change(&in)
+			if got := nameOf(in); (got == want) != tc.same {
+				t.Errorf("jobName(...): got %q, base name %q, want same: %t", got, want, tc.same)
+			}
+		})
+	}
+}
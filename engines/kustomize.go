@@ -0,0 +1,192 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package engines
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// KustomizeEngineRunner renders a kustomization directory which is shipped by a stack.
+//
+// The claim is passed to kustomize by generating an overlay on top of the stack's kustomization.
+// The overlay includes a copy of the claim, which is marked as local configuration so that kustomize
+// uses it as input but leaves it out of the rendered resources. This means the claim can be used as
+// the source of replacements. If the stack's directory has a file named claim-replacements.yaml,
+// its replacements are added to the overlay. For example, to use a field of a SampleClaim as the
+// value of a field in a ConfigMap:
+//
+//   - source:
+//       kind: SampleClaim
+//       fieldPath: spec.config.mode
+//     targets:
+//     - select:
+//         kind: ConfigMap
+//       fieldPaths:
+//       - data.configmode
+//
+// The overlay also sets the namespace of all of the rendered resources to the claim's namespace.
+type KustomizeEngineRunner struct {
+	Log                logr.Logger
+	Images             ImageOptions
+	ServiceAccountName string
+}
+
+const (
+	KustomizeEngineType  = "kustomize"
+	kustomizeEngineImage = "crossplane/kustomize-engine:latest"
+
+	kustomizationFile     = "kustomization.yaml"
+	kustomizeClaimFile    = "claim.yaml"
+	claimReplacementsFile = "claim-replacements.yaml"
+
+	// Resources with this annotation are used as input by kustomize, but are not included in its output.
+	localConfigAnnotation = "config.kubernetes.io/local-config"
+)
+
+func init() {
+	Register(Engine{
+		Type:           KustomizeEngineType,
+		DefaultImage:   kustomizeEngineImage,
+		ConfigFileName: kustomizationFile,
+		New: func(opts EngineOptions) ResourceEngineRunner {
+			return NewKustomizeEngineRunner(opts.Log, opts.Images, opts.ServiceAccountName)
+		},
+	})
+}
+
+func (ker *KustomizeEngineRunner) CreateConfig(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration) (*corev1.ConfigMap, error) {
+	if _, ok := claim.Object[spec]; !ok && len(hc.Values) == 0 {
+		ker.Log.V(0).Info("Spec not found on claim; the claim will be passed to kustomize without one", "claim", claim)
+	}
+
+	// The local copy of the claim has the engine's inputs as its spec, so that the stack's replacements can
+	// refer to them.
+	s, err := claimValues(claim, hc)
+	if err != nil {
+		ker.Log.V(0).Info("Error mapping claim to engine values!", "claim", claim, "error", err)
+		return nil, err
+	}
+
+	localClaim := map[string]interface{}{
+		"apiVersion": claim.GetAPIVersion(),
+		"kind":       claim.GetKind(),
+		"metadata": map[string]interface{}{
+			"name":      claim.GetName(),
+			"namespace": claim.GetNamespace(),
+			"annotations": map[string]interface{}{
+				localConfigAnnotation: "true",
+			},
+		},
+		spec: s,
+	}
+
+	claimContents, err := yaml.Marshal(localClaim)
+	if err != nil {
+		ker.Log.Error(err, "Error marshaling claim as yaml!", "claim", claim)
+		return nil, err
+	}
+
+	kustomization := map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"namespace":  claim.GetNamespace(),
+		"resources": []string{
+			stackDestDir,
+			kustomizeClaimFile,
+		},
+	}
+
+	kustomizationContents, err := yaml.Marshal(kustomization)
+	if err != nil {
+		ker.Log.Error(err, "Error marshaling kustomization as yaml!", "claim", claim)
+		return nil, err
+	}
+
+	return engineConfigMap(claim, map[string]string{
+		kustomizationFile:  string(kustomizationContents),
+		kustomizeClaimFile: string(claimContents),
+	}, ker.Log)
+}
+
+func (ker *KustomizeEngineRunner) RunEngine(ctx context.Context, client client.Client, claim *unstructured.Unstructured, config *corev1.ConfigMap, stackSource string, event v1alpha1.EventName, hookIndex int, hc *v1alpha1.HookConfiguration) (*v1alpha1.HookStatus, error) {
+	job, err := newRenderJob(claim, config, stackSource, event, hookIndex, hc, ker.engine(hc), ker.Images, ker.ServiceAccountName, nil, nil)
+	if err != nil {
+		ker.Log.V(1).Info("Error generating render job", "claim", claim.GetNamespace()+"/"+claim.GetName(), "error", err)
+		return nil, err
+	}
+
+	return runJob(ctx, client, job)
+}
+
+// PlanEngine runs a plan job for the hook, which renders the hook's resources without applying them.
+func (ker *KustomizeEngineRunner) PlanEngine(ctx context.Context, client client.Client, claim *unstructured.Unstructured, config *corev1.ConfigMap, stackSource string, event v1alpha1.EventName, hookIndex int, hc *v1alpha1.HookConfiguration) (*v1alpha1.HookPlan, error) {
+	job, err := newRenderJob(claim, config, stackSource, event, hookIndex, hc, ker.engine(hc), ker.Images, ker.ServiceAccountName, nil, nil)
+	if err != nil {
+		ker.Log.V(1).Info("Error generating plan job", "claim", claim.GetNamespace()+"/"+claim.GetName(), "error", err)
+		return nil, err
+	}
+
+	return runPlanJob(ctx, client, job)
+}
+
+// RenderLocal runs kustomize on the local machine, rather than in a job.
+func (ker *KustomizeEngineRunner) RenderLocal(ctx context.Context, claim *unstructured.Unstructured, config *corev1.ConfigMap, hc *v1alpha1.HookConfiguration, opts LocalOptions) ([]*unstructured.Unstructured, error) {
+	return renderContainerLocally(ctx, ker.engine(hc), claim, config, hc, nil, opts)
+}
+
+// engine returns the container which runs kustomize in a render job.
+func (ker *KustomizeEngineRunner) engine(hc *v1alpha1.HookConfiguration) corev1.Container {
+	// The engine configuration is mounted from a config map, which is read only, so the overlay is
+	// copied somewhere writable before the stack's replacements are added to it. The overlay refers to
+	// the stack's files by absolute path, which kustomize only allows if load restrictions are disabled.
+	overlayDir := scratchDir + "overlay/"
+	stackReplacements := stackDestDir + claimReplacementsFile
+	script := fmt.Sprintf(`set -e
+mkdir -p %[1]s
+cp %[2]s%[3]s %[2]s%[4]s %[1]s
+if [ -f %[5]s ]; then
+  printf 'replacements:\n- path: %[5]s\n' >> %[1]s%[3]s
+fi
+kustomize build --load-restrictor LoadRestrictionsNone --output %[6]s %[1]s
+`, overlayDir, engineCfgDir, kustomizationFile, kustomizeClaimFile, stackReplacements, resourceCfgDestDir)
+
+	return corev1.Container{
+		Name:  "engine",
+		Image: ker.Images.engineImage(hc),
+		Command: []string{
+			"sh", "-c",
+		},
+		Args: []string{
+			script,
+		},
+	}
+}
+
+func NewKustomizeEngineRunner(log logr.Logger, images ImageOptions, serviceAccountName string) *KustomizeEngineRunner {
+	return &KustomizeEngineRunner{
+		Log:                log,
+		Images:             images,
+		ServiceAccountName: serviceAccountName,
+	}
+}
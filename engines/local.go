@@ -0,0 +1,229 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// Stack authors can render a hook on their own machine, to see what a claim renders to without a cluster.
+// The engine is configured from the claim in the same way as it is in the controller, and then:
+// - The gotemplate engine executes its templates, as it does inside of the controller
+// - Engines which render in jobs run the command of their engine container, with the directories which are
+//   mounted in the job replaced by local ones. The engine's tools, such as helm or kustomize, have to be
+//   on the PATH.
+//
+// Nothing is applied; the rendered objects are returned instead. As in the controller, objects without a
+// namespace are put in the claim's namespace, even if they turn out to be cluster-scoped.
+
+// LocalOptions configure a local render.
+type LocalOptions struct {
+	Log logr.Logger
+
+	// ConfigName is the stack configuration which the hook is configured by.
+	ConfigName types.NamespacedName
+
+	// StackRoot is a local copy of the stack's files, laid out in the same way as they are under the
+	// registry root of the stack image.
+	StackRoot string
+
+	// ReferencesDir has the secrets and config maps which the claim references. See LocalReferences.
+	ReferencesDir string
+
+	// WorkDir is where engines write their configuration and the resources which they render.
+	WorkDir string
+}
+
+// A LocalRenderer is an engine runner which can render a hook without a cluster.
+type LocalRenderer interface {
+	RenderLocal(
+		ctx context.Context,
+		claim *unstructured.Unstructured,
+		config *corev1.ConfigMap,
+		hc *v1alpha1.HookConfiguration,
+		opts LocalOptions,
+	) ([]*unstructured.Unstructured, error)
+}
+
+// RenderLocal renders a resolved hook for a claim on the local machine, and returns the rendered objects.
+func RenderLocal(
+	ctx context.Context, claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration, opts LocalOptions,
+) ([]*unstructured.Unstructured, error) {
+	engine, err := Lookup(hc.Engine.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := LocalReferences(claim, hc, opts.ReferencesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	runner := engine.New(EngineOptions{
+		Log:          opts.Log,
+		ConfigName:   opts.ConfigName,
+		RegistryRoot: opts.StackRoot,
+		Images:       DefaultImageOptions(),
+		References:   refs,
+	})
+
+	lr, ok := runner.(LocalRenderer)
+	if !ok {
+		return nil, fmt.Errorf("engine type %q can't render locally", hc.Engine.Type)
+	}
+
+	config, err := runner.CreateConfig(claim, hc)
+	if err != nil {
+		return nil, err
+	}
+
+	return lr.RenderLocal(ctx, claim, config, hc, opts)
+}
+
+// renderContainerLocally runs the command of an engine container on the local machine, and decodes what it
+// renders. The directories which the container would have mounted are set up under the work directory,
+// except for the stack's directory, which is used where it is.
+func renderContainerLocally(
+	ctx context.Context,
+	engine corev1.Container,
+	claim *unstructured.Unstructured,
+	config *corev1.ConfigMap,
+	hc *v1alpha1.HookConfiguration,
+	refs []Reference,
+	opts LocalOptions,
+) ([]*unstructured.Unstructured, error) {
+	// The engine's configuration may refer to the stack's directory from elsewhere, so its path has to be
+	// absolute.
+	stackDir, err := filepath.Abs(filepath.Join(opts.StackRoot, hc.Directory))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(stackDir); err != nil {
+		return nil, err
+	}
+
+	cfgDir := filepath.Join(opts.WorkDir, engineCfgVolumeName)
+	outputDir := filepath.Join(opts.WorkDir, resourceCfgVolumeName)
+	refsDir := filepath.Join(opts.WorkDir, "references")
+	tmpDir := filepath.Join(opts.WorkDir, "scratch")
+
+	for _, dir := range []string{cfgDir, outputDir, refsDir, tmpDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// The job's directories all end with a slash, and none of them is a prefix of another, so they can be
+	// replaced wherever they appear in the command, and in the engine's configuration.
+	local := strings.NewReplacer(
+		stackDestDir, stackDir+string(filepath.Separator),
+		engineCfgDir, cfgDir+string(filepath.Separator),
+		resourceCfgDestDir, outputDir+string(filepath.Separator),
+		referencesDir, refsDir+string(filepath.Separator),
+		scratchDir, tmpDir+string(filepath.Separator),
+	)
+
+	if config != nil {
+		for name, contents := range config.Data {
+			if err := ioutil.WriteFile(filepath.Join(cfgDir, name), []byte(local.Replace(contents)), 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, ref := range refs {
+		dir := filepath.Join(refsDir, ref.Name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		for key, contents := range ref.Data {
+			if err := ioutil.WriteFile(filepath.Join(dir, key), []byte(contents), 0600); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	command := make([]string, 0, len(engine.Command)+len(engine.Args))
+	for _, arg := range append(engine.Command, engine.Args...) {
+		command = append(command, local.Replace(arg))
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("engine type %q has no command", hc.Engine.Type)
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running %s: %v: %s", command[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return DecodeDirectory(outputDir, claim.GetNamespace())
+}
+
+// DecodeDirectory decodes the objects in the YAML files under a directory, in the order of the files' paths.
+// Objects without a namespace are put in the given namespace.
+func DecodeDirectory(dir string, namespace string) ([]*unstructured.Unstructured, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+			if !info.IsDir() {
+				files = append(files, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	objs := make([]*unstructured.Unstructured, 0)
+	for _, path := range files {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := decodeObjects(string(contents), namespace)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		objs = append(objs, decoded...)
+	}
+
+	return objs, nil
+}
@@ -0,0 +1,182 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// Planning a hook renders its resources in the same way as running it does, but nothing is changed:
+// - Engines which render in jobs run a plan job, whose applier applies the rendered resources with a
+//   server-side dry run, and runs kubectl diff against them. The objects which would be applied are
+//   recorded in the job's inventory, along with which of them would be created or updated, and the diff
+//   itself. kubectl masks the data of secrets in its diffs.
+// - The gotemplate engine applies the rendered resources with a server-side dry run, and compares the
+//   results with the objects in the cluster.
+
+const (
+	// Keys of the inventory of a plan job.
+	changesKey = "changes"
+	diffKey    = "diff"
+
+	// Diffs are cut short so that they fit in the inventory config map.
+	maxDiffBytes = 512 * 1024
+
+	// Plan jobs are named after the job which would run the hook, with this suffix.
+	planJobSuffix = "-plan"
+)
+
+// LabelPlan is put on plan jobs, to tell them apart from the jobs which run hooks.
+var LabelPlan = v1alpha1.GroupVersion.Group + "/plan"
+
+// PlanID returns the ID of a claim's plan, which is a hash of what the plan would change. Plans with the same
+// changes for the same generation of a claim have the same ID.
+func PlanID(plan *v1alpha1.ClaimPlan) (string, error) {
+	return hashObject(struct {
+		Event      v1alpha1.EventName  `json:"event"`
+		Generation int64               `json:"generation"`
+		Hooks      []v1alpha1.HookPlan `json:"hooks"`
+	}{plan.Event, plan.Generation, plan.Hooks})
+}
+
+// runPlanJob turns a render job into one which plans the hook, and returns the plan once the job has
+// finished.
+func runPlanJob(ctx context.Context, kube client.Client, job *batchv1.Job) (*v1alpha1.HookPlan, error) {
+	job = planJob(job)
+
+	hs, err := runJob(ctx, kube, job)
+	if err != nil {
+		return nil, err
+	}
+
+	hp := &v1alpha1.HookPlan{
+		Phase:     hs.Phase,
+		JobName:   hs.JobName,
+		Resources: hs.Resources,
+		Message:   hs.Message,
+	}
+	if hp.Phase != v1alpha1.HookPhaseSucceeded {
+		return hp, nil
+	}
+
+	data, err := readInventoryData(ctx, kube, job)
+	if err != nil {
+		return nil, err
+	}
+
+	byDiffName := make(map[string]corev1.ObjectReference, len(hp.Resources))
+	for _, ref := range hp.Resources {
+		byDiffName[diffName(ref)] = ref
+	}
+
+	for _, line := range strings.Split(data[changesKey], "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+
+		ref, ok := byDiffName[fields[1]]
+		if !ok {
+			continue
+		}
+
+		switch fields[0] {
+		case "create":
+			hp.Create = append(hp.Create, ref)
+		case "update":
+			hp.Update = append(hp.Update, ref)
+		}
+	}
+
+	return hp, nil
+}
+
+// planJob changes a render job into a plan job. The job is given its own name, so that it doesn't get mixed
+// up with the job which runs the hook with the same inputs.
+func planJob(job *batchv1.Job) *batchv1.Job {
+	job.SetName(job.GetName() + planJobSuffix)
+
+	labels := job.GetLabels()
+	labels[LabelPlan] = "true"
+	job.SetLabels(labels)
+
+	// The applier is the only one of the job's containers.
+	applier := &job.Spec.Template.Spec.Containers[0]
+	applier.Args = []string{planScript()}
+	for i := range applier.Env {
+		if applier.Env[i].Name == "INVENTORY" {
+			applier.Env[i].Value = job.GetName()
+		}
+	}
+
+	return job
+}
+
+// planScript returns the applier script of a plan job. kubectl diff exits with 1 when there are differences,
+// and with more than 1 when it fails. The changes are found from the headers of the diff before it is cut
+// short: the hunk of an object which doesn't exist yet starts at line 0 of the live object.
+func planScript() string {
+	return `set -e
+kubectl apply --server-side --dry-run=server --force-conflicts --field-manager "$FIELD_MANAGER" --namespace "$NAMESPACE" -R -f "$RESOURCE_DIR" \
+  -o jsonpath='` + inventoryJSONPath + `' > /tmp/inventory
+status=0
+kubectl diff --server-side --force-conflicts --field-manager "$FIELD_MANAGER" --namespace "$NAMESPACE" -R -f "$RESOURCE_DIR" > /tmp/diff.full || status=$?
+[ "$status" -le 1 ]
+awk '/^\+\+\+ / { n = split($2, path, "/"); name = path[n]; getline; if ($0 ~ /^@@ -0,0 /) print "create\t" name; else print "update\t" name }' /tmp/diff.full > /tmp/changes
+head -c ` + strconv.Itoa(maxDiffBytes) + ` /tmp/diff.full > /tmp/diff
+kubectl create configmap "$INVENTORY" --namespace "$INVENTORY_NAMESPACE" --from-file=` + inventoryKey + `=/tmp/inventory \
+  --from-file=` + changesKey + `=/tmp/changes --from-file=` + diffKey + `=/tmp/diff --dry-run=client -o yaml \
+  | kubectl apply --server-side --force-conflicts --field-manager "$FIELD_MANAGER" -f -
+`
+}
+
+// diffName returns the name which kubectl diff gives the files of an object.
+func diffName(ref corev1.ObjectReference) string {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return ""
+	}
+
+	group := ""
+	if gv.Group != "" {
+		group = gv.Group + "."
+	}
+	return fmt.Sprintf("%s%s.%s.%s.%s", group, gv.Version, ref.Kind, ref.Namespace, ref.Name)
+}
+
+// sameObject returns true if an object which was applied with a dry run is the same as the live object,
+// ignoring the metadata which changes whenever an object is written.
+func sameObject(live, applied *unstructured.Unstructured) bool {
+	a, b := live.DeepCopy(), applied.DeepCopy()
+	for _, obj := range []*unstructured.Unstructured{a, b} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+		unstructured.RemoveNestedField(obj.Object, "metadata", "resourceVersion")
+		unstructured.RemoveNestedField(obj.Object, "metadata", "generation")
+	}
+	return equality.Semantic.DeepEqual(a.Object, b.Object)
+}
@@ -0,0 +1,142 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// planScriptAwk returns the awk program which the plan script finds the changes in a diff with.
+func planScriptAwk(t *testing.T) string {
+	for _, line := range strings.Split(planScript(), "\n") {
+		if !strings.HasPrefix(line, "awk '") {
+			continue
+		}
+		program := strings.TrimPrefix(line, "awk '")
+		end := strings.LastIndex(program, "'")
+		if end < 0 {
+			t.Fatalf("cannot find the end of the awk program in %q", line)
+		}
+		return program[:end]
+	}
+	t.Fatal("the plan script doesn't run awk")
+	return ""
+}
+
+func TestPlanScriptChanges(t *testing.T) {
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("awk is not installed")
+	}
+
+	deployment := corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "web"}
+	configMap := corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "settings"}
+
+	cases := map[string]struct {
+		diff    string
+		changes string
+	}{
+		"NoDifferences": {
+			diff:    "",
+			changes: "",
+		},
+		"UpdatedObject": {
+			diff: `diff -u -N /tmp/LIVE-123/` + diffName(deployment) + ` /tmp/MERGED-123/` + diffName(deployment) + `
+--- /tmp/LIVE-123/` + diffName(deployment) + `	2020-01-01 00:00:00.000000000 +0000
++++ /tmp/MERGED-123/` + diffName(deployment) + `	2020-01-01 00:00:00.000000000 +0000
+@@ -6,7 +6,7 @@
+ spec:
+-  replicas: 1
++  replicas: 3
+`,
+			changes: "update\t" + diffName(deployment) + "\n",
+		},
+		"CreatedObject": {
+			diff: `diff -u -N /tmp/LIVE-123/` + diffName(configMap) + ` /tmp/MERGED-123/` + diffName(configMap) + `
+--- /tmp/LIVE-123/` + diffName(configMap) + `	2020-01-01 00:00:00.000000000 +0000
++++ /tmp/MERGED-123/` + diffName(configMap) + `	2020-01-01 00:00:00.000000000 +0000
+@@ -0,0 +1,6 @@
++apiVersion: v1
++data:
++  size: "3"
++kind: ConfigMap
+`,
+			changes: "create\t" + diffName(configMap) + "\n",
+		},
+		"CreatedAndUpdatedObjects": {
+			diff: `diff -u -N /tmp/LIVE-123/` + diffName(deployment) + ` /tmp/MERGED-123/` + diffName(deployment) + `
+--- /tmp/LIVE-123/` + diffName(deployment) + `	2020-01-01 00:00:00.000000000 +0000
++++ /tmp/MERGED-123/` + diffName(deployment) + `	2020-01-01 00:00:00.000000000 +0000
+@@ -6,7 +6,7 @@
+-  replicas: 1
++  replicas: 3
+diff -u -N /tmp/LIVE-123/` + diffName(configMap) + ` /tmp/MERGED-123/` + diffName(configMap) + `
+--- /tmp/LIVE-123/` + diffName(configMap) + `	2020-01-01 00:00:00.000000000 +0000
++++ /tmp/MERGED-123/` + diffName(configMap) + `	2020-01-01 00:00:00.000000000 +0000
+@@ -0,0 +1,2 @@
++apiVersion: v1
++kind: ConfigMap
+`,
+			changes: "update\t" + diffName(deployment) + "\ncreate\t" + diffName(configMap) + "\n",
+		},
+	}
+
+	program := planScriptAwk(t)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command("awk", program)
+			cmd.Stdin = strings.NewReader(tc.diff)
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("awk: %v", err)
+			}
+			if string(out) != tc.changes {
+				t.Errorf("got changes %q, want %q", out, tc.changes)
+			}
+		})
+	}
+}
+
+func TestDiffName(t *testing.T) {
+	cases := map[string]struct {
+		ref  corev1.ObjectReference
+		want string
+	}{
+		"CoreGroup": {
+			ref:  corev1.ObjectReference{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "settings"},
+			want: "v1.ConfigMap.default.settings",
+		},
+		"NamedGroup": {
+			ref:  corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "web"},
+			want: "apps.v1.Deployment.default.web",
+		},
+		"ClusterScoped": {
+			ref:  corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: "team"},
+			want: "v1.Namespace..team",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := diffName(tc.ref); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// A hook can reference secrets and config maps which the claim names, so that credentials and large
+// configuration don't have to be put in the claim's spec. The contents of the referenced objects are never
+// copied into an engine's configuration map:
+// - Engines which run in jobs mount the objects in the engine's container, in a directory for each
+//   reference under referencesDir. The helm engines also pass each file to the chart with --set-file.
+// - The gotemplate engine adds the contents to the data which its templates are executed against.
+//
+// Either way, the contents are found at references.<name>.<key>.
+//
+// A HelmChartInstall can reference values files as well. They are mounted in the same way, but they are
+// passed to the chart with --values instead, so their contents are merged into the chart's values.
+
+const (
+	referencesDir       = "/usr/share/references/"
+	referencesValuesKey = "references"
+)
+
+// A Reference is a secret or config map which a hook references, resolved for a claim.
+type Reference struct {
+	v1alpha1.ResourceReference
+
+	// ObjectName is the name of the referenced object, in the claim's namespace.
+	ObjectName string
+
+	// ResourceVersion is the version of the object which was resolved, so that hooks can be run again when
+	// the object changes.
+	ResourceVersion string
+
+	// Data is the contents of the object, by key. The data of secrets is decoded.
+	Data map[string]string
+
+	// ValuesKey is the key of the values file in the object, if the object is a values file for a chart.
+	ValuesKey string
+}
+
+// Keys returns the keys of the referenced object's data, in order.
+func (r *Reference) Keys() []string {
+	keys := make([]string, 0, len(r.Data))
+	for k := range r.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ResolveReferences finds the objects which a hook references for the given claim. The client should act as
+// the stack's service account, so that hooks can only reference what the stack's permissions allow. An
+// error is returned if an object which isn't optional can't be found.
+func ResolveReferences(
+	ctx context.Context, kube client.Client, claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration,
+) ([]Reference, error) {
+	refs := make([]Reference, 0, len(hc.References))
+
+	for _, rr := range hc.References {
+		objectName, ok, err := referencedName(claim, rr)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		obj, err := getReferencedObject(ctx, kube, rr.Kind, claim.GetNamespace(), objectName)
+		if kerrors.IsNotFound(err) && rr.Optional {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("references[%s]: %s %s/%s: %v", rr.Name, rr.Kind, claim.GetNamespace(), objectName, err)
+		}
+
+		data, err := referenceData(obj)
+		if err != nil {
+			return nil, fmt.Errorf("references[%s]: %v", rr.Name, err)
+		}
+
+		refs = append(refs, Reference{
+			ResourceReference: rr,
+			ObjectName:        objectName,
+			ResourceVersion:   obj.GetResourceVersion(),
+			Data:              data,
+		})
+	}
+
+	return refs, nil
+}
+
+// ResolveValuesFrom finds the values files which a HelmChartInstall references in its namespace. Each one is
+// resolved as a reference named values-<index>, in order. An error is returned if a values file which isn't
+// optional can't be found.
+func ResolveValuesFrom(
+	ctx context.Context, kube client.Client, namespace string, vrs []v1alpha1.ValuesReference,
+) ([]Reference, error) {
+	refs := make([]Reference, 0, len(vrs))
+
+	for i, vr := range vrs {
+		key := vr.Key
+		if key == "" {
+			key = valuesFile
+		}
+
+		if vr.Kind != v1alpha1.ReferenceKindSecret && vr.Kind != v1alpha1.ReferenceKindConfigMap {
+			return nil, fmt.Errorf("valuesFrom[%d]: kind must be %s or %s", i, v1alpha1.ReferenceKindSecret, v1alpha1.ReferenceKindConfigMap)
+		}
+
+		obj, err := getReferencedObject(ctx, kube, vr.Kind, namespace, vr.Name)
+		if kerrors.IsNotFound(err) && vr.Optional {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("valuesFrom[%d]: %s %s/%s: %v", i, vr.Kind, namespace, vr.Name, err)
+		}
+
+		data, err := referenceData(obj)
+		if err != nil {
+			return nil, fmt.Errorf("valuesFrom[%d]: %v", i, err)
+		}
+
+		if _, ok := data[key]; !ok {
+			if vr.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("valuesFrom[%d]: %s %s/%s has no key %s", i, vr.Kind, namespace, vr.Name, key)
+		}
+
+		refs = append(refs, Reference{
+			ResourceReference: v1alpha1.ResourceReference{
+				Name:     fmt.Sprintf("values-%d", i),
+				Kind:     vr.Kind,
+				Optional: vr.Optional,
+			},
+			ObjectName:      vr.Name,
+			ResourceVersion: obj.GetResourceVersion(),
+			Data:            data,
+			ValuesKey:       key,
+		})
+	}
+
+	return refs, nil
+}
+
+// getReferencedObject reads a secret or config map. The object is read as an unstructured object, so that it
+// is read from the api server rather than from a cache. Otherwise, every secret in the cluster would be
+// cached.
+func getReferencedObject(ctx context.Context, kube client.Client, kind, namespace, name string) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind(kind))
+
+	err := kube.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj)
+	return obj, err
+}
+
+// LocalReferences finds the objects which a hook references for the given claim in a local directory, rather
+// than in the api server. The directory has a directory for each object, named after the object, with a file
+// for each key of the object's data.
+func LocalReferences(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration, dir string) ([]Reference, error) {
+	refs := make([]Reference, 0, len(hc.References))
+
+	for _, rr := range hc.References {
+		objectName, ok, err := referencedName(claim, rr)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		objectDir := filepath.Join(dir, objectName)
+		files, err := ioutil.ReadDir(objectDir)
+		if (dir == "" || os.IsNotExist(err)) && rr.Optional {
+			continue
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("references[%s]: no references directory was given for %s %s", rr.Name, rr.Kind, objectName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("references[%s]: %v", rr.Name, err)
+		}
+
+		data := make(map[string]string, len(files))
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+
+			contents, err := ioutil.ReadFile(filepath.Join(objectDir, f.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("references[%s]: %v", rr.Name, err)
+			}
+			data[f.Name()] = string(contents)
+		}
+
+		refs = append(refs, Reference{
+			ResourceReference: rr,
+			ObjectName:        objectName,
+			Data:              data,
+		})
+	}
+
+	return refs, nil
+}
+
+// referencedName returns the name of the object which the claim names for a reference. False is returned
+// if the claim doesn't name an object and the reference is optional.
+func referencedName(claim *unstructured.Unstructured, rr v1alpha1.ResourceReference) (string, bool, error) {
+	name, ok, err := evaluateJSONPath(claim, rr.From)
+	if err != nil {
+		return "", false, fmt.Errorf("references[%s]: %v", rr.Name, err)
+	}
+
+	objectName, isString := name.(string)
+	if !ok || !isString || objectName == "" {
+		if rr.Optional {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("references[%s]: the claim doesn't name a %s at %s", rr.Name, rr.Kind, rr.From)
+	}
+
+	return objectName, true, nil
+}
+
+// referenceData returns the data of a secret or config map. Binary data in config maps isn't supported.
+func referenceData(obj *unstructured.Unstructured) (map[string]string, error) {
+	raw, _, err := unstructured.NestedStringMap(obj.Object, "data")
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if obj.GetKind() == v1alpha1.ReferenceKindSecret {
+			decoded, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("decoding key %s: %v", k, err)
+			}
+			v = string(decoded)
+		}
+		data[k] = v
+	}
+
+	return data, nil
+}
+
+// referenceValues returns the contents of the references, in the form that they are passed to engines which
+// render inside of the controller.
+func referenceValues(refs []Reference) map[string]interface{} {
+	values := make(map[string]interface{}, len(refs))
+	for _, ref := range refs {
+		data := make(map[string]interface{}, len(ref.Data))
+		for k, v := range ref.Data {
+			data[k] = v
+		}
+		values[ref.Name] = data
+	}
+	return values
+}
+
+// referenceVolumes returns the volumes for the referenced objects, and where they are mounted in the
+// engine's container.
+func referenceVolumes(refs []Reference) ([]corev1.Volume, []corev1.VolumeMount) {
+	volumes := make([]corev1.Volume, 0, len(refs))
+	mounts := make([]corev1.VolumeMount, 0, len(refs))
+
+	for _, ref := range refs {
+		volumeName := "reference-" + ref.Name
+
+		v := corev1.Volume{Name: volumeName}
+		switch ref.Kind {
+		case v1alpha1.ReferenceKindSecret:
+			v.Secret = &corev1.SecretVolumeSource{SecretName: ref.ObjectName}
+		case v1alpha1.ReferenceKindConfigMap:
+			v.ConfigMap = &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: ref.ObjectName},
+			}
+		}
+
+		volumes = append(volumes, v)
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: referencesDir + ref.Name,
+			ReadOnly:  true,
+		})
+	}
+
+	return volumes, mounts
+}
+
+// referenceVersions identifies the versions of the referenced objects, so that a job is run again when one of
+// them changes.
+func referenceVersions(refs []Reference) []string {
+	versions := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		versions = append(versions, fmt.Sprintf("%s=%s/%s@%s", ref.Name, ref.Kind, ref.ObjectName, ref.ResourceVersion))
+	}
+	return versions
+}
+
+// setFileArgs returns the helm arguments which pass the referenced files to a chart as values. Values files
+// are passed with valuesFileArgs instead.
+func setFileArgs(refs []Reference) []string {
+	args := make([]string, 0)
+	for _, ref := range refs {
+		if ref.ValuesKey != "" {
+			continue
+		}
+		for _, key := range ref.Keys() {
+			args = append(args, "--set-file", fmt.Sprintf("%s.%s.%s=%s%s/%s",
+				referencesValuesKey, ref.Name, escapeValuesKey(key), referencesDir, ref.Name, key))
+		}
+	}
+	return args
+}
+
+// valuesFileArgs returns the helm arguments which pass the referenced values files to a chart, in order.
+func valuesFileArgs(refs []Reference) []string {
+	args := make([]string, 0)
+	for _, ref := range refs {
+		if ref.ValuesKey != "" {
+			args = append(args, "--values", referencesDir+ref.Name+"/"+ref.ValuesKey)
+		}
+	}
+	return args
+}
+
+// escapeValuesKey escapes the dots in a key, such as tls.crt, so that helm doesn't treat them as nesting.
+// Keys can only have alphanumerics, '-', '_' and '.' in them, so dots are the only problem.
+func escapeValuesKey(key string) string {
+	return strings.Replace(key, ".", `\.`, -1)
+}
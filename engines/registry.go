@@ -0,0 +1,147 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EngineOptions are passed to an engine's constructor when a hook is run.
+type EngineOptions struct {
+	Log logr.Logger
+
+	// ConfigName is the stack configuration which the hook is configured by.
+	ConfigName types.NamespacedName
+
+	// RegistryRoot is where stack files are found on the controller's filesystem, for engines
+	// which render inside of the controller.
+	RegistryRoot string
+
+	// Images are the defaults for the containers of engines which render in jobs.
+	Images ImageOptions
+
+	// ServiceAccountName is the service account which rendered resources are applied as. Engines
+	// which render in jobs run their jobs as this service account.
+	ServiceAccountName string
+
+	// ApplyClient is a client which acts as the service account, for engines which apply rendered
+	// resources from inside of the controller.
+	ApplyClient client.Client
+
+	// References are the secrets and config maps which the hook references, resolved for the claim.
+	References []Reference
+
+	// ReleaseName and Namespace are the name and namespace which the helm engines install a chart as. If
+	// they aren't set, the claim's name and namespace are used. Other engines ignore them.
+	ReleaseName string
+	Namespace   string
+}
+
+// An EngineConstructor creates a runner for an engine.
+type EngineConstructor func(opts EngineOptions) ResourceEngineRunner
+
+// Engine describes an engine which can be referenced by type from a stack configuration.
+type Engine struct {
+	// Type is the name which stack configurations use to refer to the engine.
+	Type string
+
+	// ConfigFileName is the name of the file which the engine's configuration is passed in,
+	// if the engine is configured with a file.
+	ConfigFileName string
+
+	// DefaultImage is the image which the engine runs in, for engines which render in jobs.
+	DefaultImage string
+
+	// References is whether the engine passes a hook's references to what it renders. Hooks for engines
+	// which don't can't have references.
+	References bool
+
+	// ReadsSources is whether the engine reads config map and URL sources itself, with ReadSourceFiles,
+	// rather than in a job. Those sources don't need to be prepared for the engine's hooks.
+	ReadsSources bool
+
+	New EngineConstructor
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Engine{}
+)
+
+// Register makes an engine available by its type name. Engines register themselves when the
+// package is initialized. Registering two engines with the same type is a programming error,
+// so it panics.
+func Register(e Engine) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[e.Type]; ok {
+		panic(fmt.Sprintf("engine type %q is already registered", e.Type))
+	}
+	registry[e.Type] = e
+}
+
+// Lookup returns the engine which is registered with the given type. An error is returned if there is
+// no such engine, which lists the engine types which are registered.
+func Lookup(engineType string) (Engine, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	e, ok := registry[engineType]
+	if !ok {
+		return Engine{}, fmt.Errorf("engine type %q is not registered; registered engine types are %v", engineType, registeredTypes())
+	}
+	return e, nil
+}
+
+// Types returns the type names of all of the registered engines, in sorted order.
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	return registeredTypes()
+}
+
+// ReferenceTypes returns the type names of the registered engines which pass references to what they
+// render, in sorted order.
+func ReferenceTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	t := make([]string, 0, len(registry))
+	for engineType, e := range registry {
+		if e.References {
+			t = append(t, engineType)
+		}
+	}
+	sort.Strings(t)
+	return t
+}
+
+func registeredTypes() []string {
+	t := make([]string, 0, len(registry))
+	for engineType := range registry {
+		t = append(t, engineType)
+	}
+	sort.Strings(t)
+	return t
+}
@@ -38,6 +38,11 @@ import (
 // which are being created. For example, if the resources are created asynchronously (say by running a Job), the
 // output the first time the engine is run may be the status of the Job. The next time, if the job is finished, it may
 // be some sort of reference to the objects which have been created.
+//
+// RunEngine returns the status of the hook which it started, so that the render phase can surface it on the claim.
+// It is called on every reconcile, so it should only start the hook again if its inputs have changed since the last
+// time it was started. The hook index is the position of the hook in the list of hooks for the event. For the delete
+// event, the rendered resources should be deleted rather than applied.
 type ResourceEngineRunner interface {
 	CreateConfig(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration) (*corev1.ConfigMap, error)
 
@@ -47,6 +52,25 @@ type ResourceEngineRunner interface {
 		claim *unstructured.Unstructured,
 		config *corev1.ConfigMap,
 		stackSource string,
+		event v1alpha1.EventName,
+		hookIndex int,
+		hc *v1alpha1.HookConfiguration,
+	) (*v1alpha1.HookStatus, error)
+}
+
+// A ResourceEnginePlanner can plan what running a hook would change, without changing anything. It is called
+// with the same arguments as RunEngine, and like RunEngine, it is called on every reconcile, so it should only
+// start planning the hook again if its inputs have changed. What the hook would prune isn't planned by the
+// engine; see PlanPrune.
+type ResourceEnginePlanner interface {
+	PlanEngine(
+		ctx context.Context,
+		client client.Client,
+		claim *unstructured.Unstructured,
+		config *corev1.ConfigMap,
+		stackSource string,
+		event v1alpha1.EventName,
+		hookIndex int,
 		hc *v1alpha1.HookConfiguration,
-	) (*unstructured.Unstructured, error)
+	) (*v1alpha1.HookPlan, error)
 }
@@ -0,0 +1,452 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// The first step of a render job loads the hook's directory from the stack's source into the stack volume:
+// - A stack image copies the directory out of its own registry root
+// - An OCI artifact is pulled by its digest, which verifies it
+// - A git repository is cloned, and the pinned commit is checked out
+// - A tarball from a URL or a config map is checked against its digest before it is unpacked
+//
+// Every source other than an image is loaded by the source image, with the details of the source passed in
+// environment variables rather than in the script. A config map can't be mounted in another namespace, so
+// the tarball of a config map source is copied to the claim's namespace first, by PrepareSource.
+//
+// Engines which render inside of the controller read config map and URL sources themselves, with
+// ReadSourceFiles, so no job is run for them, and nothing needs to be copied. They still load git and OCI
+// sources with a job; see LoadStackFiles.
+//
+// Copies are shared by every claim in the namespace which uses the same tarball, so each of the claims is one
+// of the copy's owners. A claim lets go of a copy once none of its jobs mount it, with ReleaseSources, and the
+// copy is deleted when it has no owners left.
+
+const (
+	// A config map source's tarball is mounted here.
+	sourceVolumeName = "stack-source"
+	sourceDir        = "/usr/share/stack-source/"
+
+	// This is the default key of the tarball in a config map source, and the key of the tarball in its copy.
+	sourceTarballKey = "stack.tar.gz"
+
+	// Sources are loaded here before the hook's directory is copied out of them.
+	sourceLoadDir = "/tmp/source"
+
+	// These limit the size of a tarball which is read in process, and how many of them are cached.
+	maxSourceTarballSize    = 32 << 20
+	maxCachedSourceTarballs = 16
+)
+
+// LabelStackSource is put on the copies of config map sources, so that they can be found again.
+var LabelStackSource = v1alpha1.GroupVersion.Group + "/stack-source"
+
+// loadStackContainer returns the container which loads the hook's directory from the stack's source, and the
+// volumes which it needs besides the stack volume.
+func loadStackContainer(
+	source v1alpha1.StackConfigurationSource, directory string, images ImageOptions, pullPolicy corev1.PullPolicy,
+) (corev1.Container, []corev1.Volume) {
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      stackVolumeName,
+			MountPath: stackDestDir,
+		},
+	}
+
+	if source.Image != "" || source.IsZero() {
+		return corev1.Container{
+			Name:  "load-stack",
+			Image: source.Image,
+			Command: []string{
+				// The "." suffix causes the cp -R to copy the contents of the directory instead of
+				// the directory itself
+				"cp", "-R", fmt.Sprintf("%s/%s/.", DefaultRegistryRoot, directory), stackDestDir,
+			},
+			VolumeMounts:    mounts,
+			ImagePullPolicy: pullPolicy,
+		}, nil
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "DIRECTORY", Value: directory},
+		{Name: "SOURCE", Value: sourceLoadDir},
+		{Name: "DEST", Value: stackDestDir},
+	}
+	var volumes []corev1.Volume
+	var fetch string
+
+	switch {
+	case source.OCI != nil:
+		env = append(env,
+			corev1.EnvVar{Name: "REFERENCE", Value: source.OCI.Reference},
+			corev1.EnvVar{Name: "DIGEST", Value: source.OCI.Digest},
+		)
+		fetch = `oras pull "$REFERENCE@$DIGEST" --output "$SOURCE"`
+
+	case source.Git != nil:
+		env = append(env,
+			corev1.EnvVar{Name: "REPOSITORY", Value: source.Git.Repository},
+			corev1.EnvVar{Name: "REVISION", Value: source.Git.Revision},
+		)
+		fetch = `git clone --quiet --no-checkout "$REPOSITORY" "$SOURCE"
+git -C "$SOURCE" checkout --quiet --detach "$REVISION"
+[ "$(git -C "$SOURCE" rev-parse HEAD)" = "$REVISION" ] || { echo "checked out the wrong revision" >&2; exit 1; }`
+
+	case source.URL != nil:
+		env = append(env,
+			corev1.EnvVar{Name: "URL", Value: source.URL.URL},
+			corev1.EnvVar{Name: "DIGEST", Value: source.URL.Digest},
+		)
+		fetch = `curl --fail --silent --show-error --location "$URL" --output /tmp/stack.tar.gz
+` + unpackScript("/tmp/stack.tar.gz")
+
+	case source.ConfigMap != nil:
+		env = append(env, corev1.EnvVar{Name: "DIGEST", Value: source.ConfigMap.Digest})
+		fetch = unpackScript(sourceDir + sourceTarballKey)
+
+		volumes = append(volumes, corev1.Volume{
+			Name: sourceVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: sourceConfigMapName(source.ConfigMap.Digest)},
+				},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      sourceVolumeName,
+			MountPath: sourceDir,
+			ReadOnly:  true,
+		})
+	}
+
+	return corev1.Container{
+		Name:    "load-stack",
+		Image:   images.sourceImage(),
+		Command: []string{"sh", "-c"},
+		Args: []string{`set -e
+mkdir -p "$SOURCE"
+` + fetch + `
+cp -R "$SOURCE/$DIRECTORY/." "$DEST"
+`},
+		Env:             env,
+		VolumeMounts:    mounts,
+		ImagePullPolicy: pullPolicy,
+	}, volumes
+}
+
+// unpackScript returns the script which verifies a tarball against $DIGEST, and unpacks it into $SOURCE.
+func unpackScript(tarball string) string {
+	return `echo "${DIGEST#sha256:}  ` + tarball + `" | sha256sum -c -
+tar -xzf ` + tarball + ` -C "$SOURCE"`
+}
+
+// sourceConfigMapName returns the name of the copy of a config map source in a claim's namespace. Copies are
+// named after the tarball's digest, so that every copy of the same tarball is the same.
+func sourceConfigMapName(digest string) string {
+	return "stack-source-" + strings.TrimPrefix(digest, "sha256:")
+}
+
+// PrepareSource makes a stack's source available to the render jobs of a claim. Only config map sources need
+// to be prepared: the tarball is copied from the stack configuration's namespace to the claim's namespace,
+// once its digest has been verified, and the claim is made one of the copy's owners. The copy is made with the
+// controller's client, because the stack's service account can't read the stack configuration's namespace.
+func PrepareSource(
+	ctx context.Context, kube client.Client, configNamespace string, claim *unstructured.Unstructured, source v1alpha1.StackConfigurationSource,
+) error {
+	if source.ConfigMap == nil {
+		return nil
+	}
+
+	name := sourceConfigMapName(source.ConfigMap.Digest)
+	owner := meta.AsOwner(meta.ReferenceTo(claim, claim.GroupVersionKind()))
+
+	// Config maps are read as unstructured objects, so that they are read from the api server rather than
+	// from a cache.
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+	err := kube.Get(ctx, types.NamespacedName{Namespace: claim.GetNamespace(), Name: name}, existing)
+	if err == nil {
+		if ownerIndex(existing, claim.GetUID()) >= 0 {
+			return nil
+		}
+		// The update fails if anything else changed the copy since it was read, so no owners are lost.
+		meta.AddOwnerReference(existing, owner)
+		return kube.Update(ctx, existing)
+	}
+	if !kerrors.IsNotFound(err) {
+		return err
+	}
+
+	tarball, err := readConfigMapSource(ctx, kube, configNamespace, source.ConfigMap)
+	if err != nil {
+		return err
+	}
+
+	cp := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       claim.GetNamespace(),
+			Name:            name,
+			Labels:          map[string]string{LabelStackSource: "true"},
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		BinaryData: map[string][]byte{sourceTarballKey: tarball},
+	}
+	if err := kube.Create(ctx, cp); err != nil {
+		if kerrors.IsAlreadyExists(err) {
+			// Another claim made the copy first, so this claim still needs to be one of its owners.
+			return fmt.Errorf("source: config map %s/%s was created while it was being copied", claim.GetNamespace(), name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// readConfigMapSource returns the tarball of a config map source in the stack configuration's namespace, once
+// its digest has been verified.
+func readConfigMapSource(ctx context.Context, kube client.Client, configNamespace string, source *v1alpha1.ConfigMapSource) ([]byte, error) {
+	key := source.Key
+	if key == "" {
+		key = sourceTarballKey
+	}
+
+	// Config maps are read as unstructured objects, so that they are read from the api server rather than
+	// from a cache.
+	cm := &unstructured.Unstructured{}
+	cm.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+	if err := kube.Get(ctx, types.NamespacedName{Namespace: configNamespace, Name: source.Name}, cm); err != nil {
+		return nil, fmt.Errorf("source: config map %s/%s: %v", configNamespace, source.Name, err)
+	}
+
+	encoded, ok, err := unstructured.NestedString(cm.Object, "binaryData", key)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("source: config map %s/%s has no binary data under %s", configNamespace, source.Name, key)
+	}
+	tarball, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("source: decoding config map %s/%s: %v", configNamespace, source.Name, err)
+	}
+
+	if err := verifyDigest(tarball, source.Digest); err != nil {
+		return nil, fmt.Errorf("source: config map %s/%s: %v", configNamespace, source.Name, err)
+	}
+	return tarball, nil
+}
+
+// readURLSource downloads the tarball of a URL source, and verifies its digest.
+func readURLSource(ctx context.Context, source *v1alpha1.URLSource) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, source.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("source: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("source: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("source: downloading %s: %s", source.URL, resp.Status)
+	}
+
+	// The digest can only be checked once the whole tarball has been read, so anything larger than a stack
+	// could reasonably be is refused.
+	tarball, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSourceTarballSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("source: downloading %s: %v", source.URL, err)
+	}
+	if len(tarball) > maxSourceTarballSize {
+		return nil, fmt.Errorf("source: %s is larger than %d bytes", source.URL, maxSourceTarballSize)
+	}
+
+	if err := verifyDigest(tarball, source.Digest); err != nil {
+		return nil, fmt.Errorf("source: %s: %v", source.URL, err)
+	}
+	return tarball, nil
+}
+
+// verifyDigest returns an error unless the tarball has the given digest.
+func verifyDigest(tarball []byte, digest string) error {
+	if actual := fmt.Sprintf("sha256:%x", sha256.Sum256(tarball)); actual != digest {
+		return fmt.Errorf("the digest is %s, not %s", actual, digest)
+	}
+	return nil
+}
+
+// ReadsSourceInProcess returns true if ReadSourceFiles can read the files of the given source, without a job.
+func ReadsSourceInProcess(source v1alpha1.StackConfigurationSource) bool {
+	return source.ConfigMap != nil || source.URL != nil
+}
+
+// ReadSourceFiles reads the files of a hook's directory from a config map or URL source inside of the
+// controller, rather than with a job, and returns them keyed by their paths relative to the directory. The
+// config map is read from the stack configuration's namespace with the given client, so it doesn't need to
+// be copied to the claim's namespace first. The tarballs are addressed by their digests, so they are cached
+// once they have been verified.
+func ReadSourceFiles(
+	ctx context.Context, kube client.Client, configNamespace string, source v1alpha1.StackConfigurationSource, directory string,
+) (map[string][]byte, error) {
+	var digest string
+	switch {
+	case source.ConfigMap != nil:
+		digest = source.ConfigMap.Digest
+	case source.URL != nil:
+		digest = source.URL.Digest
+	default:
+		return nil, fmt.Errorf("source: only config map and URL sources can be read without a job")
+	}
+
+	tarball, ok := sourceTarballs.get(digest)
+	if !ok {
+		var err error
+		if source.ConfigMap != nil {
+			tarball, err = readConfigMapSource(ctx, kube, configNamespace, source.ConfigMap)
+		} else {
+			tarball, err = readURLSource(ctx, source.URL)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sourceTarballs.add(digest, tarball)
+	}
+
+	files, err := unpackFiles(tarball)
+	if err != nil {
+		return nil, fmt.Errorf("source: unpacking the stack's files: %v", err)
+	}
+	return directoryFiles(files, directory)
+}
+
+// directoryFiles returns the files under a directory of the stack, keyed by their paths relative to the
+// directory.
+func directoryFiles(files map[string][]byte, directory string) (map[string][]byte, error) {
+	prefix := path.Clean("/" + directory)[1:]
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	inDirectory := map[string][]byte{}
+	for name, contents := range files {
+		if strings.HasPrefix(name, prefix) {
+			inDirectory[strings.TrimPrefix(name, prefix)] = contents
+		}
+	}
+
+	if len(inDirectory) == 0 {
+		return nil, fmt.Errorf("source: directory %q has no files in it", directory)
+	}
+	return inDirectory, nil
+}
+
+// A tarballCache holds the tarballs of sources which have been read in process, by their digests. It holds
+// a limited number of them, and forgets an arbitrary one when it is full.
+type tarballCache struct {
+	mu       sync.Mutex
+	tarballs map[string][]byte
+}
+
+var sourceTarballs = &tarballCache{}
+
+func (c *tarballCache) get(digest string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tarball, ok := c.tarballs[digest]
+	return tarball, ok
+}
+
+func (c *tarballCache) add(digest string, tarball []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tarballs == nil {
+		c.tarballs = map[string][]byte{}
+	}
+	for d := range c.tarballs {
+		if len(c.tarballs) < maxCachedSourceTarballs {
+			break
+		}
+		delete(c.tarballs, d)
+	}
+	c.tarballs[digest] = tarball
+}
+
+// ReleaseSources removes a claim from the owners of the source copies in its namespace which aren't in use by
+// any of its jobs. Copies which the claim was the last owner of are deleted.
+func ReleaseSources(ctx context.Context, kube client.Client, claim *unstructured.Unstructured, inUse map[string]bool) error {
+	copies := &unstructured.UnstructuredList{}
+	copies.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMapList"))
+	if err := kube.List(ctx, copies,
+		client.InNamespace(claim.GetNamespace()),
+		client.MatchingLabels{LabelStackSource: "true"},
+	); err != nil {
+		return err
+	}
+
+	for i := range copies.Items {
+		cp := &copies.Items[i]
+		index := ownerIndex(cp, claim.GetUID())
+		if index < 0 || inUse[cp.GetName()] {
+			continue
+		}
+
+		owners := cp.GetOwnerReferences()
+		if len(owners) == 1 {
+			if err := kube.Delete(ctx, cp); err != nil && !kerrors.IsNotFound(err) {
+				return err
+			}
+			continue
+		}
+
+		cp.SetOwnerReferences(append(owners[:index:index], owners[index+1:]...))
+		if err := kube.Update(ctx, cp); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ownerIndex returns the index of the owner reference with the given UID, or -1 if there isn't one.
+func ownerIndex(o metav1.Object, uid types.UID) int {
+	for i, ref := range o.GetOwnerReferences() {
+		if ref.UID == uid {
+			return i
+		}
+	}
+	return -1
+}
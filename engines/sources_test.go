@@ -0,0 +1,321 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// testTarball returns a gzipped tarball of the given files, and its digest.
+func testTarball(t *testing.T, files map[string]string) ([]byte, string) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, contents := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), fmt.Sprintf("sha256:%x", sha256.Sum256(buf.Bytes()))
+}
+
+func TestReadSourceFiles(t *testing.T) {
+	tarball, digest := testTarball(t, map[string]string{
+		"./widget/widget.yaml":         "kind: Widget",
+		"./widget/_helpers.tpl":        "{{ define \"name\" }}{{ end }}",
+		"./widget-other/gadget.yaml":   "kind: Gadget",
+		"./widget/nested/service.yaml": "kind: Service",
+	})
+	want := map[string][]byte{
+		"widget.yaml":         []byte("kind: Widget"),
+		"_helpers.tpl":        []byte("{{ define \"name\" }}{{ end }}"),
+		"nested/service.yaml": []byte("kind: Service"),
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/stack.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer server.Close()
+
+	kube := fake.NewFakeClientWithScheme(scheme.Scheme, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "stacks", Name: "widget-stack"},
+		BinaryData: map[string][]byte{"stack.tar.gz": tarball},
+	})
+
+	cases := map[string]struct {
+		source    v1alpha1.StackConfigurationSource
+		directory string
+		want      map[string][]byte
+		wantErr   string
+	}{
+		"ConfigMap": {
+			source:    v1alpha1.StackConfigurationSource{ConfigMap: &v1alpha1.ConfigMapSource{Name: "widget-stack", Digest: digest}},
+			directory: "widget",
+			want:      want,
+		},
+		"ConfigMapWithWrongDigest": {
+			source:    v1alpha1.StackConfigurationSource{ConfigMap: &v1alpha1.ConfigMapSource{Name: "widget-stack", Digest: "sha256:1111"}},
+			directory: "widget",
+			wantErr:   "not sha256:1111",
+		},
+		"MissingConfigMap": {
+			source:    v1alpha1.StackConfigurationSource{ConfigMap: &v1alpha1.ConfigMapSource{Name: "missing", Digest: "sha256:2222"}},
+			directory: "widget",
+			wantErr:   "config map stacks/missing",
+		},
+		"URL": {
+			source:    v1alpha1.StackConfigurationSource{URL: &v1alpha1.URLSource{URL: server.URL + "/stack.tar.gz", Digest: digest}},
+			directory: "./widget/",
+			want:      want,
+		},
+		"URLNotFound": {
+			source:    v1alpha1.StackConfigurationSource{URL: &v1alpha1.URLSource{URL: server.URL + "/missing.tar.gz", Digest: "sha256:3333"}},
+			directory: "widget",
+			wantErr:   "404",
+		},
+		"MissingDirectory": {
+			source:    v1alpha1.StackConfigurationSource{ConfigMap: &v1alpha1.ConfigMapSource{Name: "widget-stack", Digest: digest}},
+			directory: "gadget",
+			wantErr:   `directory "gadget" has no files in it`,
+		},
+		"Git": {
+			source:  v1alpha1.StackConfigurationSource{Git: &v1alpha1.GitSource{Repository: "https://example.org/widgets.git"}},
+			wantErr: "can be read without a job",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sourceTarballs = &tarballCache{}
+
+			got, err := ReadSourceFiles(context.Background(), kube, "stacks", tc.source, tc.directory)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("ReadSourceFiles(...): %v", err)
+			case tc.wantErr != "" && err == nil:
+				t.Fatalf("ReadSourceFiles(...): got no error, want %q", tc.wantErr)
+			case tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr):
+				t.Fatalf("ReadSourceFiles(...): got %q, want it to contain %q", err, tc.wantErr)
+			}
+			if tc.wantErr == "" && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ReadSourceFiles(...): got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// The tarball is cached by its digest, so it's only downloaded once.
+	sourceTarballs = &tarballCache{}
+	requests = 0
+	url := cases["URL"]
+	for i := 0; i < 2; i++ {
+		if _, err := ReadSourceFiles(context.Background(), kube, "stacks", url.source, url.directory); err != nil {
+			t.Fatalf("ReadSourceFiles(...): %v", err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("ReadSourceFiles(...): downloaded the tarball %d times, want once", requests)
+	}
+}
+
+// sourceClaim returns a claim in the default namespace with the given name, whose UID is its name.
+func sourceClaim(name string) *unstructured.Unstructured {
+	claim := valuesClaim()
+	claim.SetName(name)
+	claim.SetUID(types.UID(name))
+	return claim
+}
+
+// sourceOwners returns the UIDs of the owners of a source copy, or nil if there is no copy.
+func sourceOwners(t *testing.T, kube client.Client, name string) []types.UID {
+	cp := &corev1.ConfigMap{}
+	err := kube.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, cp)
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owners := make([]types.UID, 0, len(cp.GetOwnerReferences()))
+	for _, ref := range cp.GetOwnerReferences() {
+		owners = append(owners, ref.UID)
+	}
+	return owners
+}
+
+func TestPrepareSource(t *testing.T) {
+	tarball, digest := testTarball(t, map[string]string{"./widget/widget.yaml": "kind: Widget"})
+	kube := fake.NewFakeClientWithScheme(scheme.Scheme, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "stacks", Name: "widget-stack"},
+		BinaryData: map[string][]byte{"stack.tar.gz": tarball},
+	})
+	ctx := context.Background()
+	source := v1alpha1.StackConfigurationSource{ConfigMap: &v1alpha1.ConfigMapSource{Name: "widget-stack", Digest: digest}}
+	name := sourceConfigMapName(digest)
+
+	// The first claim gets a copy of the tarball in its namespace.
+	if err := PrepareSource(ctx, kube, "stacks", sourceClaim("first"), source); err != nil {
+		t.Fatalf("PrepareSource(first): %v", err)
+	}
+	cp := &corev1.ConfigMap{}
+	if err := kube.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, cp); err != nil {
+		t.Fatalf("PrepareSource(first): no copy: %v", err)
+	}
+	if !bytes.Equal(cp.BinaryData[sourceTarballKey], tarball) {
+		t.Errorf("PrepareSource(first): the copy doesn't have the tarball in it")
+	}
+	if cp.GetLabels()[LabelStackSource] != "true" {
+		t.Errorf("PrepareSource(first): the copy isn't labelled as a source")
+	}
+
+	// Preparing the source again changes nothing.
+	if err := PrepareSource(ctx, kube, "stacks", sourceClaim("first"), source); err != nil {
+		t.Fatalf("PrepareSource(first) again: %v", err)
+	}
+	if got, want := sourceOwners(t, kube, name), []types.UID{"first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PrepareSource(first): got owners %v, want %v", got, want)
+	}
+
+	// A second claim with the same source shares the copy.
+	if err := PrepareSource(ctx, kube, "stacks", sourceClaim("second"), source); err != nil {
+		t.Fatalf("PrepareSource(second): %v", err)
+	}
+	if got, want := sourceOwners(t, kube, name), []types.UID{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PrepareSource(second): got owners %v, want %v", got, want)
+	}
+
+	// A tarball with the wrong digest isn't copied.
+	wrong := v1alpha1.StackConfigurationSource{ConfigMap: &v1alpha1.ConfigMapSource{Name: "widget-stack", Digest: "sha256:1111"}}
+	err := PrepareSource(ctx, kube, "stacks", sourceClaim("first"), wrong)
+	if err == nil || !strings.Contains(err.Error(), "not sha256:1111") {
+		t.Errorf("PrepareSource(wrong digest): got error %v, want it to contain %q", err, "not sha256:1111")
+	}
+	if got := sourceOwners(t, kube, sourceConfigMapName("sha256:1111")); got != nil {
+		t.Errorf("PrepareSource(wrong digest): made a copy owned by %v", got)
+	}
+}
+
+func TestReleaseSources(t *testing.T) {
+	sourceCopy := func(name string, owners ...string) *corev1.ConfigMap {
+		cp := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Labels:    map[string]string{LabelStackSource: "true"},
+		}}
+		for _, owner := range owners {
+			cp.OwnerReferences = append(cp.OwnerReferences, metav1.OwnerReference{
+				APIVersion: "example.org/v1alpha1",
+				Kind:       "Widget",
+				Name:       owner,
+				UID:        types.UID(owner),
+			})
+		}
+		return cp
+	}
+
+	cases := map[string]struct {
+		copies []*corev1.ConfigMap
+		inUse  map[string]bool
+		want   map[string][]types.UID
+	}{
+		"SharedCopy": {
+			copies: []*corev1.ConfigMap{sourceCopy("stack-source-1", "other", "widget")},
+			want:   map[string][]types.UID{"stack-source-1": {"other"}},
+		},
+		"LastOwner": {
+			copies: []*corev1.ConfigMap{sourceCopy("stack-source-1", "widget")},
+			want:   map[string][]types.UID{"stack-source-1": nil},
+		},
+		"CopyInUse": {
+			copies: []*corev1.ConfigMap{sourceCopy("stack-source-1", "widget")},
+			inUse:  map[string]bool{"stack-source-1": true},
+			want:   map[string][]types.UID{"stack-source-1": {"widget"}},
+		},
+		"CopyOfAnotherClaim": {
+			copies: []*corev1.ConfigMap{sourceCopy("stack-source-1", "other")},
+			want:   map[string][]types.UID{"stack-source-1": {"other"}},
+		},
+		"SeveralCopies": {
+			copies: []*corev1.ConfigMap{
+				sourceCopy("stack-source-1", "widget"),
+				sourceCopy("stack-source-2", "widget", "other"),
+				sourceCopy("stack-source-3", "other", "widget"),
+			},
+			inUse: map[string]bool{"stack-source-3": true},
+			want: map[string][]types.UID{
+				"stack-source-1": nil,
+				"stack-source-2": {"other"},
+				"stack-source-3": {"other", "widget"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			objs := make([]runtime.Object, 0, len(tc.copies))
+			for _, cp := range tc.copies {
+				objs = append(objs, cp)
+			}
+			kube := fake.NewFakeClientWithScheme(scheme.Scheme, objs...)
+
+			if err := ReleaseSources(context.Background(), kube, sourceClaim("widget"), tc.inUse); err != nil {
+				t.Fatalf("ReleaseSources(...): %v", err)
+			}
+			for cp, want := range tc.want {
+				if got := sourceOwners(t, kube, cp); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: got owners %v, want %v", cp, got, want)
+				}
+			}
+		})
+	}
+}
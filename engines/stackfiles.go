@@ -0,0 +1,276 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// Engines which render inside of the controller can't pull the stack's source themselves, so it is loaded
+// by a job, with the same container that loads the stack in the first step of a render job. Instead of
+// rendering anything, the job packs the hook's directory into a tarball, and hands it back to the
+// controller in a config map with the same name as the job. The config map is created by the controller,
+// like a render job's inventory, and is deleted along with the job once the job is stale.
+//
+// The job only runs again when the source or the directory changes, so the files are usually read from the
+// config map without running anything.
+
+// stackFilesScript packs the stack's files into the job's config map.
+const stackFilesScript = `set -e
+tar -czf /tmp/` + sourceTarballKey + ` -C "$STACK_DIR" .
+kubectl create configmap "$FILES" --namespace "$NAMESPACE" --from-file=` + sourceTarballKey + `=/tmp/` + sourceTarballKey + ` \
+  --dry-run=client -o yaml | kubectl apply --server-side --force-conflicts --field-manager "$FIELD_MANAGER" -f -
+`
+
+// loadJobInputs are the inputs which determine what a load job loads, which are hashed into its name.
+type loadJobInputs struct {
+	Source       v1alpha1.StackConfigurationSource `json:"source"`
+	Directory    string                            `json:"directory"`
+	SourceImage  string                            `json:"sourceImage,omitempty"`
+	ApplierImage string                            `json:"applierImage"`
+
+	// Like a render job, a load job runs again when the way its pod is pulled or run changes.
+	ImagePullPolicy    corev1.PullPolicy             `json:"imagePullPolicy"`
+	ImagePullSecrets   []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	ServiceAccountName string                        `json:"serviceAccountName"`
+}
+
+// LoadStackFiles returns the files of a hook's directory, keyed by their paths relative to the directory. If
+// the job which loads them hasn't succeeded yet, the status of the job is returned instead. Callers pass the
+// hook's image as the stack source, as they do for render jobs.
+func LoadStackFiles(
+	ctx context.Context,
+	kube client.Client,
+	claim *unstructured.Unstructured,
+	stackSource string,
+	event v1alpha1.EventName,
+	hookIndex int,
+	hc *v1alpha1.HookConfiguration,
+	images ImageOptions,
+	serviceAccountName string,
+) (map[string][]byte, *v1alpha1.HookStatus, error) {
+	job, err := newLoadJob(claim, stackSource, event, hookIndex, hc, images, serviceAccountName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hs, err := runJob(ctx, kube, job)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hs.Phase != v1alpha1.HookPhaseSucceeded {
+		return nil, hs, nil
+	}
+
+	// Config maps are read as unstructured objects, so that they are read from the api server rather than
+	// from a cache.
+	cm := &unstructured.Unstructured{}
+	cm.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ConfigMap"))
+	if err := kube.Get(ctx, types.NamespacedName{Namespace: job.GetNamespace(), Name: job.GetName()}, cm); err != nil {
+		return nil, nil, err
+	}
+
+	encoded, ok, err := unstructured.NestedString(cm.Object, "binaryData", sourceTarballKey)
+	if err != nil || !ok {
+		return nil, nil, fmt.Errorf("job %s didn't record the stack's files", job.GetName())
+	}
+	tarball, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := unpackFiles(tarball)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unpacking the stack's files from job %s: %v", job.GetName(), err)
+	}
+
+	return files, hs, nil
+}
+
+// newLoadJob builds the job which loads a hook's directory from the stack's source. The job runs as the
+// given service account, which can update its config map in the same way as a render job's inventory.
+func newLoadJob(
+	claim *unstructured.Unstructured,
+	stackSource string,
+	event v1alpha1.EventName,
+	hookIndex int,
+	hc *v1alpha1.HookConfiguration,
+	images ImageOptions,
+	serviceAccountName string,
+) (*batchv1.Job, error) {
+	var jobBackoff int32
+
+	applierImage := images.applierImage(hc)
+	pullPolicy := images.imagePullPolicy(hc)
+	pullSecrets := images.imagePullSecrets(hc)
+
+	source := hc.Source
+	if stackSource != "" {
+		source = v1alpha1.StackConfigurationSource{Image: stackSource}
+	}
+	loadStack, sourceVolumes := loadStackContainer(source, hc.Directory, images, pullPolicy)
+
+	inputs := loadJobInputs{
+		Source:       source,
+		Directory:    hc.Directory,
+		ApplierImage: applierImage,
+
+		ImagePullPolicy:    pullPolicy,
+		ImagePullSecrets:   pullSecrets,
+		ServiceAccountName: serviceAccountName,
+	}
+	if source.Image == "" {
+		inputs.SourceImage = images.sourceImage()
+	}
+	h, err := hashObject(inputs)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%d-%s", claim.GetUID(), hookIndex, h)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: claim.GetNamespace(),
+			Labels:    jobLabels(claim, event, hookIndex),
+			OwnerReferences: []metav1.OwnerReference{
+				meta.AsController(meta.ReferenceTo(claim, claim.GroupVersionKind())),
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &jobBackoff,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy:      corev1.RestartPolicyNever,
+					ServiceAccountName: serviceAccountName,
+					ImagePullSecrets:   pullSecrets,
+					InitContainers:     []corev1.Container{loadStack},
+					Containers: []corev1.Container{
+						{
+							Name:    "kubectl",
+							Image:   applierImage,
+							Command: []string{"sh", "-c"},
+							Args:    []string{stackFilesScript},
+							Env: []corev1.EnvVar{
+								{Name: "STACK_DIR", Value: stackDestDir},
+								{Name: "FILES", Value: name},
+								{Name: "NAMESPACE", Value: claim.GetNamespace()},
+								{Name: "FIELD_MANAGER", Value: FieldManager(claim, hookIndex)},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									Name:      stackVolumeName,
+									MountPath: stackDestDir,
+								},
+							},
+							ImagePullPolicy: pullPolicy,
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: stackVolumeName,
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, sourceVolumes...)
+
+	return job, nil
+}
+
+// unpackFiles returns the regular files in a gzipped tarball, keyed by their cleaned paths.
+func unpackFiles(tarball []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("%q is outside of the stack's directory", hdr.Name)
+		}
+
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = contents
+	}
+}
+
+// readStackDirectory returns the files under a directory on the local filesystem, keyed by their paths
+// relative to the directory.
+func readStackDirectory(dir string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(name)] = contents
+		return nil
+	})
+	return files, err
+}
@@ -16,20 +16,38 @@ limitations under the License.
 package engines
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 
+	"github.com/crossplaneio/crossplane-runtime/pkg/meta"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/kubectl/pkg/util/hash"
+	"sigs.k8s.io/yaml"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+const (
+	spec = "spec"
+
+	// The number of characters of a hash which are used in generated names.
+	nameHashLength = 10
 )
 
 // The main reason this exists as its own method is to encapsulate the hashing logic
-func generateConfigMap(name string, fileName string, fileContents string, log logr.Logger) (*corev1.ConfigMap, error) {
+func generateConfigMap(name string, files map[string]string, log logr.Logger) (*corev1.ConfigMap, error) {
 	cm := &corev1.ConfigMap{}
 	cm.Name = name
 	cm.Data = map[string]string{}
 
-	cm.Data[fileName] = fileContents
+	for fileName, fileContents := range files {
+		cm.Data[fileName] = fileContents
+	}
 	h, err := hash.ConfigMapHash(cm)
 	if err != nil {
 		log.V(0).Info("Error hashing config map!", "error", err)
@@ -39,3 +57,73 @@ func generateConfigMap(name string, fileName string, fileContents string, log lo
 
 	return cm, nil
 }
+
+// hashObject returns a short, stable hash of an object's json representation, which is suitable
+// for using in a generated name.
+func hashObject(o interface{}) (string, error) {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:nameHashLength], nil
+}
+
+// valuesYAML marshals the inputs for a hook's engine as yaml, along with the reserved claim and stack
+// blocks, which is how the claim is passed to engines which are configured with a values file.
+func valuesYAML(
+	claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration, configName types.NamespacedName, log logr.Logger,
+) (string, error) {
+	// TODO if spec is missing, this won't work very well
+	if _, ok := claim.Object[spec]; !ok && len(hc.Values) == 0 {
+		log.V(0).Info("Spec not found on claim; not creating engine configuration", "claim", claim)
+	}
+
+	s, err := claimValues(claim, hc)
+	if err != nil {
+		log.V(0).Info("Error mapping claim to engine values!", "claim", claim, "error", err)
+		return "", err
+	}
+
+	values := withContext(s, claim, hc, configName)
+
+	log.V(0).Info("Converting configuration", "values", values)
+	configContents, err := yaml.Marshal(values)
+
+	log.V(0).Info("Configuration contents as yaml", "configContents", configContents)
+
+	if err != nil {
+		log.Error(err, "Error marshaling engine values as yaml!", "claim", claim)
+		return "", err
+	}
+
+	// Underneath, the yamler uses https://godoc.org/encoding/json#Marshal,
+	// which means that the bytes are UTF-8 encoded
+	// Theoretically we could get better performance by using a binary config
+	// map, but having a string makes it better for humans who may want to observe
+	// or troubleshoot behavior.
+	return string(configContents), nil
+}
+
+// engineConfigMap generates the config map which passes an engine's configuration files to
+// the engine, in the claim's namespace. The files are keyed by file name. The config map is owned
+// by the claim, and labelled with its UID, so that it can be deleted once no job uses it.
+func engineConfigMap(claim *unstructured.Unstructured, files map[string]string, log logr.Logger) (*corev1.ConfigMap, error) {
+	configName := string(claim.GetUID())
+	generatedMap, err := generateConfigMap(configName, files, log)
+
+	if err != nil {
+		log.V(1).Info("Error generating config map", "claim", claim.GetNamespace()+"/"+claim.GetName(), "error", err)
+		return nil, err
+	}
+
+	generatedMap.SetNamespace(claim.GetNamespace())
+	generatedMap.SetLabels(map[string]string{LabelClaimUID: string(claim.GetUID())})
+	generatedMap.SetOwnerReferences([]metav1.OwnerReference{
+		meta.AsOwner(meta.ReferenceTo(claim, claim.GroupVersionKind())),
+	})
+
+	log.V(0).Info("Generated config map to pass engine configuration", "configMap", generatedMap)
+
+	return generatedMap, nil
+}
@@ -0,0 +1,248 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/jsonpath"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+// The inputs of an engine are derived from the claim which triggered the hook. By default, the engine is
+// given the claim's spec, but a hook can instead map the claim's fields to the engine's inputs with value
+// mappings. Every engine uses the inputs in place of the claim's spec:
+// - The helm engines write them to the chart's values file
+// - The kustomize engine puts them in the spec of the local copy of the claim
+// - The gotemplate engine executes its templates against the claim with its spec replaced by them
+//
+// The helm engines also add two reserved blocks to their values, which charts can use to name and label
+// what they render. Values which the claim or the value mappings put under these keys are replaced.
+// - claim has the apiVersion, kind, name, namespace, uid and labels of the claim
+// - stack has the name and namespace of the stack configuration, and the image of the stack
+//
+// The references key is reserved as well, for the contents of referenced secrets and config maps.
+
+// Keys in the values of the helm engines which are reserved for the claim and the stack.
+const (
+	claimValuesKey = "claim"
+	stackValuesKey = "stack"
+)
+
+// claimValues returns the inputs for a hook's engine. If the hook doesn't map any values, the claim's spec
+// is returned as it is, which may be nil if the claim has no spec.
+func claimValues(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration) (interface{}, error) {
+	if len(hc.Values) == 0 {
+		return claim.Object[spec], nil
+	}
+
+	values := map[string]interface{}{}
+	for _, vm := range hc.Values {
+		v, ok, err := evaluateValueMapping(claim, &vm)
+		if err != nil {
+			return nil, fmt.Errorf("values[%s]: %v", vm.To, err)
+		}
+		if !ok {
+			continue
+		}
+
+		if err := setValue(values, vm.To, v); err != nil {
+			return nil, fmt.Errorf("values[%s]: %v", vm.To, err)
+		}
+	}
+
+	return values, nil
+}
+
+// claimWithValues returns a copy of the claim, with its spec replaced by the inputs for a hook's engine. If
+// the hook doesn't map any values, the copy keeps the claim's spec. The claim is always copied, because
+// engines hand it to code such as templates, which could otherwise change the claim that the controller
+// writes back.
+func claimWithValues(claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration) (*unstructured.Unstructured, error) {
+	c := claim.DeepCopy()
+	if len(hc.Values) == 0 {
+		return c, nil
+	}
+
+	values, err := claimValues(claim, hc)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Object[spec] = values
+	return c, nil
+}
+
+// withContext returns the values with the reserved claim and stack blocks added. The values are copied
+// rather than changed, because they may be the claim's own spec. Values which aren't an object can't have
+// blocks added to them, so they are replaced.
+func withContext(
+	values interface{}, claim *unstructured.Unstructured, hc *v1alpha1.HookConfiguration, configName types.NamespacedName,
+) map[string]interface{} {
+	withCtx := map[string]interface{}{}
+	if m, ok := values.(map[string]interface{}); ok {
+		for k, v := range m {
+			withCtx[k] = v
+		}
+	}
+
+	labels := map[string]interface{}{}
+	for k, v := range claim.GetLabels() {
+		labels[k] = v
+	}
+
+	withCtx[claimValuesKey] = map[string]interface{}{
+		"apiVersion": claim.GetAPIVersion(),
+		"kind":       claim.GetKind(),
+		"name":       claim.GetName(),
+		"namespace":  claim.GetNamespace(),
+		"uid":        string(claim.GetUID()),
+		"labels":     labels,
+	}
+	withCtx[stackValuesKey] = map[string]interface{}{
+		"name":      configName.Name,
+		"namespace": configName.Namespace,
+		"image":     hc.Source.Image,
+	}
+
+	return withCtx
+}
+
+// evaluateValueMapping returns the value which a mapping sets its input to. If the mapping doesn't produce
+// a value and has no default, false is returned, and the input is left out.
+func evaluateValueMapping(claim *unstructured.Unstructured, vm *v1alpha1.ValueMapping) (interface{}, bool, error) {
+	switch {
+	case vm.Value != nil:
+		v, err := rawValue(vm.Value)
+		return v, true, err
+
+	case vm.From != "":
+		v, ok, err := evaluateJSONPath(claim, vm.From)
+		if err != nil || ok {
+			return v, ok, err
+		}
+
+	case vm.Template != "":
+		v, err := evaluateTemplate(claim, vm.Template)
+		if err != nil || v != "" {
+			return v, err == nil, err
+		}
+
+	default:
+		return nil, false, fmt.Errorf("one of from, template or value is required")
+	}
+
+	if vm.Default == nil {
+		return nil, false, nil
+	}
+
+	v, err := rawValue(vm.Default)
+	return v, true, err
+}
+
+// evaluateJSONPath evaluates a JSONPath expression against the claim. Missing fields aren't an error; if the
+// expression doesn't match anything, false is returned. If it matches more than one value, the values are
+// returned as a list.
+func evaluateJSONPath(claim *unstructured.Unstructured, expr string) (interface{}, bool, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "{") {
+		expr = "{" + expr + "}"
+	}
+
+	jp := jsonpath.New("value").AllowMissingKeys(true)
+	if err := jp.Parse(expr); err != nil {
+		return nil, false, err
+	}
+
+	results, err := jp.FindResults(claim.Object)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The matches are copied, so that setting other values inside of them doesn't change the claim.
+	matches := make([]interface{}, 0)
+	for _, result := range results {
+		for _, v := range result {
+			matches = append(matches, runtime.DeepCopyJSONValue(v.Interface()))
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, false, nil
+	case 1:
+		return matches[0], true, nil
+	default:
+		return matches, true, nil
+	}
+}
+
+// evaluateTemplate executes a template against the claim, with the same functions as the gotemplate engine.
+// Missing fields render as nothing, as they do in helm, so that a template of only missing fields falls back
+// to the mapping's default.
+func evaluateTemplate(claim *unstructured.Unstructured, text string) (string, error) {
+	t := template.New("value")
+	t.Funcs(templateFuncs(t))
+	if _, err := t.Parse(text); err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, claim.Object); err != nil {
+		return "", err
+	}
+
+	return strings.Replace(buf.String(), "<no value>", "", -1), nil
+}
+
+func rawValue(raw *runtime.RawExtension) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw.Raw, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// setValue sets the value at a dot-separated path in the values, creating the maps along the path.
+func setValue(values map[string]interface{}, path string, v interface{}) error {
+	fields := strings.Split(path, ".")
+
+	m := values
+	for i, field := range fields[:len(fields)-1] {
+		next, ok := m[field]
+		if !ok {
+			next = map[string]interface{}{}
+			m[field] = next
+		}
+
+		nextMap, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is already set to a value which isn't an object", strings.Join(fields[:i+1], "."))
+		}
+		m = nextMap
+	}
+
+	m[fields[len(fields)-1]] = v
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engines
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/suskin/stack-template-engine/api/v1alpha1"
+)
+
+func valuesClaim() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.org/v1alpha1",
+		"kind":       "Widget",
+		"metadata": map[string]interface{}{
+			"name":      "widget",
+			"namespace": "default",
+		},
+		"spec": map[string]interface{}{
+			"size": int64(3),
+			"database": map[string]interface{}{
+				"engine": "postgres",
+			},
+			"users": []interface{}{
+				map[string]interface{}{"name": "alice"},
+				map[string]interface{}{"name": "bob"},
+			},
+		},
+	}}
+}
+
+func raw(json string) *runtime.RawExtension {
+	return &runtime.RawExtension{Raw: []byte(json)}
+}
+
+func TestClaimValues(t *testing.T) {
+	cases := map[string]struct {
+		values  []v1alpha1.ValueMapping
+		want    interface{}
+		wantErr bool
+	}{
+		"NoMappings": {
+			want: valuesClaim().Object["spec"],
+		},
+		"JSONPath": {
+			values: []v1alpha1.ValueMapping{{To: "replicas", From: ".spec.size"}},
+			want:   map[string]interface{}{"replicas": int64(3)},
+		},
+		"JSONPathWithBraces": {
+			values: []v1alpha1.ValueMapping{{To: "replicas", From: "{.spec.size}"}},
+			want:   map[string]interface{}{"replicas": int64(3)},
+		},
+		"JSONPathObject": {
+			values: []v1alpha1.ValueMapping{{To: "db", From: ".spec.database"}},
+			want:   map[string]interface{}{"db": map[string]interface{}{"engine": "postgres"}},
+		},
+		"JSONPathManyMatches": {
+			values: []v1alpha1.ValueMapping{{To: "users", From: ".spec.users[*].name"}},
+			want:   map[string]interface{}{"users": []interface{}{"alice", "bob"}},
+		},
+		"NestedInput": {
+			values: []v1alpha1.ValueMapping{
+				{To: "db.engine", From: ".spec.database.engine"},
+				{To: "db.name", From: ".metadata.name"},
+			},
+			want: map[string]interface{}{"db": map[string]interface{}{"engine": "postgres", "name": "widget"}},
+		},
+		"MissingPath": {
+			values: []v1alpha1.ValueMapping{
+				{To: "replicas", From: ".spec.size"},
+				{To: "storage", From: ".spec.storage.size"},
+			},
+			want: map[string]interface{}{"replicas": int64(3)},
+		},
+		"MissingPathWithDefault": {
+			values: []v1alpha1.ValueMapping{{To: "storage", From: ".spec.storage.size", Default: raw(`"10Gi"`)}},
+			want:   map[string]interface{}{"storage": "10Gi"},
+		},
+		"Template": {
+			values: []v1alpha1.ValueMapping{{To: "name", Template: "{{ .metadata.name }}-{{ .spec.database.engine }}"}},
+			want:   map[string]interface{}{"name": "widget-postgres"},
+		},
+		"TemplateWithFunctions": {
+			values: []v1alpha1.ValueMapping{{To: "name", Template: "{{ .metadata.name | upper }}"}},
+			want:   map[string]interface{}{"name": "WIDGET"},
+		},
+		"TemplateMissingPath": {
+			values: []v1alpha1.ValueMapping{{To: "storage", Template: "{{ .spec.storage }}"}},
+			want:   map[string]interface{}{},
+		},
+		"TemplateMissingPathWithDefault": {
+			values: []v1alpha1.ValueMapping{{To: "storage", Template: "{{ .spec.storage }}", Default: raw(`"10Gi"`)}},
+			want:   map[string]interface{}{"storage": "10Gi"},
+		},
+		"Const": {
+			values: []v1alpha1.ValueMapping{
+				{To: "replicas", Value: raw(`1`)},
+				{To: "tls", Value: raw(`{"enabled": true}`)},
+			},
+			want: map[string]interface{}{"replicas": float64(1), "tls": map[string]interface{}{"enabled": true}},
+		},
+		"InvalidJSONPath": {
+			values:  []v1alpha1.ValueMapping{{To: "replicas", From: ".spec.users[?("}},
+			wantErr: true,
+		},
+		"InvalidTemplate": {
+			values:  []v1alpha1.ValueMapping{{To: "name", Template: "{{ .metadata.name "}},
+			wantErr: true,
+		},
+		"InputUnderAValue": {
+			values: []v1alpha1.ValueMapping{
+				{To: "db", Value: raw(`"postgres"`)},
+				{To: "db.name", From: ".metadata.name"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			claim := valuesClaim()
+			got, err := claimValues(claim, &v1alpha1.HookConfiguration{Values: tc.values})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("claimValues(...): got error %v, want error: %t", err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("claimValues(...): got %#v, want %#v", got, tc.want)
+			}
+			if !reflect.DeepEqual(claim, valuesClaim()) {
+				t.Errorf("claimValues(...): changed the claim to %#v", claim)
+			}
+		})
+	}
+}
+
+func TestClaimWithValuesCopiesTheClaim(t *testing.T) {
+	claim := valuesClaim()
+	hc := &v1alpha1.HookConfiguration{Values: []v1alpha1.ValueMapping{{To: "db", From: ".spec.database"}}}
+
+	for name, hc := range map[string]*v1alpha1.HookConfiguration{"NoMappings": {}, "Mappings": hc} {
+		t.Run(name, func(t *testing.T) {
+			got, err := claimWithValues(claim, hc)
+			if err != nil {
+				t.Fatalf("claimWithValues(...): %v", err)
+			}
+
+			if err := unstructured.SetNestedField(got.Object, "mysql", "spec", "db", "engine"); err != nil {
+				t.Fatal(err)
+			}
+			got.SetName("changed")
+
+			if !reflect.DeepEqual(claim, valuesClaim()) {
+				t.Errorf("claimWithValues(...): changing the copy changed the claim to %#v", claim)
+			}
+		})
+	}
+}
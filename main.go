@@ -17,8 +17,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -29,6 +33,7 @@ import (
 
 	helmv1alpha1 "github.com/suskin/stack-template-engine/api/v1alpha1"
 	"github.com/suskin/stack-template-engine/controllers"
+	"github.com/suskin/stack-template-engine/engines"
 )
 
 var (
@@ -46,13 +51,54 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var registryRoot string
+	var enableWebhooks bool
+	images := engines.DefaultImageOptions()
+	var imagePullPolicy string
+	var imagePullSecrets string
+	var resolveImageDigests bool
+	var permissionsRole string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&registryRoot, "registry-root", engines.DefaultRegistryRoot,
+		"The directory where stack files are found, for engines which render inside of the controller.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", os.Getenv("ENABLE_WEBHOOKS") == "true",
+		"Enable the admission webhooks. The webhook server needs a serving certificate, which is usually provided by cert-manager. "+
+			"Defaults to true if the ENABLE_WEBHOOKS environment variable is \"true\".")
+	flag.Var(engineImages(images.EngineImages), "engine-image",
+		"The default image for an engine type, as type=image. May be given once for each engine type.")
+	flag.StringVar(&images.ApplierImage, "applier-image", engines.DefaultApplierImage,
+		"The default image which applies rendered resources to the cluster.")
+	flag.StringVar(&images.SourceImage, "source-image", engines.DefaultSourceImage,
+		"The image which loads the files of stacks which don't come from an image.")
+	flag.StringVar(&imagePullPolicy, "image-pull-policy", string(engines.DefaultImagePullPolicy),
+		"The default pull policy for the images of render jobs. One of Always, IfNotPresent or Never.")
+	flag.StringVar(&imagePullSecrets, "image-pull-secrets", "",
+		"A comma-separated list of secrets which are used by default to pull the images of render jobs.")
+	flag.BoolVar(&resolveImageDigests, "resolve-image-digests", false,
+		"Resolve the tags of stack images to digests, and render from the digests. Tags are resolved anonymously, "+
+			"so private images, and images which are only available on the cluster's nodes, are rendered from their tags.")
+	flag.StringVar(&permissionsRole, "stack-permissions-role", controllers.DefaultPermissionsRole,
+		"The cluster role whose rules limit the permissions which stack configurations can be granted. "+
+			"The controller needs to be bound to it as well.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.Logger(true))
 
+	switch corev1.PullPolicy(imagePullPolicy) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		images.ImagePullPolicy = corev1.PullPolicy(imagePullPolicy)
+	default:
+		setupLog.Error(fmt.Errorf("unknown image pull policy %q", imagePullPolicy), "invalid flags")
+		os.Exit(1)
+	}
+	for _, name := range strings.Split(imagePullSecrets, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			images.ImagePullSecrets = append(images.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -68,10 +114,33 @@ func main() {
 		Client:  mgr.GetClient(),
 		Log:     ctrl.Log.WithName("controllers").WithName("StackConfiguration"),
 		Manager: mgr,
+
+		RegistryRoot:        registryRoot,
+		Images:              images,
+		ResolveImageDigests: resolveImageDigests,
+		PermissionsRole:     permissionsRole,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "StackConfiguration")
 		os.Exit(1)
 	}
+	if err = (&controllers.HelmChartInstallReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("HelmChartInstall"),
+		Images: images,
+
+		Config: mgr.GetConfig(),
+		Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "HelmChartInstall")
+		os.Exit(1)
+	}
+	if enableWebhooks {
+		if err = (&helmv1alpha1.StackConfiguration{}).SetupWebhookWithManager(mgr, engines.Types(), engines.ReferenceTypes()); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "StackConfiguration")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -80,3 +149,28 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// engineImages is a flag which sets the default images of engines, by engine type.
+type engineImages map[string]string
+
+func (e engineImages) String() string {
+	pairs := make([]string, 0, len(e))
+	for engineType, image := range e {
+		pairs = append(pairs, engineType+"="+image)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (e engineImages) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+		return fmt.Errorf("%q is not in the format type=image", value)
+	}
+	if _, err := engines.Lookup(pair[0]); err != nil {
+		return err
+	}
+
+	e[pair[0]] = pair[1]
+	return nil
+}
@@ -0,0 +1,6 @@
+{{/*
+Expand the name of the claim's resources.
+*/}}
+{{- define "name" -}}
+{{- default .metadata.name .spec.nameOverride | trunc 63 | trimSuffix "-" -}}
+{{- end -}}